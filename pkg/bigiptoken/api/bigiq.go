@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ManagedDevice represents a BIG-IP device managed by BIG-IQ
+type ManagedDevice struct {
+	UUID      string `json:"uuid"`
+	Hostname  string `json:"hostname"`
+	Address   string `json:"address"`
+	Product   string `json:"product"`
+	Version   string `json:"version"`
+	MachineID string `json:"machineId"`
+}
+
+// managedDeviceListResponse represents the response from listing BIG-IQ managed devices
+type managedDeviceListResponse struct {
+	Items []ManagedDevice `json:"items"`
+}
+
+// ListManagedDevices returns every BIG-IP device managed by the BIG-IQ the
+// client is connected to
+func (c *Client) ListManagedDevices(authToken string) ([]ManagedDevice, error) {
+	// Construct the URL for the device resolver group holding every BIG-IP
+	url := fmt.Sprintf("%s/mgmt/shared/resolver/device-groups/cm-bigip-allBigIpDevices/devices", c.Host)
+
+	// Create request
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating device list request: %w", err)
+	}
+
+	// Set token header
+	req.Header.Set("X-F5-Auth-Token", authToken)
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making device list request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading device list response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing managed devices: %s - %s", resp.Status, string(body))
+	}
+
+	// Parse the response
+	var listResp managedDeviceListResponse
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("error parsing device list response: %w", err)
+	}
+
+	return listResp.Items, nil
+}
@@ -4,19 +4,70 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// ErrAuthentication is returned when the F5 BIG-IP rejects the supplied credentials
+var ErrAuthentication = errors.New("authentication rejected by F5 BIG-IP")
+
+// ErrTransport is returned when the F5 BIG-IP could not be reached at all
+var ErrTransport = errors.New("unable to reach F5 BIG-IP")
+
+// DeviceClient is the token API of one management host. Client implements
+// it for TMOS-based BIG-IP and BIG-IQ, F5OSClient for F5OS and NextCMClient
+// for BIG-IP Next Central Manager. Operations a
+// platform has no equivalent for return an error wrapping errors.ErrUnsupported.
+type DeviceClient interface {
+	// GetToken logs in, falling back to the secondary credential set
+	GetToken(timeout int64) (*TokenResponse, error)
+	// GetTokenWithCredential logs in with one named credential set only
+	GetTokenWithCredential(credential string, timeout int64) (*TokenResponse, error)
+	// RefreshToken extends a token's lifetime; the returned token may differ.
+	// token is the refresh token on platforms that issue one.
+	RefreshToken(token string, timeout int64) (*TokenResponse, error)
+	// RevokeToken logs a token out
+	RevokeToken(token string) error
+	// DeleteToken revokes a token using a different token for authentication
+	DeleteToken(authToken, token string) error
+	// ListTokens returns the tokens held by the device
+	ListTokens(authToken string) ([]TokenItem, error)
+	// GetVersion returns the software version of the device
+	GetVersion(authToken string) (*SystemVersion, error)
+	// GetFailoverStatus returns the HA failover state of the device
+	GetFailoverStatus(authToken string) (*FailoverStatus, error)
+	// CertificateExpiry returns when the management certificate expires
+	CertificateExpiry() (time.Time, error)
+}
+
+// Credential names reported on a TokenResponse
+const (
+	CredentialPrimary   = "primary"
+	CredentialSecondary = "secondary"
+)
+
 // Client represents an F5 BIG-IP API client
 type Client struct {
 	Host       string
 	Username   string
 	Password   string
 	HTTPClient *http.Client
+
+	// SecondaryUsername and SecondaryPassword are tried when the device
+	// rejects the primary credentials; both are optional
+	SecondaryUsername string
+	SecondaryPassword string
+
+	// Platform is the kind of device (PlatformBIGIP or PlatformBIGIQ), and
+	// LoginProvider overrides the platform's default login provider
+	Platform      string
+	LoginProvider string
 }
 
 // TokenResponse represents the response from a token authentication request
@@ -25,7 +76,73 @@ type TokenResponse struct {
 		Token    string `json:"token"`
 		Timeout  int64  `json:"timeout"`
 		ExpireAt string `json:"expireTime,omitempty"`
+
+		// Device-clock timestamps, in microseconds since the epoch
+		ExpirationMicros int64 `json:"expirationMicros,omitempty"`
+		LastUpdateMicros int64 `json:"lastUpdateMicros,omitempty"`
 	} `json:"token"`
+
+	// Credential is which credential set obtained the token, and Username
+	// the user it was issued to
+	Credential string `json:"-"`
+	Username   string `json:"-"`
+
+	// RefreshToken is issued alongside the access token by platforms that
+	// refresh with a separate token, such as BIG-IP Next Central Manager
+	RefreshToken string `json:"-"`
+}
+
+// TokenItem represents a token held in the F5 BIG-IP's authz token store
+type TokenItem struct {
+	Token            string `json:"token"`
+	UserName         string `json:"userName"`
+	Timeout          int64  `json:"timeout"`
+	StartTime        string `json:"startTime,omitempty"`
+	ExpirationMicros int64  `json:"expirationMicros"`
+	LastUpdateMicros int64  `json:"lastUpdateMicros"`
+	User             struct {
+		Link string `json:"link"`
+	} `json:"user"`
+}
+
+// Owner returns the name of the user the token was issued to
+func (t *TokenItem) Owner() string {
+	if t.UserName != "" {
+		return t.UserName
+	}
+	// Older TMOS versions only reference the user by link
+	return t.User.Link[strings.LastIndex(t.User.Link, "/")+1:]
+}
+
+// TokenListResponse represents the response from listing the authz token store
+type TokenListResponse struct {
+	Items []TokenItem `json:"items"`
+}
+
+// SystemVersion represents the software version reported by /mgmt/tm/sys/version
+type SystemVersion struct {
+	Product string
+	Version string
+	Build   string
+	Edition string
+}
+
+// FailoverStatus represents the HA state reported by /mgmt/tm/cm/failover-status
+type FailoverStatus struct {
+	Status  string
+	Color   string
+	Summary string
+}
+
+// statsResponse represents the nested stats format used by /mgmt/tm stats endpoints
+type statsResponse struct {
+	Entries map[string]struct {
+		NestedStats struct {
+			Entries map[string]struct {
+				Description string `json:"description"`
+			} `json:"entries"`
+		} `json:"nestedStats"`
+	} `json:"entries"`
 }
 
 // TokenRequest represents a token request to the F5 BIG-IP
@@ -56,18 +173,64 @@ func NewClient(host, username, password string, insecureSSL bool) *Client {
 		Username:   username,
 		Password:   password,
 		HTTPClient: httpClient,
+		Platform:   PlatformBIGIP,
 	}
 }
 
-// GetToken authenticates to the F5 BIG-IP and retrieves an authentication token
+// HasSecondary reports whether a secondary credential set is configured
+func (c *Client) HasSecondary() bool {
+	return c.SecondaryUsername != "" && c.SecondaryPassword != ""
+}
+
+// GetToken authenticates to the F5 BIG-IP and retrieves an authentication
+// token. If the device rejects the primary credentials and a secondary set
+// is configured, the secondary set is tried before giving up.
 func (c *Client) GetToken(timeout int64) (*TokenResponse, error) {
+	return getTokenWithFallback(c.GetTokenWithCredential, c.HasSecondary(), timeout)
+}
+
+// getTokenWithFallback logs in with the primary credential set and, if the
+// device rejects it and a secondary set exists, with the secondary set
+func getTokenWithFallback(login func(credential string, timeout int64) (*TokenResponse, error), hasSecondary bool, timeout int64) (*TokenResponse, error) {
+	tokenResp, err := login(CredentialPrimary, timeout)
+	if err == nil || !errors.Is(err, ErrAuthentication) || !hasSecondary {
+		return tokenResp, err
+	}
+
+	tokenResp, secondaryErr := login(CredentialSecondary, timeout)
+	if secondaryErr != nil {
+		return nil, fmt.Errorf("primary credential: %w; secondary credential: %w", err, secondaryErr)
+	}
+
+	return tokenResp, nil
+}
+
+// GetTokenWithCredential authenticates with one named credential set only
+func (c *Client) GetTokenWithCredential(credential string, timeout int64) (*TokenResponse, error) {
+	username, password := c.Username, c.Password
+	switch credential {
+	case CredentialPrimary:
+	case CredentialSecondary:
+		if !c.HasSecondary() {
+			return nil, fmt.Errorf("no secondary credential configured")
+		}
+		username, password = c.SecondaryUsername, c.SecondaryPassword
+	default:
+		return nil, fmt.Errorf("unknown credential %q", credential)
+	}
+
+	if limit := c.limits().MaxTimeout; timeout > limit {
+		return nil, fmt.Errorf("timeout %d exceeds the %s maximum of %d seconds", timeout, c.Platform, limit)
+	}
+
 	// Construct the URL for token authentication
 	url := fmt.Sprintf("%s/mgmt/shared/authn/login", c.Host)
 
 	// Create the token request payload
 	tokenReq := TokenRequest{
-		Username: c.Username,
-		Password: c.Password,
+		Username:          username,
+		Password:          password,
+		LoginProviderName: c.loginProvider(),
 	}
 
 	// Convert payload to JSON
@@ -88,7 +251,7 @@ func (c *Client) GetToken(timeout int64) (*TokenResponse, error) {
 	// Send the request
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making token request: %w", err)
+		return nil, fmt.Errorf("error making token request: %w: %w", ErrTransport, err)
 	}
 	defer resp.Body.Close()
 
@@ -99,6 +262,9 @@ func (c *Client) GetToken(timeout int64) (*TokenResponse, error) {
 	}
 
 	// Check response status code
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s - %s", ErrAuthentication, resp.Status, string(body))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("error authenticating to F5 BIG-IP: %s - %s", resp.Status, string(body))
 	}
@@ -108,21 +274,29 @@ func (c *Client) GetToken(timeout int64) (*TokenResponse, error) {
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
 		return nil, fmt.Errorf("error parsing token response: %w", err)
 	}
+	tokenResp.Credential = credential
+	tokenResp.Username = username
 
 	// If a custom timeout is specified, update the token timeout
 	if timeout > 0 {
-		err = c.UpdateTokenTimeout(tokenResp.Token.Token, timeout)
+		updated, err := c.UpdateTokenTimeout(tokenResp.Token.Token, timeout)
 		if err != nil {
 			return nil, fmt.Errorf("error updating token timeout: %w", err)
 		}
 		tokenResp.Token.Timeout = timeout
+		if updated.Timeout > 0 {
+			// The device may cap the requested timeout
+			tokenResp.Token.Timeout = updated.Timeout
+		}
+		tokenResp.Token.ExpirationMicros = updated.ExpirationMicros
+		tokenResp.Token.LastUpdateMicros = updated.LastUpdateMicros
 	}
 
 	return &tokenResp, nil
 }
 
-// UpdateTokenTimeout updates the timeout for a token
-func (c *Client) UpdateTokenTimeout(token string, timeout int64) error {
+// UpdateTokenTimeout updates the timeout for a token and returns the updated token resource
+func (c *Client) UpdateTokenTimeout(token string, timeout int64) (*TokenItem, error) {
 	// Construct the URL for token timeout update
 	url := fmt.Sprintf("%s/mgmt/shared/authz/tokens/%s", c.Host, token)
 
@@ -136,13 +310,13 @@ func (c *Client) UpdateTokenTimeout(token string, timeout int64) error {
 	// Convert payload to JSON
 	payloadBytes, err := json.Marshal(timeoutReq)
 	if err != nil {
-		return fmt.Errorf("error marshaling timeout request: %w", err)
+		return nil, fmt.Errorf("error marshaling timeout request: %w", err)
 	}
 
 	// Create request
 	req, err := http.NewRequest("PATCH", url, bytes.NewReader(payloadBytes))
 	if err != nil {
-		return fmt.Errorf("error creating timeout update request: %w", err)
+		return nil, fmt.Errorf("error creating timeout update request: %w", err)
 	}
 
 	// Set headers
@@ -152,26 +326,63 @@ func (c *Client) UpdateTokenTimeout(token string, timeout int64) error {
 	// Send the request
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error making timeout update request: %w", err)
+		return nil, fmt.Errorf("error making timeout update request: %w: %w", ErrTransport, err)
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading timeout update response: %w", err)
+		return nil, fmt.Errorf("error reading timeout update response: %w", err)
 	}
 
 	// Check response status code
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error updating token timeout: %s - %s", resp.Status, string(body))
+		return nil, fmt.Errorf("error updating token timeout: %s - %s", resp.Status, string(body))
 	}
 
-	return nil
+	// Parse the updated token resource
+	var item TokenItem
+	if err := json.Unmarshal(body, &item); err != nil {
+		return nil, fmt.Errorf("error parsing timeout update response: %w", err)
+	}
+
+	return &item, nil
+}
+
+// RefreshToken sets a new timeout on a token. TMOS keeps the token value,
+// so the same token is returned with its new expiry.
+func (c *Client) RefreshToken(token string, timeout int64) (*TokenResponse, error) {
+	if limit := c.limits().MaxTimeout; timeout > limit {
+		return nil, fmt.Errorf("timeout %d exceeds the %s maximum of %d seconds", timeout, c.Platform, limit)
+	}
+
+	updated, err := c.UpdateTokenTimeout(token, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResp TokenResponse
+	tokenResp.Token.Token = token
+	tokenResp.Token.Timeout = timeout
+	if updated.Timeout > 0 {
+		tokenResp.Token.Timeout = updated.Timeout
+	}
+	tokenResp.Token.ExpirationMicros = updated.ExpirationMicros
+	tokenResp.Token.LastUpdateMicros = updated.LastUpdateMicros
+	tokenResp.Username = updated.Owner()
+
+	return &tokenResp, nil
 }
 
 // RevokeToken revokes an authentication token
 func (c *Client) RevokeToken(token string) error {
+	return c.DeleteToken(token, token)
+}
+
+// DeleteToken revokes a token using a different token for authentication,
+// which allows an administrative session to remove other users' tokens
+func (c *Client) DeleteToken(authToken, token string) error {
 	// Construct the URL for token revocation
 	url := fmt.Sprintf("%s/mgmt/shared/authz/tokens/%s", c.Host, token)
 
@@ -182,12 +393,12 @@ func (c *Client) RevokeToken(token string) error {
 	}
 
 	// Set headers
-	req.Header.Set("X-F5-Auth-Token", token)
+	req.Header.Set("X-F5-Auth-Token", authToken)
 
 	// Send the request
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error making token revocation request: %w", err)
+		return fmt.Errorf("error making token revocation request: %w: %w", ErrTransport, err)
 	}
 	defer resp.Body.Close()
 
@@ -203,8 +414,8 @@ func (c *Client) RevokeToken(token string) error {
 
 // ValidateToken checks if a token is valid
 func (c *Client) ValidateToken(token string) (bool, error) {
-	// Construct the URL for a simple validation (getting system version)
-	url := fmt.Sprintf("%s/mgmt/tm/sys/version", c.Host)
+	// Construct the URL for a simple validation of the platform
+	url := c.Host + c.limits().ValidationPath
 
 	// Create request
 	req, err := http.NewRequest("GET", url, nil)
@@ -218,7 +429,7 @@ func (c *Client) ValidateToken(token string) (bool, error) {
 	// Send the request
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("error making validation request: %w", err)
+		return false, fmt.Errorf("error making validation request: %w: %w", ErrTransport, err)
 	}
 	defer resp.Body.Close()
 
@@ -235,3 +446,161 @@ func (c *Client) ValidateToken(token string) (bool, error) {
 	// Any other status is an error
 	return false, fmt.Errorf("unexpected status when validating token: %s", resp.Status)
 }
+
+// ListTokens returns all tokens held in the F5 BIG-IP's authz token store
+func (c *Client) ListTokens(authToken string) ([]TokenItem, error) {
+	// Construct the URL for the token store
+	url := fmt.Sprintf("%s/mgmt/shared/authz/tokens", c.Host)
+
+	// Create request
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token list request: %w", err)
+	}
+
+	// Set token header
+	req.Header.Set("X-F5-Auth-Token", authToken)
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making token list request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token list response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing tokens: %s - %s", resp.Status, string(body))
+	}
+
+	// Parse the response
+	var listResp TokenListResponse
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("error parsing token list response: %w", err)
+	}
+
+	return listResp.Items, nil
+}
+
+// GetVersion returns the software version of the F5 BIG-IP or BIG-IQ
+func (c *Client) GetVersion(authToken string) (*SystemVersion, error) {
+	if c.Platform == PlatformBIGIQ {
+		version, err := c.getDeviceInfo(authToken)
+		if err != nil {
+			return nil, fmt.Errorf("error getting system version: %w", err)
+		}
+		return version, nil
+	}
+
+	stats, err := c.getStats(authToken, "/mgmt/tm/sys/version")
+	if err != nil {
+		return nil, fmt.Errorf("error getting system version: %w", err)
+	}
+
+	return &SystemVersion{
+		Product: stats["Product"],
+		Version: stats["Version"],
+		Build:   stats["Build"],
+		Edition: stats["Edition"],
+	}, nil
+}
+
+// GetFailoverStatus returns the HA failover state of the F5 BIG-IP
+func (c *Client) GetFailoverStatus(authToken string) (*FailoverStatus, error) {
+	stats, err := c.getStats(authToken, "/mgmt/tm/cm/failover-status")
+	if err != nil {
+		return nil, fmt.Errorf("error getting failover status: %w", err)
+	}
+
+	return &FailoverStatus{
+		Status:  stats["status"],
+		Color:   stats["color"],
+		Summary: stats["summary"],
+	}, nil
+}
+
+// getStats fetches a /mgmt/tm stats endpoint and flattens the descriptions of its first entry
+func (c *Client) getStats(authToken, path string) (map[string]string, error) {
+	// Create request
+	req, err := http.NewRequest("GET", c.Host+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Set token header
+	req.Header.Set("X-F5-Auth-Token", authToken)
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s - %s", resp.Status, string(body))
+	}
+
+	// Parse the response
+	var statsResp statsResponse
+	if err := json.Unmarshal(body, &statsResp); err != nil {
+		return nil, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	stats := make(map[string]string)
+	for _, entry := range statsResp.Entries {
+		for key, value := range entry.NestedStats.Entries {
+			stats[key] = value.Description
+		}
+		break
+	}
+
+	return stats, nil
+}
+
+// CertificateExpiry returns the expiry time of the certificate presented by
+// the F5 BIG-IP management interface. The certificate is read without
+// verification so that self-signed device certificates can be inspected.
+func (c *Client) CertificateExpiry() (time.Time, error) {
+	return certificateExpiry(c.Host)
+}
+
+// certificateExpiry reads the certificate presented by a management host
+func certificateExpiry(host string) (time.Time, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing host: %w", err)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error connecting to management interface: %w: %w", ErrTransport, err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, fmt.Errorf("management interface presented no certificate")
+	}
+
+	return certs[0].NotAfter, nil
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// F5OS RESTCONF endpoints used by F5OSClient
+const (
+	f5osLoginPath   = "/restconf/data/openconfig-system:system/aaa"
+	f5osLogoutPath  = "/restconf/operations/openconfig-system:system/aaa/authentication/f5-aaa-confd-restconf-token:logout"
+	f5osVersionPath = "/restconf/data/openconfig-system:system/f5-system-version:version"
+)
+
+// f5osTokenHeader carries F5OS session tokens in both directions
+const f5osTokenHeader = "X-Auth-Token"
+
+// f5osTokenLifetime is how long, in seconds, an F5OS token lasts unless refreshed
+const f5osTokenLifetime = 900
+
+// Compile-time checks that every client implements DeviceClient
+var (
+	_ DeviceClient = (*Client)(nil)
+	_ DeviceClient = (*F5OSClient)(nil)
+	_ DeviceClient = (*NextCMClient)(nil)
+)
+
+// F5OSClient represents an F5OS (rSeries and VELOS) RESTCONF API client.
+// F5OS has no login endpoint: any request authenticated with basic auth
+// returns a session token in the X-Auth-Token header, and each request
+// made with a token returns a refreshed one.
+type F5OSClient struct {
+	Host       string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+
+	// SecondaryUsername and SecondaryPassword are tried when the device
+	// rejects the primary credentials; both are optional
+	SecondaryUsername string
+	SecondaryPassword string
+}
+
+// f5osVersionResponse represents the response from the F5OS system version endpoint
+type f5osVersionResponse struct {
+	Version struct {
+		OSVersion      string `json:"os-version"`
+		ServiceVersion string `json:"service-version"`
+		Product        string `json:"product"`
+	} `json:"f5-system-version:version"`
+}
+
+// NewF5OSClient creates a new F5OS client
+func NewF5OSClient(host, username, password string, insecureSSL bool) *F5OSClient {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSSL},
+	}
+
+	httpClient := &http.Client{
+		Transport: tr,
+		Timeout:   time.Second * 30,
+	}
+
+	// Ensure host starts with https://
+	if !strings.HasPrefix(host, "https://") {
+		host = "https://" + host
+	}
+
+	return &F5OSClient{
+		Host:       host,
+		Username:   username,
+		Password:   password,
+		HTTPClient: httpClient,
+	}
+}
+
+// HasSecondary reports whether a secondary credential set is configured
+func (c *F5OSClient) HasSecondary() bool {
+	return c.SecondaryUsername != "" && c.SecondaryPassword != ""
+}
+
+// GetToken authenticates to the F5OS device and retrieves a session token,
+// falling back to the secondary credential set if the primary is rejected
+func (c *F5OSClient) GetToken(timeout int64) (*TokenResponse, error) {
+	return getTokenWithFallback(c.GetTokenWithCredential, c.HasSecondary(), timeout)
+}
+
+// GetTokenWithCredential authenticates with one named credential set only.
+// F5OS tokens have a fixed lifetime, so timeout can only shorten how long
+// the caller intends to use the token, not extend it.
+func (c *F5OSClient) GetTokenWithCredential(credential string, timeout int64) (*TokenResponse, error) {
+	username, password := c.Username, c.Password
+	switch credential {
+	case CredentialPrimary:
+	case CredentialSecondary:
+		if !c.HasSecondary() {
+			return nil, fmt.Errorf("no secondary credential configured")
+		}
+		username, password = c.SecondaryUsername, c.SecondaryPassword
+	default:
+		return nil, fmt.Errorf("unknown credential %q", credential)
+	}
+
+	if limit := MaxTokenTimeout(PlatformF5OS); timeout > limit {
+		return nil, fmt.Errorf("timeout %d exceeds the %s maximum of %d seconds", timeout, PlatformF5OS, limit)
+	}
+
+	// Create request
+	req, err := http.NewRequest("GET", c.Host+f5osLoginPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request: %w", err)
+	}
+
+	// Set headers
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Accept", "application/yang-data+json")
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making token request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s - %s", ErrAuthentication, resp.Status, string(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error authenticating to F5OS: %s - %s", resp.Status, string(body))
+	}
+
+	token := resp.Header.Get(f5osTokenHeader)
+	if token == "" {
+		return nil, fmt.Errorf("error authenticating to F5OS: no %s header in response", f5osTokenHeader)
+	}
+
+	var tokenResp TokenResponse
+	tokenResp.Token.Token = token
+	tokenResp.Token.Timeout = f5osTokenLifetime
+	if timeout > 0 {
+		tokenResp.Token.Timeout = timeout
+	}
+	tokenResp.Credential = credential
+	tokenResp.Username = username
+
+	return &tokenResp, nil
+}
+
+// RefreshToken exchanges a token for a fresh one with a full lifetime.
+// F5OS returns the refreshed token on any authenticated request; if the
+// device keeps the same value it is returned unchanged.
+func (c *F5OSClient) RefreshToken(token string, timeout int64) (*TokenResponse, error) {
+	if limit := MaxTokenTimeout(PlatformF5OS); timeout > limit {
+		return nil, fmt.Errorf("timeout %d exceeds the %s maximum of %d seconds", timeout, PlatformF5OS, limit)
+	}
+
+	resp, body, err := c.do("GET", f5osLoginPath, token)
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error refreshing token: %s - %s", resp.Status, string(body))
+	}
+
+	var tokenResp TokenResponse
+	tokenResp.Token.Token = token
+	if refreshed := resp.Header.Get(f5osTokenHeader); refreshed != "" {
+		tokenResp.Token.Token = refreshed
+	}
+	tokenResp.Token.Timeout = f5osTokenLifetime
+	if timeout > 0 {
+		tokenResp.Token.Timeout = timeout
+	}
+
+	return &tokenResp, nil
+}
+
+// RevokeToken logs out an F5OS session token. Releases without the logout
+// operation let the token lapse at the end of its lifetime instead.
+func (c *F5OSClient) RevokeToken(token string) error {
+	resp, body, err := c.do("POST", f5osLogoutPath, token)
+	if err != nil {
+		return fmt.Errorf("error making logout request: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	case http.StatusUnauthorized:
+		// The token has already expired or been logged out
+		return nil
+	}
+
+	return fmt.Errorf("error logging out token: %s - %s", resp.Status, string(body))
+}
+
+// DeleteToken logs out a token. F5OS sessions can only log themselves out,
+// so authToken must be the token being revoked.
+func (c *F5OSClient) DeleteToken(authToken, token string) error {
+	if authToken != token {
+		return fmt.Errorf("revoking another session's token: %w", errors.ErrUnsupported)
+	}
+	return c.RevokeToken(token)
+}
+
+// ListTokens is not available on F5OS, which has no token store to read
+func (c *F5OSClient) ListTokens(authToken string) ([]TokenItem, error) {
+	return nil, fmt.Errorf("listing tokens on F5OS: %w", errors.ErrUnsupported)
+}
+
+// GetVersion returns the software version of the F5OS device
+func (c *F5OSClient) GetVersion(authToken string) (*SystemVersion, error) {
+	resp, body, err := c.do("GET", f5osVersionPath, authToken)
+	if err != nil {
+		return nil, fmt.Errorf("error getting system version: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting system version: unexpected status: %s - %s", resp.Status, string(body))
+	}
+
+	var versionResp f5osVersionResponse
+	if err := json.Unmarshal(body, &versionResp); err != nil {
+		return nil, fmt.Errorf("error parsing system version: %w", err)
+	}
+
+	product := versionResp.Version.Product
+	if product == "" {
+		product = "F5OS"
+	}
+
+	return &SystemVersion{
+		Product: product,
+		Version: versionResp.Version.OSVersion,
+		Build:   versionResp.Version.ServiceVersion,
+	}, nil
+}
+
+// GetFailoverStatus is not available on F5OS, which has no TMOS failover state
+func (c *F5OSClient) GetFailoverStatus(authToken string) (*FailoverStatus, error) {
+	return nil, fmt.Errorf("failover status on F5OS: %w", errors.ErrUnsupported)
+}
+
+// CertificateExpiry returns the expiry time of the certificate presented by
+// the F5OS management interface
+func (c *F5OSClient) CertificateExpiry() (time.Time, error) {
+	return certificateExpiry(c.Host)
+}
+
+// do sends a request authenticated with a session token and returns the
+// response with its body already read
+func (c *F5OSClient) do(method, path, token string) (*http.Response, []byte, error) {
+	// Create request
+	req, err := http.NewRequest(method, c.Host+path, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set(f5osTokenHeader, token)
+	req.Header.Set("Accept", "application/yang-data+json")
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	return resp, body, nil
+}
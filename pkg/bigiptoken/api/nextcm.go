@@ -0,0 +1,270 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BIG-IP Next Central Manager endpoints used by NextCMClient
+const (
+	nextcmLoginPath   = "/api/login"
+	nextcmRefreshPath = "/api/token-refresh"
+	nextcmLogoutPath  = "/api/logout"
+)
+
+// nextcmMaxSession is the longest time, in seconds, a Next CM session may
+// be kept alive through refreshes
+const nextcmMaxSession = 36000
+
+// NextCMClient represents a BIG-IP Next Central Manager API client. Next CM
+// issues a short-lived bearer access token together with a refresh token
+// that is exchanged for a new pair before the access token expires.
+type NextCMClient struct {
+	Host       string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+
+	// SecondaryUsername and SecondaryPassword are tried when the device
+	// rejects the primary credentials; both are optional
+	SecondaryUsername string
+	SecondaryPassword string
+}
+
+// nextcmTokenResponse represents the response from the Next CM login and refresh endpoints
+type nextcmTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// NewNextCMClient creates a new BIG-IP Next Central Manager client
+func NewNextCMClient(host, username, password string, insecureSSL bool) *NextCMClient {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSSL},
+	}
+
+	httpClient := &http.Client{
+		Transport: tr,
+		Timeout:   time.Second * 30,
+	}
+
+	// Ensure host starts with https://
+	if !strings.HasPrefix(host, "https://") {
+		host = "https://" + host
+	}
+
+	return &NextCMClient{
+		Host:       host,
+		Username:   username,
+		Password:   password,
+		HTTPClient: httpClient,
+	}
+}
+
+// HasSecondary reports whether a secondary credential set is configured
+func (c *NextCMClient) HasSecondary() bool {
+	return c.SecondaryUsername != "" && c.SecondaryPassword != ""
+}
+
+// GetToken logs in to Next CM and retrieves an access and refresh token,
+// falling back to the secondary credential set if the primary is rejected
+func (c *NextCMClient) GetToken(timeout int64) (*TokenResponse, error) {
+	return getTokenWithFallback(c.GetTokenWithCredential, c.HasSecondary(), timeout)
+}
+
+// GetTokenWithCredential logs in with one named credential set only. Next
+// CM decides the access token lifetime; timeout only bounds the session.
+func (c *NextCMClient) GetTokenWithCredential(credential string, timeout int64) (*TokenResponse, error) {
+	username, password := c.Username, c.Password
+	switch credential {
+	case CredentialPrimary:
+	case CredentialSecondary:
+		if !c.HasSecondary() {
+			return nil, fmt.Errorf("no secondary credential configured")
+		}
+		username, password = c.SecondaryUsername, c.SecondaryPassword
+	default:
+		return nil, fmt.Errorf("unknown credential %q", credential)
+	}
+
+	if limit := MaxTokenTimeout(PlatformNextCM); timeout > limit {
+		return nil, fmt.Errorf("timeout %d exceeds the %s maximum of %d seconds", timeout, PlatformNextCM, limit)
+	}
+
+	tokenResp, err := c.postToken(nextcmLoginPath, map[string]string{
+		"username": username,
+		"password": password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokenResp.Credential = credential
+	tokenResp.Username = username
+
+	return tokenResp, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token
+func (c *NextCMClient) RefreshToken(refreshToken string, timeout int64) (*TokenResponse, error) {
+	tokenResp, err := c.postToken(nextcmRefreshPath, map[string]string{
+		"refresh_token": refreshToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing token: %w", err)
+	}
+	return tokenResp, nil
+}
+
+// RevokeToken logs out the session of an access token. An access token the
+// device no longer accepts is treated as logged out.
+func (c *NextCMClient) RevokeToken(token string) error {
+	return c.logout(token, true)
+}
+
+// EndSession logs out the session behind an access and refresh token pair.
+// A lapsed access token cannot log out, yet its refresh token stays valid,
+// so the refresh token is first exchanged for a fresh pair and the new
+// session is logged out. A refresh token the device no longer accepts means
+// the session has already ended.
+func (c *NextCMClient) EndSession(accessToken, refreshToken string) error {
+	if refreshToken == "" {
+		return c.RevokeToken(accessToken)
+	}
+
+	fresh, err := c.RefreshToken(refreshToken, 0)
+	if err != nil {
+		if errors.Is(err, ErrAuthentication) {
+			return nil
+		}
+		return fmt.Errorf("error ending session: %w", err)
+	}
+
+	return c.logout(fresh.Token.Token, false)
+}
+
+// logout logs out the session of an access token. With allowExpired, a
+// token the device rejects as unauthorized counts as logged out.
+func (c *NextCMClient) logout(token string, allowExpired bool) error {
+	// Create request
+	req, err := http.NewRequest("POST", c.Host+nextcmLogoutPath, nil)
+	if err != nil {
+		return fmt.Errorf("error creating logout request: %w", err)
+	}
+
+	// Set token header
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making logout request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized && allowExpired:
+		// The access token has already expired or been logged out
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("error logging out token: %s - %s", resp.Status, string(body))
+}
+
+// DeleteToken logs out a token. Next CM sessions can only log themselves
+// out, so authToken must be the token being revoked.
+func (c *NextCMClient) DeleteToken(authToken, token string) error {
+	if authToken != token {
+		return fmt.Errorf("revoking another session's token: %w", errors.ErrUnsupported)
+	}
+	return c.RevokeToken(token)
+}
+
+// ListTokens is not available on Next CM, which does not expose its sessions
+func (c *NextCMClient) ListTokens(authToken string) ([]TokenItem, error) {
+	return nil, fmt.Errorf("listing tokens on BIG-IP Next Central Manager: %w", errors.ErrUnsupported)
+}
+
+// GetVersion is not available through the Next CM client
+func (c *NextCMClient) GetVersion(authToken string) (*SystemVersion, error) {
+	return nil, fmt.Errorf("system version on BIG-IP Next Central Manager: %w", errors.ErrUnsupported)
+}
+
+// GetFailoverStatus is not available on Next CM, which has no TMOS failover state
+func (c *NextCMClient) GetFailoverStatus(authToken string) (*FailoverStatus, error) {
+	return nil, fmt.Errorf("failover status on BIG-IP Next Central Manager: %w", errors.ErrUnsupported)
+}
+
+// CertificateExpiry returns the expiry time of the certificate presented by
+// the Next CM management interface
+func (c *NextCMClient) CertificateExpiry() (time.Time, error) {
+	return certificateExpiry(c.Host)
+}
+
+// postToken posts a JSON payload to a Next CM token endpoint and parses the
+// access and refresh token it returns
+func (c *NextCMClient) postToken(path string, payload map[string]string) (*TokenResponse, error) {
+	// Convert payload to JSON
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling token request: %w", err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("POST", c.Host+path, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request: %w", err)
+	}
+
+	// Set Content-Type header
+	req.Header.Set("Content-Type", "application/json")
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making token request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s - %s", ErrAuthentication, resp.Status, string(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error authenticating to BIG-IP Next Central Manager: %s - %s", resp.Status, string(body))
+	}
+
+	// Parse the response
+	var pair nextcmTokenResponse
+	if err := json.Unmarshal(body, &pair); err != nil {
+		return nil, fmt.Errorf("error parsing token response: %w", err)
+	}
+	if pair.AccessToken == "" || pair.RefreshToken == "" {
+		return nil, fmt.Errorf("error parsing token response: access or refresh token missing")
+	}
+
+	var tokenResp TokenResponse
+	tokenResp.Token.Token = pair.AccessToken
+	tokenResp.Token.Timeout = pair.ExpiresIn
+	tokenResp.RefreshToken = pair.RefreshToken
+
+	return &tokenResp, nil
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Platforms the clients can talk to. BIG-IP and BIG-IQ use the same login
+// and authz token API through Client, but differ in token limits, login
+// providers and system endpoints. F5OS uses F5OSClient and BIG-IP Next
+// Central Manager NextCMClient.
+const (
+	PlatformBIGIP  = "bigip"
+	PlatformBIGIQ  = "bigiq"
+	PlatformF5OS   = "f5os"
+	PlatformNextCM = "nextcm"
+)
+
+// platformLimits describes how one platform treats authentication tokens
+type platformLimits struct {
+	// MaxTimeout is the longest token timeout, in seconds, the platform accepts
+	MaxTimeout int64
+
+	// DefaultLoginProvider is sent when the client has no LoginProvider set;
+	// empty leaves the choice to the device
+	DefaultLoginProvider string
+
+	// ValidationPath is a cheap authenticated endpoint used to check a token
+	ValidationPath string
+
+	// TokenStore reports whether the device exposes the tokens it holds
+	TokenStore bool
+}
+
+// platforms holds the limits of every supported platform
+var platforms = map[string]platformLimits{
+	PlatformBIGIP: {
+		MaxTimeout:     36000,
+		ValidationPath: "/mgmt/tm/sys/version",
+		TokenStore:     true,
+	},
+	PlatformBIGIQ: {
+		MaxTimeout:           3600,
+		DefaultLoginProvider: "local",
+		ValidationPath:       "/mgmt/shared/identified-devices/config/device-info",
+		TokenStore:           true,
+	},
+	PlatformF5OS: {
+		MaxTimeout:     f5osTokenLifetime,
+		ValidationPath: f5osVersionPath,
+	},
+	PlatformNextCM: {
+		MaxTimeout: nextcmMaxSession,
+	},
+}
+
+// deviceInfo represents the response from /mgmt/shared/identified-devices/config/device-info
+type deviceInfo struct {
+	Product string `json:"product"`
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	Edition string `json:"edition"`
+}
+
+// ValidPlatform reports whether platform is a supported platform name
+func ValidPlatform(platform string) bool {
+	_, ok := platforms[platform]
+	return ok
+}
+
+// Platforms returns the names of every supported platform, sorted
+func Platforms() []string {
+	names := make([]string, 0, len(platforms))
+	for name := range platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasTokenStore reports whether devices of the platform expose the tokens
+// they hold, which reconciliation depends on
+func HasTokenStore(platform string) bool {
+	return limitsFor(platform).TokenStore
+}
+
+// MaxTokenTimeout returns the longest token timeout, in seconds, the
+// platform accepts
+func MaxTokenTimeout(platform string) int64 {
+	return limitsFor(platform).MaxTimeout
+}
+
+// limitsFor returns the limits of a platform, defaulting to BIG-IP
+func limitsFor(platform string) platformLimits {
+	if limits, ok := platforms[platform]; ok {
+		return limits
+	}
+	return platforms[PlatformBIGIP]
+}
+
+// limits returns the limits of the client's platform
+func (c *Client) limits() platformLimits {
+	return limitsFor(c.Platform)
+}
+
+// loginProvider returns the login provider to authenticate against
+func (c *Client) loginProvider() string {
+	if c.LoginProvider != "" {
+		return c.LoginProvider
+	}
+	return c.limits().DefaultLoginProvider
+}
+
+// getDeviceInfo returns the software version reported by the device-info endpoint
+func (c *Client) getDeviceInfo(authToken string) (*SystemVersion, error) {
+	// Create request
+	req, err := http.NewRequest("GET", c.Host+"/mgmt/shared/identified-devices/config/device-info", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Set token header
+	req.Header.Set("X-F5-Auth-Token", authToken)
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s - %s", resp.Status, string(body))
+	}
+
+	// Parse the response
+	var info deviceInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	return &SystemVersion{
+		Product: info.Product,
+		Version: info.Version,
+		Build:   info.Build,
+		Edition: info.Edition,
+	}, nil
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllPartitions is the partition access name granting a role on every partition
+const AllPartitions = "all-partitions"
+
+// ManagedUserDescription starts the description of every user the plugin
+// creates. It marks the account as the plugin's to update; users without it
+// are never modified.
+const ManagedUserDescription = "Managed by Vault"
+
+// ErrUserExists is returned when creating a user whose name is already
+// taken, or when updating a user the plugin does not manage
+var ErrUserExists = errors.New("user already exists")
+
+// UserRoles lists the BIG-IP user roles that can be granted to a managed user
+var UserRoles = []string{
+	"acceleration-policy-editor",
+	"admin",
+	"application-editor",
+	"auditor",
+	"certificate-manager",
+	"firewall-manager",
+	"fraud-protection-manager",
+	"guest",
+	"irule-manager",
+	"manager",
+	"no-access",
+	"operator",
+	"resource-admin",
+	"user-manager",
+	"web-application-security-administrator",
+	"web-application-security-editor",
+}
+
+// PartitionAccess grants a BIG-IP role on one partition, or on all of them
+type PartitionAccess struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// ManagedUser is a local BIG-IP user account maintained by the plugin
+type ManagedUser struct {
+	Name            string            `json:"name,omitempty"`
+	Password        string            `json:"password,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Shell           string            `json:"shell,omitempty"`
+	PartitionAccess []PartitionAccess `json:"partitionAccess"`
+}
+
+// EnsureUser creates a local user or, if it already exists, updates its
+// password, description and partition access to match user. It reports
+// whether the user was created. An existing user whose description does not
+// start with ManagedUserDescription was not created by the plugin and fails
+// with ErrUserExists rather than being taken over.
+func (c *Client) EnsureUser(authToken string, user *ManagedUser) (bool, error) {
+	if !strings.HasPrefix(user.Description, ManagedUserDescription) {
+		return false, fmt.Errorf("user %s description must start with %q", user.Name, ManagedUserDescription)
+	}
+
+	path := "/mgmt/tm/auth/user/" + url.PathEscape(user.Name)
+
+	resp, body, err := c.userRequest("GET", path, authToken, nil)
+	if err != nil {
+		return false, fmt.Errorf("error reading user %s: %w", user.Name, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var existing ManagedUser
+		if err := json.Unmarshal(body, &existing); err != nil {
+			return false, fmt.Errorf("error parsing user %s: %w", user.Name, err)
+		}
+		if !strings.HasPrefix(existing.Description, ManagedUserDescription) {
+			return false, fmt.Errorf("error updating user %s: %w and is not managed by Vault", user.Name, ErrUserExists)
+		}
+
+		update := *user
+		update.Name = ""
+		resp, body, err = c.userRequest("PATCH", path, authToken, &update)
+		if err != nil {
+			return false, fmt.Errorf("error updating user %s: %w", user.Name, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("error updating user %s: %s - %s", user.Name, resp.Status, string(body))
+		}
+		return false, nil
+	case http.StatusNotFound:
+		if err := c.CreateUser(authToken, user); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("error reading user %s: %s - %s", user.Name, resp.Status, string(body))
+}
+
+// CreateUser creates a local user, failing with ErrUserExists rather than
+// taking over an account that already exists
+func (c *Client) CreateUser(authToken string, user *ManagedUser) error {
+	resp, body, err := c.userRequest("POST", "/mgmt/tm/auth/user", authToken, user)
+	if err != nil {
+		return fmt.Errorf("error creating user %s: %w", user.Name, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("error creating user %s: %w", user.Name, ErrUserExists)
+	}
+
+	return fmt.Errorf("error creating user %s: %s - %s", user.Name, resp.Status, string(body))
+}
+
+// DeleteUser removes a local user. Users that no longer exist are treated
+// as deleted.
+func (c *Client) DeleteUser(authToken, name string) error {
+	resp, body, err := c.userRequest("DELETE", "/mgmt/tm/auth/user/"+url.PathEscape(name), authToken, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting user %s: %w", name, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return fmt.Errorf("error deleting user %s: %s - %s", name, resp.Status, string(body))
+}
+
+// userRequest sends a request to the auth user endpoints and returns the
+// response with its body already read. A nil user sends no body.
+func (c *Client) userRequest(method, path, authToken string, user *ManagedUser) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if user != nil {
+		payloadBytes, err := json.Marshal(user)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+		}
+		reqBody = bytes.NewReader(payloadBytes)
+	}
+
+	// Create request
+	req, err := http.NewRequest(method, c.Host+path, reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("X-F5-Auth-Token", authToken)
+	if user != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	return resp, body, nil
+}
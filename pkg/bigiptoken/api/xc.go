@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// F5 Distributed Cloud endpoints used by XCClient. API credentials always
+// live in the tenant's system namespace.
+const (
+	xcNamespace         = "system"
+	xcCredentialsPath   = "/api/web/namespaces/system/api_credentials"
+	xcRevokeCredentials = "/api/web/namespaces/system/revoke/api_credentials"
+)
+
+// XC API credential types
+const (
+	XCCredentialAPIToken       = "API_TOKEN"
+	XCCredentialAPICertificate = "API_CERTIFICATE"
+)
+
+// XCClient represents an F5 Distributed Cloud tenant API client. It
+// authenticates with a bootstrap API token and manages the tenant's API
+// credentials.
+type XCClient struct {
+	TenantURL  string
+	APIToken   string
+	HTTPClient *http.Client
+}
+
+// XCCredential is an API credential created on an XC tenant. Data holds the
+// API token, or the base64-encoded PKCS#12 bundle of an API certificate.
+type XCCredential struct {
+	Name                string `json:"name"`
+	Active              bool   `json:"active"`
+	ExpirationTimestamp string `json:"expiration_timestamp"`
+	Data                string `json:"data"`
+}
+
+// xcCredentialRequest represents the body of an API credential create request
+type xcCredentialRequest struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Spec      struct {
+		Type           string `json:"type"`
+		ExpirationDays int    `json:"expiration_days"`
+		Password       string `json:"password,omitempty"`
+	} `json:"spec"`
+}
+
+// NewXCClient creates a new F5 Distributed Cloud client
+func NewXCClient(tenantURL, apiToken string, insecureSSL bool) *XCClient {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSSL},
+	}
+
+	httpClient := &http.Client{
+		Transport: tr,
+		Timeout:   time.Second * 30,
+	}
+
+	// Ensure the tenant URL starts with https:// and has no trailing slash
+	if !strings.HasPrefix(tenantURL, "https://") {
+		tenantURL = "https://" + tenantURL
+	}
+	tenantURL = strings.TrimSuffix(tenantURL, "/")
+
+	return &XCClient{
+		TenantURL:  tenantURL,
+		APIToken:   apiToken,
+		HTTPClient: httpClient,
+	}
+}
+
+// CreateCredential creates an API credential of the given type that expires
+// on the tenant after expirationDays. API certificates are protected with
+// password, which must be empty for API tokens.
+func (c *XCClient) CreateCredential(name, credentialType string, expirationDays int, password string) (*XCCredential, error) {
+	switch credentialType {
+	case XCCredentialAPIToken:
+		if password != "" {
+			return nil, fmt.Errorf("API tokens do not take a password")
+		}
+	case XCCredentialAPICertificate:
+		if password == "" {
+			return nil, fmt.Errorf("API certificates require a password")
+		}
+	default:
+		return nil, fmt.Errorf("unknown credential type %q", credentialType)
+	}
+	if expirationDays < 1 {
+		return nil, fmt.Errorf("expiration must be at least one day")
+	}
+
+	var payload xcCredentialRequest
+	payload.Name = name
+	payload.Namespace = xcNamespace
+	payload.Spec.Type = credentialType
+	payload.Spec.ExpirationDays = expirationDays
+	payload.Spec.Password = password
+
+	resp, body, err := c.do("POST", xcCredentialsPath, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error creating API credential: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error creating API credential: %s - %s", resp.Status, string(body))
+	}
+
+	var credential XCCredential
+	if err := json.Unmarshal(body, &credential); err != nil {
+		return nil, fmt.Errorf("error parsing API credential: %w", err)
+	}
+	if credential.Data == "" {
+		return nil, fmt.Errorf("error parsing API credential: no credential data in response")
+	}
+	if credential.Name == "" {
+		credential.Name = name
+	}
+
+	return &credential, nil
+}
+
+// RevokeCredential revokes an API credential, which deletes it from the
+// tenant. Credentials that no longer exist are treated as revoked.
+func (c *XCClient) RevokeCredential(name string) error {
+	resp, body, err := c.do("POST", xcRevokeCredentials, map[string]string{
+		"name":      name,
+		"namespace": xcNamespace,
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking API credential: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return fmt.Errorf("error revoking API credential: %s - %s", resp.Status, string(body))
+}
+
+// ListCredentials returns the names of the API credentials on the tenant,
+// which also confirms the bootstrap token is accepted
+func (c *XCClient) ListCredentials() ([]string, error) {
+	resp, body, err := c.do("GET", xcCredentialsPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing API credentials: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing API credentials: %s - %s", resp.Status, string(body))
+	}
+
+	var list struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("error parsing API credentials: %w", err)
+	}
+
+	names := make([]string, 0, len(list.Items))
+	for _, item := range list.Items {
+		names = append(names, item.Name)
+	}
+	return names, nil
+}
+
+// do sends a request authenticated with the bootstrap API token and returns
+// the response with its body already read. A nil payload sends no body.
+func (c *XCClient) do(method, path string, payload interface{}) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+		}
+		reqBody = bytes.NewReader(payloadBytes)
+	}
+
+	// Create request
+	req, err := http.NewRequest(method, c.TenantURL+path, reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Authorization", "APIToken "+c.APIToken)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// Send the request
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making request: %w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	// The bootstrap token was rejected
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, nil, fmt.Errorf("%w: %s - %s", ErrAuthentication, resp.Status, string(body))
+	}
+
+	return resp, body, nil
+}
@@ -2,7 +2,12 @@ package bigiptoken
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -24,7 +29,25 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 // f5TokenBackend defines the F5 BIG-IP token backend structure
 type f5TokenBackend struct {
 	*framework.Backend
-	lock sync.RWMutex
+	lock     sync.RWMutex
+	breakers map[string]*circuitBreaker
+	skews    map[string]clockSkew
+
+	// Host selection state for connections with several management hosts
+	roundRobin       map[string]int
+	activeHosts      map[string]string
+	unreachableHosts map[string]time.Time
+
+	// lastReconcile and lastHealthCheck are when the scheduled reconcile
+	// and background probes last ran on this node
+	lastReconcile   time.Time
+	lastHealthCheck time.Time
+
+	// lastSourceSync is when each BIG-IQ source was last synced on this node
+	lastSourceSync map[string]time.Time
+
+	// serviceUsers serialises issuance per role service user on this node
+	serviceUsers map[string]*sync.Mutex
 }
 
 // Connection represents a connection to an F5 BIG-IP device
@@ -33,6 +56,31 @@ type Connection struct {
 	Username    string `json:"username"`
 	Password    string `json:"password"`
 	InsecureSSL bool   `json:"insecure_ssl"`
+
+	// Hosts lists further management addresses of the same device, such
+	// as the other units of an HA pair, and HostSelection picks between them
+	Hosts         []string `json:"hosts,omitempty"`
+	HostSelection string   `json:"host_selection,omitempty"`
+
+	// Tags are free-form labels used to select connections, e.g. for
+	// groups and list filters; Metadata is descriptive only
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// BreakerThreshold and BreakerCooldown (in seconds) tune the circuit
+	// breaker guarding logins; zero values fall back to the defaults
+	BreakerThreshold int   `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  int64 `json:"breaker_cooldown,omitempty"`
+
+	// SecondaryUsername and SecondaryPassword are an optional second
+	// account used when the device rejects the primary credentials
+	SecondaryUsername string `json:"secondary_username,omitempty"`
+	SecondaryPassword string `json:"secondary_password,omitempty"`
+
+	// Platform is the kind of device, bigip (the default) or bigiq, and
+	// LoginProvider overrides the platform's default login provider
+	Platform      string `json:"platform,omitempty"`
+	LoginProvider string `json:"login_provider,omitempty"`
 }
 
 // TokenEntry represents a stored F5 BIG-IP token
@@ -42,11 +90,54 @@ type TokenEntry struct {
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 	IsActive  bool      `json:"is_active"`
+
+	// DeviceHost is the management host of the unit that issued the token
+	DeviceHost string `json:"device_host,omitempty"`
+
+	// Timestamps reported by the device, on its own clock, in microseconds
+	ExpirationMicros int64 `json:"expiration_micros,omitempty"`
+	LastUpdateMicros int64 `json:"last_update_micros,omitempty"`
+
+	// Credential set and BIG-IP user the token was issued with
+	Credential string `json:"credential,omitempty"`
+	Username   string `json:"username,omitempty"`
+
+	// Identity of the Vault client that requested the token
+	EntityID            string `json:"entity_id,omitempty"`
+	DisplayName         string `json:"display_name,omitempty"`
+	ClientTokenAccessor string `json:"client_token_accessor,omitempty"`
+	MountPoint          string `json:"mount_point,omitempty"`
+
+	// Optional caller-supplied context for the request
+	Purpose string `json:"purpose,omitempty"`
+	Ticket  string `json:"ticket,omitempty"`
+
+	// Group is the connection group the token was issued for, if any
+	Group string `json:"group,omitempty"`
+
+	// Role is the role the token was issued for, if any; its token
+	// belongs to the role's managed service user
+	Role string `json:"role,omitempty"`
+
+	// DynamicUser reports that Username was created for this token alone
+	// and is deleted from the device when the token is revoked
+	DynamicUser bool `json:"dynamic_user,omitempty"`
+
+	// RefreshToken is kept for platforms that refresh access tokens with a
+	// separate token; it is never returned by the API
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 // Backend creates a new f5TokenBackend
 func Backend() *f5TokenBackend {
 	var b f5TokenBackend
+	b.breakers = make(map[string]*circuitBreaker)
+	b.skews = make(map[string]clockSkew)
+	b.roundRobin = make(map[string]int)
+	b.activeHosts = make(map[string]string)
+	b.unreachableHosts = make(map[string]time.Time)
+	b.lastSourceSync = make(map[string]time.Time)
+	b.serviceUsers = make(map[string]*sync.Mutex)
 
 	b.Backend = &framework.Backend{
 		Help:        strings.TrimSpace(backendHelp),
@@ -55,17 +146,54 @@ func Backend() *f5TokenBackend {
 			SealWrapStorage: []string{
 				"config/connection/",
 				"tokens/",
+				connectionVersionStoragePrefix,
+				sourceStoragePrefix,
+				xcConnectionStoragePrefix,
 			},
 		},
 		Paths: framework.PathAppend(
 			[]*framework.Path{
+				pathConfig(&b),
 				pathConfigConnection(&b),
 				pathConfigConnectionList(&b),
+				pathConfigConnectionVerify(&b),
+				pathConnectionVersions(&b),
+				pathConnectionRollback(&b),
+				pathConnectionStatus(&b),
+				pathHealth(&b),
+				pathHealthHistory(&b),
 				pathToken(&b),
 				pathTokensList(&b),
+				pathConnectionTokensList(&b),
+				pathTokenLookup(&b),
+				pathTokenRefresh(&b),
+				pathRevokeAll(&b),
+				pathRevokeEntity(&b),
+				pathReconcile(&b),
+				pathConfigGroup(&b),
+				pathConfigGroupList(&b),
+				pathGroupToken(&b),
+				pathConfigImport(&b),
+				pathConfigExport(&b),
+				pathConfigSource(&b),
+				pathConfigSourceList(&b),
+				pathSourceSync(&b),
+				pathConfigXCConnection(&b),
+				pathConfigXCConnectionList(&b),
+				pathXCCredential(&b),
+				pathXCCredentialList(&b),
+				pathRole(&b),
+				pathRoleList(&b),
+				pathRoleToken(&b),
 			},
 		),
-		PeriodicFunc: b.cleanupExpiredTokens,
+		Secrets: []*framework.Secret{
+			secretGroupToken(&b),
+			secretRefreshableToken(&b),
+			secretXCCredential(&b),
+		},
+		InitializeFunc: b.initialize,
+		PeriodicFunc:   b.periodicFunc,
 	}
 
 	return &b
@@ -104,6 +232,73 @@ func pathConfigConnection(b *f5TokenBackend) *framework.Path {
 				Description: "Allow insecure SSL connections (not recommended)",
 				Default:     false,
 			},
+			"hosts": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Additional management hosts of the same device, such as the other units of an HA pair",
+			},
+			"host_selection": {
+				Type:        framework.TypeString,
+				Description: "How to choose between management hosts: first_healthy, prefer_active or round_robin",
+				Default:     hostSelectionFirstHealthy,
+			},
+			"tags": {
+				Type:        framework.TypeKVPairs,
+				Description: "Free-form key=value labels for the connection, used by group selectors and list filters",
+			},
+			"metadata": {
+				Type:        framework.TypeKVPairs,
+				Description: "Free-form key=value descriptive data for the connection, such as owner or device role",
+			},
+			"secondary_username": {
+				Type:        framework.TypeString,
+				Description: "Username of a fallback account used when the primary credentials are rejected",
+			},
+			"secondary_password": {
+				Type:        framework.TypeString,
+				Description: "Password of the fallback account",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"platform": {
+				Type:        framework.TypeString,
+				Description: "Kind of device: bigip, bigiq, f5os or nextcm",
+				Default:     api.PlatformBIGIP,
+			},
+			"login_provider": {
+				Type:        framework.TypeString,
+				Description: "Login provider to authenticate against, e.g. tmos, local or the name of a RADIUS or LDAP provider (defaults to the platform's own)",
+			},
+			"breaker_threshold": {
+				Type:        framework.TypeInt,
+				Description: "Consecutive authentication or transport failures before logins to this connection are suspended",
+				Default:     defaultBreakerThreshold,
+			},
+			"breaker_cooldown": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time to wait before a suspended connection is probed again (in seconds)",
+				Default:     int(defaultBreakerCooldown / time.Second),
+			},
+			"force": {
+				Type:        framework.TypeBool,
+				Description: "On delete, remove the connection even if tokens issued through it are still outstanding",
+				Default:     false,
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "On write, log in to the F5 BIG-IP to verify the connection before saving it",
+				Default:     true,
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "On write, validate the connection and report what would be stored without saving it",
+				Default:     false,
+			},
+			"revoke_outstanding": {
+				Type:        framework.TypeBool,
+				Description: "On delete, revoke all outstanding tokens on the F5 BIG-IP before removing the connection",
+				Default:     false,
+			},
 		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
@@ -116,6 +311,9 @@ func pathConfigConnection(b *f5TokenBackend) *framework.Path {
 			logical.CreateOperation: &framework.PathOperation{
 				Callback: b.pathConnectionWrite,
 			},
+			logical.PatchOperation: &framework.PathOperation{
+				Callback: b.pathConnectionPatch,
+			},
 			logical.DeleteOperation: &framework.PathOperation{
 				Callback: b.pathConnectionDelete,
 			},
@@ -132,6 +330,17 @@ func pathConfigConnection(b *f5TokenBackend) *framework.Path {
 func pathConfigConnectionList(b *f5TokenBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: "config/connections/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"selector": {
+				Type:        framework.TypeString,
+				Description: "Only include connections whose tags match this selector, e.g. env=prod,site=fra",
+			},
+			"detailed": {
+				Type:        framework.TypeBool,
+				Description: "Include host, username, tags, metadata and health for each connection",
+				Default:     false,
+			},
+		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ListOperation: &framework.PathOperation{
@@ -140,7 +349,34 @@ func pathConfigConnectionList(b *f5TokenBackend) *framework.Path {
 		},
 
 		HelpSynopsis:    "List all configured F5 BIG-IP connections",
-		HelpDescription: "This endpoint lists all configured F5 BIG-IP connections by name.",
+		HelpDescription: "This endpoint lists configured F5 BIG-IP connections by name, optionally filtered by a tag selector. With detailed=true each connection's host, username, tags, metadata and health are returned as key info.",
+	}
+}
+
+// pathConfigConnectionVerify defines the path for testing a stored F5 BIG-IP connection
+func pathConfigConnectionVerify(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/connection/" + framework.GenericNameRegex("name") + "/verify",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection to verify",
+				Required:    true,
+			},
+			"credential": {
+				Type:        framework.TypeString,
+				Description: "Credential set to verify: primary or secondary. By default the primary set is tried with fallback to the secondary, as for issuance.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConnectionVerify,
+			},
+		},
+
+		HelpSynopsis:    "Verify a stored F5 BIG-IP connection",
+		HelpDescription: "This endpoint logs in to the F5 BIG-IP with the stored connection details and revokes the test token, reporting whether the connection works.",
 	}
 }
 
@@ -159,16 +395,69 @@ func pathToken(b *f5TokenBackend) *framework.Path {
 				Description: "TTL for the token (in seconds)",
 				Default:     3600, // 1 hour default
 			},
+			"purpose": {
+				Type:        framework.TypeString,
+				Description: "Free-form reason the token is being requested, recorded with the token",
+			},
+			"ticket": {
+				Type:        framework.TypeString,
+				Description: "Change or incident ticket reference, recorded with the token",
+			},
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Issue the token for this role's service user instead of the connection's user; the role must be on the named connection",
+			},
 		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathTokenWrite,
+			},
 			logical.ReadOperation: &framework.PathOperation{
-				Callback: b.pathTokenRead,
+				Callback:   b.pathTokenRead,
+				Deprecated: true,
 			},
 		},
 
 		HelpSynopsis:    "Generate an F5 BIG-IP authentication token",
-		HelpDescription: "This endpoint generates and returns an F5 BIG-IP authentication token with the specified TTL.",
+		HelpDescription: "This endpoint generates and returns an F5 BIG-IP authentication token with the specified TTL, for the connection's user or, with role, for a role's service user. Tokens should be issued with a write (POST); issuing with a read (GET) is deprecated and can be disabled with allow_get_issuance on the config endpoint.",
+	}
+}
+
+// tokenListFields returns the filter and pagination fields shared by the
+// tokens/ list paths
+func tokenListFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"connection": {
+			Type:        framework.TypeString,
+			Description: "Only include tokens issued through this connection",
+		},
+		"state": {
+			Type:          framework.TypeString,
+			Description:   "Only include tokens in this state: active, inactive or all",
+			Default:       tokenStateActive,
+			AllowedValues: []interface{}{tokenStateActive, tokenStateInactive, tokenStateAll},
+		},
+		"expiring_before": {
+			Type:        framework.TypeTime,
+			Description: "Only include tokens that expire before this time (RFC3339 or Unix seconds)",
+		},
+		"created_after": {
+			Type:        framework.TypeTime,
+			Description: "Only include tokens created after this time (RFC3339 or Unix seconds)",
+		},
+		"entity_id": {
+			Type:        framework.TypeString,
+			Description: "Only include tokens requested by this Vault entity",
+		},
+		"after": {
+			Type:        framework.TypeString,
+			Description: "Only return keys that sort after this one, for pagination",
+		},
+		"limit": {
+			Type:        framework.TypeInt,
+			Description: "Maximum number of keys to return; 0 means no limit",
+		},
 	}
 }
 
@@ -176,15 +465,71 @@ func pathToken(b *f5TokenBackend) *framework.Path {
 func pathTokensList(b *f5TokenBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: "tokens/?$",
+		Fields:  tokenListFields(),
 
 		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathTokensList,
+			},
 			logical.ReadOperation: &framework.PathOperation{
 				Callback: b.pathTokensListRead,
 			},
 		},
 
 		HelpSynopsis:    "List all F5 BIG-IP tokens",
-		HelpDescription: "This endpoint lists all F5 BIG-IP tokens by ID.",
+		HelpDescription: "This endpoint lists F5 BIG-IP tokens. LIST returns the connections holding matching tokens as <connection>/ keys, to be listed in turn at tokens/<connection>/. READ returns full token details. Both accept the same filters and after/limit pagination.",
+	}
+}
+
+// pathConnectionTokensList defines the path for listing the tokens of one connection
+func pathConnectionTokensList(b *f5TokenBackend) *framework.Path {
+	fields := tokenListFields()
+	fields["connection"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the F5 BIG-IP connection the tokens were issued through",
+		Required:    true,
+	}
+
+	return &framework.Path{
+		Pattern: "tokens/" + framework.GenericNameRegex("connection") + "/?$",
+		Fields:  fields,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathConnectionTokensList,
+			},
+		},
+
+		HelpSynopsis:    "List the F5 BIG-IP tokens of a connection",
+		HelpDescription: "This endpoint lists the IDs of tokens issued through a connection, with summary key info. Each ID can be read at tokens/<connection>/<token_id>.",
+	}
+}
+
+// pathTokenLookup defines the path for looking up a single stored token
+func pathTokenLookup(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tokens/" + framework.GenericNameRegex("connection") + "/" + framework.GenericNameRegex("token_id"),
+		Fields: map[string]*framework.FieldSchema{
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection the token was issued through",
+				Required:    true,
+			},
+			"token_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the token to look up",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathTokenLookupRead,
+			},
+		},
+
+		HelpSynopsis:    "Look up an F5 BIG-IP token",
+		HelpDescription: "This endpoint returns the stored details of a single token, including who requested it and why. The token value itself is not returned.",
 	}
 }
 
@@ -207,7 +552,7 @@ func (b *f5TokenBackend) pathConnectionWrite(ctx context.Context, req *logical.R
 		return logical.ErrorResponse("connection name cannot be empty"), nil
 	}
 
-	var host, username, password string
+	var host, username, password, secondaryUsername, secondaryPassword string
 	var insecureSSL bool
 
 	// Handle both direct parameters and JSON input
@@ -223,13 +568,25 @@ func (b *f5TokenBackend) pathConnectionWrite(ctx context.Context, req *logical.R
 	if i, ok := data.GetOk("insecure_ssl"); ok {
 		insecureSSL = i.(bool)
 	}
+	if u, ok := data.GetOk("secondary_username"); ok {
+		secondaryUsername = u.(string)
+	}
+	if p, ok := data.GetOk("secondary_password"); ok {
+		secondaryPassword = p.(string)
+	}
 
-	if host == "" || username == "" || password == "" {
-		return logical.ErrorResponse("host, username, and password are required"), nil
+	var hosts []string
+	if h, ok := data.GetOk("hosts"); ok {
+		hosts = h.([]string)
+	}
+	if host == "" && len(hosts) > 0 {
+		host = hosts[0]
 	}
 
-	// Log what we're doing (without sensitive info)
-	b.Backend.Logger().Info("configuring connection", "name", name, "host", host)
+	breakerThreshold := data.Get("breaker_threshold").(int)
+	breakerCooldown := data.Get("breaker_cooldown").(int)
+	verify := data.Get("verify_connection").(bool)
+	dryRun := data.Get("dry_run").(bool)
 
 	// Create configuration entry
 	connection := &Connection{
@@ -237,40 +594,429 @@ func (b *f5TokenBackend) pathConnectionWrite(ctx context.Context, req *logical.R
 		Username:    username,
 		Password:    password,
 		InsecureSSL: insecureSSL,
+
+		Hosts:         hosts,
+		HostSelection: data.Get("host_selection").(string),
+		Tags:          data.Get("tags").(map[string]string),
+		Metadata:      data.Get("metadata").(map[string]string),
+
+		BreakerThreshold: breakerThreshold,
+		BreakerCooldown:  int64(breakerCooldown),
+
+		SecondaryUsername: secondaryUsername,
+		SecondaryPassword: secondaryPassword,
+
+		Platform:      data.Get("platform").(string),
+		LoginProvider: data.Get("login_provider").(string),
+	}
+
+	if err := connection.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	// Test the connection by getting a token
-	client := api.NewClient(host, username, password, insecureSSL)
-	tokenResp, err := client.GetToken(60) // Short-lived test token
+	// Log what we're doing (without sensitive info)
+	b.Backend.Logger().Info("configuring connection", "name", name, "host", host, "verify", verify, "dry_run", dryRun)
+
+	var credentials map[string]interface{}
+	if verify {
+		verified, err := b.verifyCredentials(name, connection, dryRun)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to connect to F5 BIG-IP: %s", err)), nil
+		}
+		credentials = verified
+	}
+
+	if dryRun {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"dry_run":     true,
+				"verified":    verify,
+				"credentials": credentials,
+				"connection":  connection.redacted(),
+			},
+		}, nil
+	}
+
+	version, err := b.saveConnection(ctx, req, name, connection, versionOperationWrite, 0)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("failed to connect to F5 BIG-IP: %s", err)), nil
+		return nil, err
 	}
 
-	// Revoke the test token, we don't need it
-	if err := client.RevokeToken(tokenResp.Token.Token); err != nil {
-		// Just log this error, don't fail the operation
-		b.Backend.Logger().Warn("failed to revoke test token", "error", err)
+	// New settings or credentials start with a clean breaker and history
+	b.resetBreaker(name)
+	b.resetHosts(name)
+	if err := req.Storage.Delete(ctx, healthStoragePrefix+name); err != nil {
+		return nil, err
 	}
 
-	// Store the connection config
-	entry, err := logical.StorageEntryJSON("config/connection/"+name, connection)
+	status := "Connection configured and tested successfully"
+	if !verify {
+		status = "Connection configured without verification"
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"success":  true,
+			"host":     host,
+			"verified": verify,
+			"status":   status,
+			"version":  version,
+
+			"credentials": credentials,
+		},
+	}, nil
+}
+
+// pathConnectionPatch handles config/connection patch operations. Supplied
+// fields are merged into the stored connection and everything else is kept.
+// The connection is only re-verified when the host or credentials change.
+func (b *f5TokenBackend) pathConnectionPatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
+	if connection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", name)), nil
+	}
+
+	// Stored connections may predate the breaker settings
+	threshold, cooldown := connection.breakerSettings()
+	connection.BreakerThreshold = threshold
+	connection.BreakerCooldown = int64(cooldown / time.Second)
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	credentialsChanged := false
+	if v, ok := data.GetOk("host"); ok && v.(string) != connection.Host {
+		connection.Host = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("username"); ok && v.(string) != connection.Username {
+		connection.Username = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("password"); ok && v.(string) != connection.Password {
+		connection.Password = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("hosts"); ok && !slices.Equal(v.([]string), connection.Hosts) {
+		connection.Hosts = v.([]string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("host_selection"); ok {
+		connection.HostSelection = v.(string)
+	}
+	if v, ok := data.GetOk("tags"); ok {
+		connection.Tags = v.(map[string]string)
+	}
+	if v, ok := data.GetOk("metadata"); ok {
+		connection.Metadata = v.(map[string]string)
+	}
+	if v, ok := data.GetOk("secondary_username"); ok && v.(string) != connection.SecondaryUsername {
+		connection.SecondaryUsername = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("secondary_password"); ok && v.(string) != connection.SecondaryPassword {
+		connection.SecondaryPassword = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("platform"); ok && v.(string) != connection.platform() {
+		connection.Platform = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("login_provider"); ok && v.(string) != connection.LoginProvider {
+		connection.LoginProvider = v.(string)
+		credentialsChanged = true
+	}
+	if v, ok := data.GetOk("insecure_ssl"); ok {
+		connection.InsecureSSL = v.(bool)
+	}
+	if v, ok := data.GetOk("breaker_threshold"); ok {
+		connection.BreakerThreshold = v.(int)
+	}
+	if v, ok := data.GetOk("breaker_cooldown"); ok {
+		connection.BreakerCooldown = int64(v.(int))
+	}
+
+	if err := connection.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	verify := credentialsChanged && data.Get("verify_connection").(bool)
+	dryRun := data.Get("dry_run").(bool)
+
+	b.Backend.Logger().Info("patching connection", "name", name, "credentials_changed", credentialsChanged, "verify", verify, "dry_run", dryRun)
+
+	var credentials map[string]interface{}
+	if verify {
+		verified, err := b.verifyCredentials(name, connection, dryRun)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to connect to F5 BIG-IP: %s", err)), nil
+		}
+		credentials = verified
+	}
+
+	if dryRun {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"dry_run":     true,
+				"verified":    verify,
+				"credentials": credentials,
+				"connection":  connection.redacted(),
+			},
+		}, nil
+	}
+
+	version, err := b.saveConnection(ctx, req, name, connection, versionOperationPatch, 0)
+	if err != nil {
 		return nil, err
 	}
 
+	// New credentials start with a clean breaker and history
+	if credentialsChanged {
+		b.resetBreaker(name)
+		b.resetHosts(name)
+		if err := req.Storage.Delete(ctx, healthStoragePrefix+name); err != nil {
+			return nil, err
+		}
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"success": true,
-			"host":    host,
-			"status":  "Connection configured and tested successfully",
+			"success":  true,
+			"host":     connection.Host,
+			"verified": verify,
+			"version":  version,
+
+			"credentials": credentials,
 		},
 	}, nil
 }
 
+// pathConnectionVerify handles config/connection/<name>/verify write operations
+func (b *f5TokenBackend) pathConnectionVerify(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", name)), nil
+	}
+
+	credential := data.Get("credential").(string)
+	switch credential {
+	case "", api.CredentialPrimary:
+	case api.CredentialSecondary:
+		if !connection.hasSecondary() {
+			return logical.ErrorResponse(fmt.Sprintf("connection %s has no secondary credential", name)), nil
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("credential must be %q or %q", api.CredentialPrimary, api.CredentialSecondary)), nil
+	}
+
+	start := time.Now()
+	used, err := b.verifyConnection(name, connection, false, credential)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to connect to F5 BIG-IP: %s", err)), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"success":    true,
+			"host":       connection.Host,
+			"credential": used,
+			"latency_ms": time.Since(start).Milliseconds(),
+		},
+	}, nil
+}
+
+// verifyCredentials verifies every credential set configured on a connection
+// separately, so a broken secondary account is caught before it is needed.
+// It returns the outcome per credential set. A dry run verifies with
+// throwaway clients and leaves the stored connection's state untouched.
+func (b *f5TokenBackend) verifyCredentials(name string, connection *Connection, dryRun bool) (map[string]interface{}, error) {
+	credentials := []string{api.CredentialPrimary}
+	if connection.hasSecondary() {
+		credentials = append(credentials, api.CredentialSecondary)
+	}
+
+	results := make(map[string]interface{}, len(credentials))
+	var errs []error
+	for _, credential := range credentials {
+		var err error
+		if dryRun {
+			err = b.probeCredential(connection, credential)
+		} else {
+			_, err = b.verifyConnection(name, connection, true, credential)
+		}
+		if err != nil {
+			results[credential] = err.Error()
+			errs = append(errs, fmt.Errorf("%s credential: %w", credential, err))
+			continue
+		}
+		results[credential] = "ok"
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// verifyConnection tests a connection by obtaining and revoking a short-lived
+// token, and returns the credential set that logged in. An empty credential
+// falls back from the primary to the secondary set as issuance does. With
+// bypassBreaker set the login ignores an open breaker so that an operator
+// can fix stale credentials, but the outcome is still recorded.
+func (b *f5TokenBackend) verifyConnection(name string, connection *Connection, bypassBreaker bool, credential string) (string, error) {
+	hosts := b.candidateHosts(name, connection)
+
+	var login *deviceLogin
+	var err error
+	if bypassBreaker {
+		threshold, _ := connection.breakerSettings()
+		login, err = b.loginHosts(name, connection, hosts, 60, credential) // Short-lived test token
+		b.breaker(name).record(err, threshold, time.Now())
+		if err == nil {
+			if _, skew, ok := deviceExpiry(login.Response, time.Now()); ok {
+				b.recordSkew(name, skew, time.Now())
+			}
+		}
+	} else {
+		login, err = b.loginWithCredential(name, connection, hosts, 60, credential)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Revoke the test token, we don't need it
+	if err := login.Client.RevokeToken(login.Response.Token.Token); err != nil {
+		// Just log this error, don't fail the operation
+		b.Backend.Logger().Warn("failed to revoke test token", "error", err)
+	}
+
+	return login.Response.Credential, nil
+}
+
+// probeCredential tests one credential set by obtaining and revoking a
+// short-lived token on the connection's hosts in order. It goes around the
+// breaker and records no skew or host reachability, so a connection that is
+// not being saved cannot trip or skew the live connection of the same name.
+func (b *f5TokenBackend) probeCredential(connection *Connection, credential string) error {
+	hosts := connection.managementHosts()
+
+	var errs []error
+	for _, host := range hosts {
+		client := newClientForHost(connection, host)
+		tokenResp, err := getToken(client, 60, credential) // Short-lived test token
+		if err != nil {
+			if len(hosts) > 1 {
+				err = fmt.Errorf("%s: %w", host, err)
+			}
+			errs = append(errs, err)
+			if errors.Is(err, api.ErrTransport) {
+				continue
+			}
+			break
+		}
+
+		// Revoke the test token, we don't need it
+		if err := client.RevokeToken(tokenResp.Token.Token); err != nil {
+			// Just log this error, don't fail the operation
+			b.Backend.Logger().Warn("failed to revoke test token", "error", err)
+		}
+		return nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks that a connection has everything needed to reach a device
+func (c *Connection) validate() error {
+	if c.Host == "" || c.Username == "" || c.Password == "" {
+		return fmt.Errorf("host, username, and password are required")
+	}
+	if c.BreakerThreshold < 1 {
+		return fmt.Errorf("breaker_threshold must be at least 1")
+	}
+	if c.BreakerCooldown < 1 {
+		return fmt.Errorf("breaker_cooldown must be at least 1 second")
+	}
+	if (c.SecondaryUsername == "") != (c.SecondaryPassword == "") {
+		return fmt.Errorf("secondary_username and secondary_password must be set together")
+	}
+	if err := validateHostSelection(c.HostSelection); err != nil {
+		return err
+	}
+	if err := c.validatePlatform(); err != nil {
+		return err
+	}
+
+	for _, host := range c.managementHosts() {
+		if err := validateHost(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateHost checks that a management host is a hostname, IP address or https URL
+func validateHost(host string) error {
+	raw := host
+	if !strings.HasPrefix(host, "https://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("host %q is not a valid hostname, IP address or https URL", raw)
+	}
+
+	return nil
+}
+
+// redacted returns the connection for API output, without the password
+func (c *Connection) redacted() map[string]interface{} {
+	threshold, cooldown := c.breakerSettings()
+	return map[string]interface{}{
+		"host":              c.Host,
+		"username":          c.Username,
+		"insecure_ssl":      c.InsecureSSL,
+		"breaker_threshold": threshold,
+		"breaker_cooldown":  int64(cooldown / time.Second),
+
+		"secondary_username": c.SecondaryUsername,
+		"hosts":              c.managementHosts(),
+		"host_selection":     c.hostSelection(),
+		"tags":               nonNilMap(c.Tags),
+		"metadata":           nonNilMap(c.Metadata),
+		"platform":           c.platform(),
+		"login_provider":     c.LoginProvider,
+	}
+}
+
+// nonNilMap returns m, or an empty map if m is nil, for API output
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+// hasSecondary reports whether the connection has a secondary credential set
+func (c *Connection) hasSecondary() bool {
+	return c.SecondaryUsername != "" && c.SecondaryPassword != ""
+}
+
+// putConnection stores a named connection configuration
+func (b *f5TokenBackend) putConnection(ctx context.Context, storage logical.Storage, name string, connection *Connection) error {
+	entry, err := logical.StorageEntryJSON("config/connection/"+name, connection)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
 // pathConnectionRead handles config/connection read operations
 func (b *f5TokenBackend) pathConnectionRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	name := data.Get("name").(string)
@@ -278,27 +1024,22 @@ func (b *f5TokenBackend) pathConnectionRead(ctx context.Context, req *logical.Re
 		return logical.ErrorResponse("connection name cannot be empty"), nil
 	}
 
-	entry, err := req.Storage.Get(ctx, "config/connection/"+name)
+	connection, err := b.getConnection(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
 
-	if entry == nil {
+	if connection == nil {
 		return nil, nil
 	}
 
-	var connection Connection
-	if err := entry.DecodeJSON(&connection); err != nil {
-		return nil, err
-	}
-
 	// Return all but the password
 	resp := &logical.Response{
-		Data: map[string]interface{}{
-			"host":         connection.Host,
-			"username":     connection.Username,
-			"insecure_ssl": connection.InsecureSSL,
-		},
+		Data: connection.redacted(),
+	}
+	resp.Data["circuit_breaker"] = b.breaker(name).status()
+	if skew := b.skewStatus(name); skew != nil {
+		resp.Data["clock_skew"] = skew
 	}
 
 	return resp, nil
@@ -311,32 +1052,141 @@ func (b *f5TokenBackend) pathConnectionDelete(ctx context.Context, req *logical.
 		return logical.ErrorResponse("connection name cannot be empty"), nil
 	}
 
+	force := data.Get("force").(bool)
+	revokeOutstanding := data.Get("revoke_outstanding").(bool)
+
+	outstanding, err := b.outstandingTokens(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{}
+
+	if len(outstanding) > 0 {
+		tokenIDs := sortedTokenIDs(outstanding)
+
+		switch {
+		case revokeOutstanding:
+			connection, err := b.requireConnection(ctx, req.Storage, name)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("error getting connection: %s", err)), nil
+			}
+
+			var failed []string
+			for _, tokenID := range tokenIDs {
+				if err := b.revokeTokenEntry(ctx, req.Storage, connection, tokenID, outstanding[tokenID]); err != nil {
+					b.Backend.Logger().Warn("failed to revoke outstanding token", "token_id", tokenID, "error", err)
+					failed = append(failed, tokenID)
+				}
+			}
+
+			if len(failed) > 0 && !force {
+				return logical.ErrorResponse(fmt.Sprintf("failed to revoke %d outstanding token(s) for connection %s: %s; set force=true to delete anyway",
+					len(failed), name, strings.Join(failed, ", "))), nil
+			}
+			for _, tokenID := range failed {
+				resp.AddWarning(fmt.Sprintf("token %s could not be revoked and is now orphaned", tokenID))
+			}
+		case force:
+			resp.AddWarning(fmt.Sprintf("connection deleted with %d outstanding token(s) that are now orphaned: %s",
+				len(tokenIDs), strings.Join(tokenIDs, ", ")))
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("connection %s has %d outstanding token(s); set revoke_outstanding=true to revoke them or force=true to delete anyway",
+				name, len(tokenIDs))), nil
+		}
+	}
+
 	// Remove the connection configuration
 	if err := req.Storage.Delete(ctx, "config/connection/"+name); err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	if err := req.Storage.Delete(ctx, healthStoragePrefix+name); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, connectionVersionStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	b.resetBreaker(name)
+	b.resetHosts(name)
+
+	if len(resp.Warnings) == 0 {
+		return nil, nil
+	}
+	return resp, nil
 }
 
 // pathConnectionList handles config/connections list operations
 func (b *f5TokenBackend) pathConnectionList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	connections, err := req.Storage.List(ctx, "config/connection/")
+	selector, err := parseKeyValues(data.Get("selector").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	names, connections, err := b.findConnections(ctx, req.Storage, selector)
 	if err != nil {
 		return nil, err
 	}
 
-	return logical.ListResponse(connections), nil
+	if !data.Get("detailed").(bool) {
+		return logical.ListResponse(names), nil
+	}
+
+	keyInfo := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		connection := connections[name]
+		health, err := b.healthSummary(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		keyInfo[name] = map[string]interface{}{
+			"host":     connection.Host,
+			"hosts":    connection.managementHosts(),
+			"username": connection.Username,
+			"tags":     nonNilMap(connection.Tags),
+			"metadata": nonNilMap(connection.Metadata),
+			"health":   health,
+		}
+	}
+
+	return logical.ListResponseWithInfo(names, keyInfo), nil
 }
 
-// getF5Client creates an F5 API client from a named connection configuration
-func (b *f5TokenBackend) getF5Client(ctx context.Context, storage logical.Storage, name string) (*api.Client, error) {
+// findConnections loads every connection whose tags match selector, returning
+// their names in sorted order; an empty selector matches every connection
+func (b *f5TokenBackend) findConnections(ctx context.Context, storage logical.Storage, selector map[string]string) ([]string, map[string]*Connection, error) {
+	names, err := storage.List(ctx, "config/connection/")
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(names)
+
+	matched := []string{}
+	connections := make(map[string]*Connection, len(names))
+	for _, name := range names {
+		connection, err := b.getConnection(ctx, storage, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if connection == nil || !matchesSelector(connection.Tags, selector) {
+			continue
+		}
+		matched = append(matched, name)
+		connections[name] = connection
+	}
+
+	return matched, connections, nil
+}
+
+// getConnection loads a named connection configuration, returning nil if it does not exist
+func (b *f5TokenBackend) getConnection(ctx context.Context, storage logical.Storage, name string) (*Connection, error) {
 	entry, err := storage.Get(ctx, "config/connection/"+name)
 	if err != nil {
 		return nil, err
 	}
 	if entry == nil {
-		return nil, fmt.Errorf("connection %s not found", name)
+		return nil, nil
 	}
 
 	var connection Connection
@@ -344,11 +1194,43 @@ func (b *f5TokenBackend) getF5Client(ctx context.Context, storage logical.Storag
 		return nil, err
 	}
 
-	return api.NewClient(connection.Host, connection.Username, connection.Password, connection.InsecureSSL), nil
+	return &connection, nil
 }
 
-// pathTokenRead handles token/ read operations to generate tokens
+// requireConnection loads a named connection configuration, returning an error if it does not exist
+func (b *f5TokenBackend) requireConnection(ctx context.Context, storage logical.Storage, name string) (*Connection, error) {
+	connection, err := b.getConnection(ctx, storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return nil, fmt.Errorf("connection %s not found", name)
+	}
+
+	return connection, nil
+}
+
+// pathTokenRead handles the deprecated token/ read operations that generate tokens
 func (b *f5TokenBackend) pathTokenRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.AllowGetIssuance {
+		return logical.ErrorResponse("issuing tokens by reading token/<name> is disabled on this mount; write to token/<name> instead"), nil
+	}
+
+	resp, err := b.pathTokenWrite(ctx, req, data)
+	if resp != nil && !resp.IsError() {
+		resp.AddWarning("issuing tokens by reading token/<name> is deprecated and will be disabled in a future release; write to token/<name> instead")
+	}
+
+	return resp, err
+}
+
+// pathTokenWrite handles token/ write operations to generate tokens
+func (b *f5TokenBackend) pathTokenWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	name := data.Get("name").(string)
 	ttl := data.Get("ttl").(int)
 
@@ -356,116 +1238,246 @@ func (b *f5TokenBackend) pathTokenRead(ctx context.Context, req *logical.Request
 		return logical.ErrorResponse("connection name cannot be empty"), nil
 	}
 
-	// Generate a token ID
-	tokenID := fmt.Sprintf("token_%s_%d", name, time.Now().Unix())
+	// Role tokens fall back to the role's TTL unless one is requested
+	if role := data.Get("role").(string); role != "" {
+		if _, ok := data.GetOk("ttl"); !ok {
+			ttl = 0
+		}
+		return b.roleTokenResponse(ctx, req, role, name, int64(ttl), data.Get("purpose").(string), data.Get("ticket").(string))
+	}
 
-	// Retrieve the F5 client for the specified host
-	client, err := b.getF5Client(ctx, req.Storage, name)
+	config, err := b.getMountConfig(ctx, req.Storage)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("error getting F5 client: %s", err)), nil
+		return nil, err
+	}
+	if !config.AllowAdminIssuance {
+		return logical.ErrorResponse(errAdminIssuanceDisabled), nil
 	}
 
-	// Get token from F5 BIG-IP
-	tokenResp, err := client.GetToken(int64(ttl))
+	template := requestTokenEntry(req, data.Get("purpose").(string), data.Get("ticket").(string))
+	issued, err := b.issueToken(ctx, req.Storage, name, ttl, template)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("error generating token: %s", err)), nil
+		var coded logical.HTTPCodedError
+		if errors.As(err, &coded) {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
 	}
+	tokenEntry := issued.Entry
 
-	// Calculate expiration time
-	expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	// Return the token and metadata
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"token_id":    issued.ID,
+			"token":       tokenEntry.Token,
+			"host":        name,
+			"expires_at":  tokenEntry.ExpiresAt.Format(time.RFC3339),
+			"ttl":         issued.Timeout,
+			"credential":  tokenEntry.Credential,
+			"device_host": tokenEntry.DeviceHost,
+		},
+	}
+	if tokenEntry.Purpose != "" {
+		resp.Data["purpose"] = tokenEntry.Purpose
+	}
+	if tokenEntry.Ticket != "" {
+		resp.Data["ticket"] = tokenEntry.Ticket
+	}
 
-	// Create and store token record
-	tokenEntry := &TokenEntry{
-		Token:     tokenResp.Token.Token,
-		Host:      name,
-		CreatedAt: time.Now(),
-		ExpiresAt: expiresAt,
-		IsActive:  true,
+	// Tokens with a refresh token are handed out under a renewable lease
+	if tokenEntry.RefreshToken != "" {
+		return b.refreshableTokenResponse(resp.Data, issued.ID, tokenEntry, ttl), nil
 	}
 
-	// Store the token
-	entry, err := logical.StorageEntryJSON("tokens/"+tokenID, tokenEntry)
+	return resp, nil
+}
+
+// issuedToken is a token minted on a device and stored by issueToken
+type issuedToken struct {
+	ID      string
+	Entry   *TokenEntry
+	Timeout int64
+}
+
+// requestTokenEntry returns a token record template carrying the identity
+// of the requesting Vault client and the caller-supplied context
+func requestTokenEntry(req *logical.Request, purpose, ticket string) TokenEntry {
+	return TokenEntry{
+		EntityID:            req.EntityID,
+		DisplayName:         req.DisplayName,
+		ClientTokenAccessor: req.ClientTokenAccessor,
+		MountPoint:          req.MountPoint,
+		Purpose:             purpose,
+		Ticket:              ticket,
+	}
+}
+
+// issueToken mints a token through the named connection and stores its
+// record, built from template. Failures the caller should see are returned
+// as coded errors; anything else is an internal error.
+func (b *f5TokenBackend) issueToken(ctx context.Context, storage logical.Storage, name string, ttl int, template TokenEntry) (*issuedToken, error) {
+	tokenID, err := newTokenID(name)
 	if err != nil {
-		// Attempt to revoke the token if we can't store it
-		_ = client.RevokeToken(tokenResp.Token.Token)
 		return nil, err
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	// Retrieve the connection for the specified host
+	connection, err := b.requireConnection(ctx, storage, name)
+	if err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error getting connection: %s", err))
+	}
+
+	// Refuse early if background probes show the device has been failing
+	if err := b.checkIssuanceHealth(ctx, storage, name); err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, err.Error())
+	}
+
+	if limit := api.MaxTokenTimeout(connection.platform()); int64(ttl) > limit {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("ttl %d exceeds the %s maximum of %d seconds", ttl, connection.platform(), limit))
+	}
+
+	// Get token from F5 BIG-IP
+	login, err := b.login(name, connection, int64(ttl))
+	if err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error generating token: %s", err))
+	}
+
+	return b.recordToken(ctx, storage, tokenID, name, ttl, template, login)
+}
+
+// recordToken stores the record of a token obtained by login, built from
+// template, and revokes the token if it cannot be stored
+func (b *f5TokenBackend) recordToken(ctx context.Context, storage logical.Storage, tokenID, name string, ttl int, template TokenEntry, login *deviceLogin) (*issuedToken, error) {
+	tokenResp := login.Response
+
+	// Prefer the device's own expiry; fall back to local clock math for
+	// devices that do not report it
+	now := time.Now()
+	expiresAt, _, ok := deviceExpiry(tokenResp, now)
+	if !ok {
+		expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	}
+	// Access tokens backed by a refresh token expire on the device's
+	// schedule and are kept alive by refreshing
+	if tokenResp.RefreshToken != "" && tokenResp.Token.Timeout > 0 && tokenResp.Token.Timeout < int64(ttl) {
+		expiresAt = now.Add(time.Duration(tokenResp.Token.Timeout) * time.Second)
+	}
+
+	// Create and store token record
+	tokenEntry := &template
+	tokenEntry.Token = tokenResp.Token.Token
+	tokenEntry.Host = name
+	tokenEntry.CreatedAt = now
+	tokenEntry.ExpiresAt = expiresAt
+	tokenEntry.IsActive = true
+	tokenEntry.DeviceHost = login.Host
+	tokenEntry.ExpirationMicros = tokenResp.Token.ExpirationMicros
+	tokenEntry.LastUpdateMicros = tokenResp.Token.LastUpdateMicros
+	tokenEntry.Credential = tokenResp.Credential
+	tokenEntry.Username = tokenResp.Username
+	tokenEntry.RefreshToken = tokenResp.RefreshToken
+
+	// Store the token
+	if err := b.putTokenEntry(ctx, storage, tokenID, tokenEntry); err != nil {
 		// Attempt to revoke the token if we can't store it
-		_ = client.RevokeToken(tokenResp.Token.Token)
+		_ = login.Client.RevokeToken(tokenResp.Token.Token)
 		return nil, err
 	}
 
-	// Return the token and metadata
-	resp := &logical.Response{
-		Data: map[string]interface{}{
-			"token_id":   tokenID,
-			"token":      tokenResp.Token.Token,
-			"host":       name,
-			"expires_at": expiresAt.Format(time.RFC3339),
-			"ttl":        ttl,
-		},
-	}
+	return &issuedToken{
+		ID:      tokenID,
+		Entry:   tokenEntry,
+		Timeout: tokenResp.Token.Timeout,
+	}, nil
+}
 
-	return resp, nil
+// periodicFunc runs the backend's background maintenance tasks
+func (b *f5TokenBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	return errors.Join(
+		b.cleanupExpiredTokens(ctx, req),
+		b.cleanupExpiredXCCredentials(ctx, req),
+		b.scheduledReconcile(ctx, req.Storage),
+		b.scheduledHealthChecks(ctx, req.Storage),
+		b.scheduledSourceSyncs(ctx, req),
+	)
 }
 
 // cleanupExpiredTokens is a periodic function to clean up expired tokens
 func (b *f5TokenBackend) cleanupExpiredTokens(ctx context.Context, req *logical.Request) error {
-	tokenIDs, err := req.Storage.List(ctx, "tokens/")
+	names, err := b.listTokenConnections(ctx, req.Storage)
 	if err != nil {
 		return err
 	}
 
 	now := time.Now()
 
-	for _, tokenID := range tokenIDs {
-		tokenEntryRaw, err := req.Storage.Get(ctx, "tokens/"+tokenID)
+	for _, name := range names {
+		connection, err := b.getConnection(ctx, req.Storage, name)
 		if err != nil {
-			b.Backend.Logger().Error("error retrieving token", "token_id", tokenID, "error", err)
-			continue
-		}
-		if tokenEntryRaw == nil {
-			continue
-		}
-
-		var tokenEntry TokenEntry
-		if err := tokenEntryRaw.DecodeJSON(&tokenEntry); err != nil {
-			b.Backend.Logger().Error("error decoding token", "token_id", tokenID, "error", err)
+			b.Backend.Logger().Error("error getting connection for cleanup", "name", name, "error", err)
 			continue
 		}
 
-		// Skip if already inactive
-		if !tokenEntry.IsActive {
+		tokenIDs, err := b.listTokenIDs(ctx, req.Storage, name)
+		if err != nil {
+			b.Backend.Logger().Error("error listing tokens", "name", name, "error", err)
 			continue
 		}
 
-		// Check if expired
-		if now.After(tokenEntry.ExpiresAt) {
-			// Get the F5 client
-			client, err := b.getF5Client(ctx, req.Storage, tokenEntry.Host)
+		for _, tokenID := range tokenIDs {
+			tokenEntry, err := b.getTokenEntry(ctx, req.Storage, name, tokenID)
 			if err != nil {
-				b.Backend.Logger().Error("error getting F5 client for cleanup", "token_id", tokenID, "error", err)
+				b.Backend.Logger().Error("error retrieving token", "token_id", tokenID, "error", err)
+				continue
+			}
+			if tokenEntry == nil {
+				continue
+			}
+
+			// Skip if already inactive or not yet expired
+			if !tokenEntry.IsActive || !now.After(tokenEntry.ExpiresAt) {
 				continue
 			}
 
-			// Revoke the token in F5
-			if err := client.RevokeToken(tokenEntry.Token); err != nil {
+			// The connection was force-deleted; the device has already timed
+			// the token out on its own, so the orphaned record can be reaped
+			if connection == nil {
+				b.Backend.Logger().Warn("reaping orphaned token whose connection no longer exists", "token_id", tokenID, "name", name)
+				if err := req.Storage.Delete(ctx, tokenStoragePath(name, tokenID)); err != nil {
+					b.Backend.Logger().Error("error deleting orphaned token", "token_id", tokenID, "error", err)
+				}
+				continue
+			}
+
+			// Leave the token for a later pass while the device is failing
+			if _, cooldown := connection.breakerSettings(); b.breaker(name).isOpen(cooldown, now) {
+				b.Backend.Logger().Debug("skipping cleanup while circuit breaker is open", "token_id", tokenID, "name", name)
+				continue
+			}
+
+			// Revoke the token in F5. A refresh token outlives the access
+			// token, so its record stays active until the session is ended.
+			if err := b.revokeOnDevice(connection, tokenEntry); err != nil {
 				b.Backend.Logger().Warn("failed to revoke expired token", "token_id", tokenID, "error", err)
+				if tokenEntry.RefreshToken != "" {
+					continue
+				}
+			}
+
+			// Keep the record active until its dynamic user is gone, so a
+			// later pass retries the deletion
+			if tokenEntry.DynamicUser {
+				if err := b.deleteDynamicUser(connection, tokenEntry); err != nil {
+					b.Backend.Logger().Warn("failed to delete dynamic user of expired token", "token_id", tokenID, "username", tokenEntry.Username, "error", err)
+					continue
+				}
 			}
 
 			// Mark token as inactive
 			tokenEntry.IsActive = false
 
 			// Update the token entry
-			entry, err := logical.StorageEntryJSON("tokens/"+tokenID, tokenEntry)
-			if err != nil {
-				b.Backend.Logger().Error("error creating storage entry", "token_id", tokenID, "error", err)
-				continue
-			}
-
-			if err := req.Storage.Put(ctx, entry); err != nil {
+			if err := b.putTokenEntry(ctx, req.Storage, tokenID, tokenEntry); err != nil {
 				b.Backend.Logger().Error("error updating token entry", "token_id", tokenID, "error", err)
 			}
 		}
@@ -474,47 +1486,104 @@ func (b *f5TokenBackend) cleanupExpiredTokens(ctx context.Context, req *logical.
 	return nil
 }
 
-// pathTokensListRead handles tokens/ read operations
-func (b *f5TokenBackend) pathTokensListRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	// Get list of tokens
-	tokens, err := req.Storage.List(ctx, "tokens/")
+// pathTokensList handles tokens/ list operations. Keys are the connections
+// holding matching tokens, so that they compose with tokens/<connection>/.
+func (b *f5TokenBackend) pathTokensList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	filter, err := tokenFilterFromData(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// Pagination applies to the connection keys rather than the token IDs
+	after, limit := filter.After, filter.Limit
+	filter.After, filter.Limit = "", 0
+
+	records, err := b.findTokens(ctx, req.Storage, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	// For each token, get details and return a more informative list
-	var tokenDetails []map[string]interface{}
-	for _, tokenID := range tokens {
-		tokenEntryRaw, err := req.Storage.Get(ctx, "tokens/"+tokenID)
-		if err != nil {
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[record.Entry.Host]++
+	}
+
+	keys := make([]string, 0, len(counts))
+	keyInfo := make(map[string]interface{}, len(counts))
+	for _, name := range sortedKeys(counts) {
+		key := name + "/"
+		if after != "" && key <= after {
 			continue
 		}
-		if tokenEntryRaw == nil {
-			continue
+		if limit > 0 && len(keys) == limit {
+			break
 		}
-
-		var tokenEntry TokenEntry
-		if err := tokenEntryRaw.DecodeJSON(&tokenEntry); err != nil {
-			continue
+		keys = append(keys, key)
+		keyInfo[key] = map[string]interface{}{
+			"tokens": counts[name],
 		}
+	}
 
-		// Only show active tokens
-		if !tokenEntry.IsActive {
-			continue
-		}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
 
-		// Check if token is expired
-		if time.Now().After(tokenEntry.ExpiresAt) {
-			continue
+// pathConnectionTokensList handles tokens/<connection>/ list operations
+func (b *f5TokenBackend) pathConnectionTokensList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	filter, err := tokenFilterFromData(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	records, err := b.findTokens(ctx, req.Storage, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(records))
+	keyInfo := make(map[string]interface{}, len(records))
+	for _, record := range records {
+		keys = append(keys, record.ID)
+		keyInfo[record.ID] = map[string]interface{}{
+			"host":         record.Entry.Host,
+			"expires_at":   record.Entry.ExpiresAt.Format(time.RFC3339),
+			"active":       record.Active,
+			"entity_id":    record.Entry.EntityID,
+			"display_name": record.Entry.DisplayName,
 		}
+	}
 
-		detail := map[string]interface{}{
-			"token_id":   tokenID,
-			"host":       tokenEntry.Host,
-			"created_at": tokenEntry.CreatedAt.Format(time.RFC3339),
-			"expires_at": tokenEntry.ExpiresAt.Format(time.RFC3339),
-			"active":     tokenEntry.IsActive,
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// pathTokensListRead handles tokens/ read operations
+func (b *f5TokenBackend) pathTokensListRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	filter, err := tokenFilterFromData(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	records, err := b.findTokens(ctx, req.Storage, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens whose connection no longer exists are flagged as orphaned
+	connectionExists := make(map[string]bool)
+
+	tokenDetails := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		exists, ok := connectionExists[record.Entry.Host]
+		if !ok {
+			connection, err := b.getConnection(ctx, req.Storage, record.Entry.Host)
+			if err != nil {
+				return nil, err
+			}
+			exists = connection != nil
+			connectionExists[record.Entry.Host] = exists
 		}
+
+		detail := tokenDetail(record)
+		detail["orphaned"] = !exists
 		tokenDetails = append(tokenDetails, detail)
 	}
 
@@ -525,6 +1594,54 @@ func (b *f5TokenBackend) pathTokensListRead(ctx context.Context, req *logical.Re
 	}, nil
 }
 
+// pathTokenLookupRead handles tokens/<connection>/<token_id> read operations
+func (b *f5TokenBackend) pathTokenLookupRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("connection").(string)
+	tokenID := data.Get("token_id").(string)
+
+	tokenEntry, err := b.getTokenEntry(ctx, req.Storage, name, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if tokenEntry == nil {
+		return nil, nil
+	}
+
+	record := &tokenRecord{
+		ID:     tokenID,
+		Entry:  tokenEntry,
+		Active: tokenEntry.IsActive && time.Now().Before(tokenEntry.ExpiresAt),
+	}
+
+	return &logical.Response{
+		Data: tokenDetail(record),
+	}, nil
+}
+
+// tokenDetail renders a token record for API output, without the token value
+func tokenDetail(record *tokenRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"token_id":              record.ID,
+		"host":                  record.Entry.Host,
+		"created_at":            record.Entry.CreatedAt.Format(time.RFC3339),
+		"expires_at":            record.Entry.ExpiresAt.Format(time.RFC3339),
+		"active":                record.Active,
+		"entity_id":             record.Entry.EntityID,
+		"display_name":          record.Entry.DisplayName,
+		"client_token_accessor": record.Entry.ClientTokenAccessor,
+		"mount_point":           record.Entry.MountPoint,
+		"expiration_micros":     record.Entry.ExpirationMicros,
+		"credential":            record.Entry.Credential,
+		"device_host":           record.Entry.DeviceHost,
+		"username":              record.Entry.Username,
+		"purpose":               record.Entry.Purpose,
+		"ticket":                record.Entry.Ticket,
+		"group":                 record.Entry.Group,
+		"role":                  record.Entry.Role,
+		"dynamic_user":          record.Entry.DynamicUser,
+	}
+}
+
 // Help text
 const backendHelp = `
 The F5 BIG-IP Token secrets backend dynamically generates and manages
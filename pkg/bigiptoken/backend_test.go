@@ -0,0 +1,322 @@
+package bigiptoken
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testBackend returns a backend set up with in-memory storage
+func testBackend(t *testing.T) (*f5TokenBackend, logical.Storage) {
+	t.Helper()
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+
+	b := Backend()
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, config.StorageView
+}
+
+// testRequest sends a request to the backend and fails the test on internal
+// or error responses
+func testRequest(t *testing.T, b *f5TokenBackend, storage logical.Storage, op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Storage:   storage,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatalf("%s %s: %v", op, path, err)
+	}
+	if resp != nil && resp.IsError() {
+		t.Fatalf("%s %s: %v", op, path, resp.Error())
+	}
+	return resp
+}
+
+// testRequestError sends a request to the backend that must be refused with
+// an error response, and returns the error message
+func testRequestError(t *testing.T, b *f5TokenBackend, storage logical.Storage, op logical.Operation, path string, data map[string]interface{}) string {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Storage:   storage,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatalf("%s %s: %v", op, path, err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("%s %s: expected an error response, got %v", op, path, resp)
+	}
+	return resp.Error().Error()
+}
+
+// testConnection writes a connection to a BIG-IP stand-in, verified against
+// it, with extra fields overriding the defaults
+func testConnection(t *testing.T, b *f5TokenBackend, storage logical.Storage, name string, srv *httptest.Server, extra map[string]interface{}) {
+	t.Helper()
+
+	data := map[string]interface{}{
+		"host":         srv.URL,
+		"username":     "admin",
+		"password":     "password",
+		"insecure_ssl": true,
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	testRequest(t, b, storage, logical.CreateOperation, "config/connection/"+name, data)
+}
+
+func TestConnectionDeleteOutstandingTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]interface{}
+		breakRevoke bool
+		wantErr     string
+		wantWarning string
+		wantHeld    bool
+	}{
+		{
+			name:     "refused with outstanding tokens",
+			wantErr:  "set revoke_outstanding=true",
+			wantHeld: true,
+		},
+		{
+			name:        "force orphans tokens",
+			data:        map[string]interface{}{"force": true},
+			wantWarning: "now orphaned",
+			wantHeld:    true,
+		},
+		{
+			name: "revoke_outstanding revokes tokens",
+			data: map[string]interface{}{"revoke_outstanding": true},
+		},
+		{
+			name:        "revoke failure refuses",
+			data:        map[string]interface{}{"revoke_outstanding": true},
+			breakRevoke: true,
+			wantErr:     "failed to revoke 1 outstanding token(s)",
+			wantHeld:    true,
+		},
+		{
+			name:        "revoke failure with force",
+			data:        map[string]interface{}{"revoke_outstanding": true, "force": true},
+			breakRevoke: true,
+			wantWarning: "could not be revoked",
+			wantHeld:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			device, srv := newBigIPDevice(t)
+			testConnection(t, b, storage, "lb1", srv, nil)
+			token := testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil).Data["token"].(string)
+			if tt.breakRevoke {
+				srv.Close()
+			}
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.DeleteOperation,
+				Path:      "config/connection/lb1",
+				Storage:   storage,
+				Data:      tt.data,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantErr != "" {
+				if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, resp)
+				}
+			} else if resp != nil && resp.IsError() {
+				t.Fatalf("unexpected error: %v", resp.Error())
+			}
+
+			var warnings []string
+			if resp != nil {
+				warnings = resp.Warnings
+			}
+			if tt.wantWarning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], tt.wantWarning)) {
+				t.Errorf("warnings = %v, want one containing %q", warnings, tt.wantWarning)
+			}
+			if tt.wantWarning == "" && len(warnings) != 0 {
+				t.Errorf("unexpected warnings: %v", warnings)
+			}
+
+			entry, err := storage.Get(context.Background(), "config/connection/lb1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted := entry == nil; deleted != (tt.wantErr == "") {
+				t.Errorf("connection deleted = %t, want %t", deleted, tt.wantErr == "")
+			}
+			if held := device.holds(token); held != tt.wantHeld {
+				t.Errorf("token held = %t, want %t", held, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestTokenGetIssuanceGate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]interface{}
+		op          logical.Operation
+		wantErr     string
+		wantWarning bool
+	}{
+		{name: "read allowed by default", op: logical.ReadOperation, wantWarning: true},
+		{name: "write", op: logical.UpdateOperation},
+		{
+			name:    "read disabled",
+			config:  map[string]interface{}{"allow_get_issuance": false},
+			op:      logical.ReadOperation,
+			wantErr: "write to token/<name> instead",
+		},
+		{name: "write with read disabled", config: map[string]interface{}{"allow_get_issuance": false}, op: logical.UpdateOperation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			device, srv := newBigIPDevice(t)
+			testConnection(t, b, storage, "lb1", srv, nil)
+			if tt.config != nil {
+				testRequest(t, b, storage, logical.UpdateOperation, "config", tt.config)
+			}
+			before := device.loginCount("admin")
+
+			if tt.wantErr != "" {
+				if msg := testRequestError(t, b, storage, tt.op, "token/lb1", nil); !strings.Contains(msg, tt.wantErr) {
+					t.Fatalf("unexpected error: %s", msg)
+				}
+				if logins := device.loginCount("admin") - before; logins != 0 {
+					t.Fatalf("expected a refused read not to log in, got %d logins", logins)
+				}
+				return
+			}
+
+			resp := testRequest(t, b, storage, tt.op, "token/lb1", nil)
+			if !device.holds(resp.Data["token"].(string)) {
+				t.Fatalf("expected a token to be issued, got %v", resp.Data)
+			}
+			if warned := len(resp.Warnings) > 0 && strings.Contains(resp.Warnings[0], "deprecated"); warned != tt.wantWarning {
+				t.Errorf("warnings = %v, want deprecation warning %t", resp.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestConnectionPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]interface{}
+		wantErr    string
+		wantLogins int
+		check      func(t *testing.T, connection *Connection)
+	}{
+		{
+			name: "settings only",
+			data: map[string]interface{}{"breaker_threshold": 7},
+			check: func(t *testing.T, connection *Connection) {
+				if connection.BreakerThreshold != 7 || connection.Password != "password" || connection.Username != "admin" {
+					t.Errorf("unexpected connection: %+v", connection.redacted())
+				}
+			},
+		},
+		{
+			name:       "password verified",
+			data:       map[string]interface{}{"password": "rotated"},
+			wantLogins: 1,
+			check: func(t *testing.T, connection *Connection) {
+				if connection.Password != "rotated" || connection.Username != "admin" || connection.BreakerThreshold != defaultBreakerThreshold {
+					t.Errorf("unexpected connection: %+v", connection.redacted())
+				}
+			},
+		},
+		{
+			name: "tags replaced",
+			data: map[string]interface{}{"tags": map[string]interface{}{"site": "dc2"}},
+			check: func(t *testing.T, connection *Connection) {
+				if len(connection.Tags) != 1 || connection.Tags["site"] != "dc2" || connection.Metadata["owner"] != "netops" {
+					t.Errorf("tags = %v, metadata = %v", connection.Tags, connection.Metadata)
+				}
+			},
+		},
+		{
+			name:       "rejected password not saved",
+			data:       map[string]interface{}{"password": "wrong"},
+			wantErr:    "failed to connect",
+			wantLogins: 1,
+		},
+		{
+			name: "dry run not saved",
+			data: map[string]interface{}{"password": "rotated", "dry_run": true},
+			// A dry run verifies without keeping the token
+			wantLogins: 1,
+		},
+		{
+			name:    "invalid settings not saved",
+			data:    map[string]interface{}{"secondary_username": "backup"},
+			wantErr: "must be set together",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			device, srv := newBigIPDevice(t)
+			testConnection(t, b, storage, "lb1", srv, map[string]interface{}{
+				"tags":     map[string]interface{}{"site": "dc1", "tier": "edge"},
+				"metadata": map[string]interface{}{"owner": "netops"},
+			})
+			device.setPassword("admin", "rotated")
+			before := device.loginCount("admin")
+
+			if tt.wantErr != "" {
+				if msg := testRequestError(t, b, storage, logical.PatchOperation, "config/connection/lb1", tt.data); !strings.Contains(msg, tt.wantErr) {
+					t.Fatalf("unexpected error: %s", msg)
+				}
+			} else {
+				testRequest(t, b, storage, logical.PatchOperation, "config/connection/lb1", tt.data)
+			}
+			if logins := device.loginCount("admin") - before; logins != tt.wantLogins {
+				t.Errorf("logins = %d, want %d", logins, tt.wantLogins)
+			}
+
+			connection, err := b.getConnection(context.Background(), storage, "lb1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check == nil {
+				if connection.Password != "password" || len(connection.Tags) != 2 {
+					t.Errorf("expected the stored connection to be unchanged, got %+v", connection.redacted())
+				}
+				return
+			}
+			tt.check(t, connection)
+		})
+	}
+
+	b, storage := testBackend(t)
+	if msg := testRequestError(t, b, storage, logical.PatchOperation, "config/connection/lb9", map[string]interface{}{"breaker_threshold": 7}); !strings.Contains(msg, "not found") {
+		t.Errorf("unexpected error patching a missing connection: %s", msg)
+	}
+}
@@ -0,0 +1,270 @@
+package bigiptoken
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// Circuit breaker states
+const (
+	breakerStateClosed   = "closed"
+	breakerStateOpen     = "open"
+	breakerStateHalfOpen = "half-open"
+)
+
+// Defaults used when a connection does not override the breaker settings.
+// BIG-IP locks local accounts after a handful of failed logins, so the
+// threshold is deliberately kept below the usual lockout limit.
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 5 * time.Minute
+)
+
+// errCircuitOpen is returned while a connection's circuit breaker refuses logins
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker tracks consecutive login failures for a single connection
+// and stops the plugin from hammering a device whose credentials or
+// management plane are broken.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	lastFailureAt       time.Time
+	lastError           string
+	probeInFlight       bool
+
+	// primaryRejectedAt is when the device last rejected the primary
+	// credential set while the secondary set worked; until the cooldown
+	// has passed, logins go straight to the secondary set
+	primaryRejectedAt time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{state: breakerStateClosed}
+}
+
+// allow reports whether a call to the device may proceed. Once the cooldown
+// of an open breaker has elapsed a single probe is let through in half-open
+// state; everything else fails fast until that probe reports back.
+func (cb *circuitBreaker) allow(cooldown time.Duration, now time.Time) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerStateOpen:
+		retryAt := cb.openedAt.Add(cooldown)
+		if now.Before(retryAt) {
+			return fmt.Errorf("%w after %d consecutive failures (last error: %s); retry after %s",
+				errCircuitOpen, cb.consecutiveFailures, cb.lastError, retryAt.Format(time.RFC3339))
+		}
+		cb.state = breakerStateHalfOpen
+		cb.probeInFlight = true
+		return nil
+	case breakerStateHalfOpen:
+		if cb.probeInFlight {
+			return fmt.Errorf("%w: half-open and a probe login is already in progress (last error: %s)", errCircuitOpen, cb.lastError)
+		}
+		cb.probeInFlight = true
+		return nil
+	}
+
+	return nil
+}
+
+// record updates the breaker with the outcome of a login attempt. Only
+// authentication and transport failures count towards opening the breaker.
+func (cb *circuitBreaker) record(err error, threshold int, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probeInFlight = false
+
+	if err == nil {
+		cb.state = breakerStateClosed
+		cb.consecutiveFailures = 0
+		cb.lastError = ""
+		return
+	}
+
+	if !errors.Is(err, api.ErrAuthentication) && !errors.Is(err, api.ErrTransport) {
+		return
+	}
+
+	cb.consecutiveFailures++
+	cb.lastFailureAt = now
+	cb.lastError = err.Error()
+
+	if cb.state == breakerStateHalfOpen || cb.consecutiveFailures >= threshold {
+		cb.state = breakerStateOpen
+		cb.openedAt = now
+	}
+}
+
+// skipPrimary reports whether the primary credential set was rejected
+// recently enough that logins should start with the secondary set
+func (cb *circuitBreaker) skipPrimary(cooldown time.Duration, now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return !cb.primaryRejectedAt.IsZero() && now.Before(cb.primaryRejectedAt.Add(cooldown))
+}
+
+// recordPrimary notes whether a login that tried the primary credential set
+// had it rejected
+func (cb *circuitBreaker) recordPrimary(rejected bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if rejected {
+		cb.primaryRejectedAt = now
+	} else {
+		cb.primaryRejectedAt = time.Time{}
+	}
+}
+
+// isOpen reports whether the breaker is currently refusing calls, without
+// consuming the half-open probe slot.
+func (cb *circuitBreaker) isOpen(cooldown time.Duration, now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state == breakerStateOpen && now.Before(cb.openedAt.Add(cooldown))
+}
+
+// status returns the breaker state for display on connection reads
+func (cb *circuitBreaker) status() map[string]interface{} {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	status := map[string]interface{}{
+		"state":                cb.state,
+		"consecutive_failures": cb.consecutiveFailures,
+	}
+	if cb.lastError != "" {
+		status["last_error"] = cb.lastError
+	}
+	if !cb.lastFailureAt.IsZero() {
+		status["last_failure_at"] = cb.lastFailureAt.Format(time.RFC3339)
+	}
+	if cb.state != breakerStateClosed {
+		status["opened_at"] = cb.openedAt.Format(time.RFC3339)
+	}
+	if !cb.primaryRejectedAt.IsZero() {
+		status["primary_rejected_at"] = cb.primaryRejectedAt.Format(time.RFC3339)
+	}
+	return status
+}
+
+// breakerSettings returns the threshold and cooldown for a connection,
+// falling back to the defaults for connections stored before they existed
+func (c *Connection) breakerSettings() (int, time.Duration) {
+	threshold := c.BreakerThreshold
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	cooldown := time.Duration(c.BreakerCooldown) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return threshold, cooldown
+}
+
+// breaker returns the circuit breaker for the named connection, creating it on first use
+func (b *f5TokenBackend) breaker(name string) *circuitBreaker {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cb, ok := b.breakers[name]
+	if !ok {
+		cb = newCircuitBreaker()
+		b.breakers[name] = cb
+	}
+	return cb
+}
+
+// breakerState returns the state of the named connection's breaker without
+// creating one, so listings do not leave entries behind for every connection
+func (b *f5TokenBackend) breakerState(name string) string {
+	b.lock.Lock()
+	cb, ok := b.breakers[name]
+	b.lock.Unlock()
+
+	if !ok {
+		return breakerStateClosed
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// resetBreaker discards any breaker state held for the named connection
+func (b *f5TokenBackend) resetBreaker(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.breakers, name)
+}
+
+// login obtains a token from the device behind the named connection,
+// guarded by that connection's circuit breaker. For connections with several
+// management hosts, the host is chosen by the connection's selection policy.
+func (b *f5TokenBackend) login(name string, connection *Connection, ttl int64) (*deviceLogin, error) {
+	return b.loginWithCredential(name, connection, b.candidateHosts(name, connection), ttl, "")
+}
+
+// loginWithCredential is login restricted to the given hosts and credential
+// set. An empty credential tries the primary set and falls back to the
+// secondary one. Once the primary set has been rejected, the secondary set
+// is used directly until the breaker cooldown has passed, so a stale
+// primary password does not cost a failed login on every call.
+func (b *f5TokenBackend) loginWithCredential(name string, connection *Connection, hosts []string, ttl int64, credential string) (*deviceLogin, error) {
+	threshold, cooldown := connection.breakerSettings()
+	cb := b.breaker(name)
+
+	if err := cb.allow(cooldown, time.Now()); err != nil {
+		return nil, fmt.Errorf("connection %s: %w", name, err)
+	}
+
+	attempt := credential
+	if credential == "" && connection.hasSecondary() && cb.skipPrimary(cooldown, time.Now()) {
+		attempt = api.CredentialSecondary
+	}
+
+	login, err := b.loginHosts(name, connection, hosts, ttl, attempt)
+	now := time.Now()
+	cb.record(err, threshold, now)
+	if err != nil {
+		if cb.isOpen(cooldown, now) {
+			b.Backend.Logger().Warn("circuit breaker opened for connection", "name", name, "error", err)
+		}
+		return nil, err
+	}
+
+	if _, skew, ok := deviceExpiry(login.Response, now); ok {
+		b.recordSkew(name, skew, now)
+	}
+	if attempt != api.CredentialSecondary {
+		rejected := login.Response.Credential == api.CredentialSecondary
+		cb.recordPrimary(rejected, now)
+		if rejected {
+			b.Backend.Logger().Warn("primary credential rejected, using secondary credential", "name", name, "retry_primary_after", now.Add(cooldown).Format(time.RFC3339))
+		}
+	}
+
+	return login, nil
+}
+
+// getToken logs in with the given credential set, or with fallback when it is empty
+func getToken(client api.DeviceClient, ttl int64, credential string) (*api.TokenResponse, error) {
+	if credential == "" {
+		return client.GetToken(ttl)
+	}
+	return client.GetTokenWithCredential(credential, ttl)
+}
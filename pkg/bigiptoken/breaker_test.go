@@ -0,0 +1,189 @@
+package bigiptoken
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const cooldown = time.Minute
+	authErr := fmt.Errorf("login: %w", api.ErrAuthentication)
+	transportErr := fmt.Errorf("login: %w", api.ErrTransport)
+
+	// Each step either asks allow at an offset from the start, or records
+	// an outcome at that offset, then checks the breaker state
+	type step struct {
+		at        time.Duration
+		allow     bool
+		err       error
+		wantErr   bool
+		wantState string
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens at the threshold",
+			steps: []step{
+				{err: authErr, wantState: breakerStateClosed},
+				{err: transportErr, wantState: breakerStateClosed},
+				{err: authErr, wantState: breakerStateOpen},
+				{at: time.Second, allow: true, wantErr: true, wantState: breakerStateOpen},
+			},
+		},
+		{
+			name: "other errors do not count",
+			steps: []step{
+				{err: authErr, wantState: breakerStateClosed},
+				{err: errors.New("unexpected response"), wantState: breakerStateClosed},
+				{err: errors.New("unexpected response"), wantState: breakerStateClosed},
+				{err: authErr, wantState: breakerStateClosed},
+			},
+		},
+		{
+			name: "success resets the count",
+			steps: []step{
+				{err: authErr, wantState: breakerStateClosed},
+				{err: authErr, wantState: breakerStateClosed},
+				{err: nil, wantState: breakerStateClosed},
+				{err: authErr, wantState: breakerStateClosed},
+				{err: authErr, wantState: breakerStateClosed},
+			},
+		},
+		{
+			name: "half-open allows a single probe",
+			steps: []step{
+				{err: authErr},
+				{err: authErr},
+				{err: authErr, wantState: breakerStateOpen},
+				{at: cooldown, allow: true, wantState: breakerStateHalfOpen},
+				{at: cooldown, allow: true, wantErr: true, wantState: breakerStateHalfOpen},
+			},
+		},
+		{
+			name: "failed probe reopens",
+			steps: []step{
+				{err: authErr},
+				{err: authErr},
+				{err: authErr, wantState: breakerStateOpen},
+				{at: cooldown, allow: true, wantState: breakerStateHalfOpen},
+				{at: cooldown, err: transportErr, wantState: breakerStateOpen},
+				{at: cooldown + time.Second, allow: true, wantErr: true, wantState: breakerStateOpen},
+			},
+		},
+		{
+			name: "successful probe closes",
+			steps: []step{
+				{err: authErr},
+				{err: authErr},
+				{err: authErr, wantState: breakerStateOpen},
+				{at: cooldown, allow: true, wantState: breakerStateHalfOpen},
+				{at: cooldown, err: nil, wantState: breakerStateClosed},
+				{at: cooldown, allow: true, wantState: breakerStateClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			cb := newCircuitBreaker()
+
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				if s.allow {
+					err := cb.allow(cooldown, now)
+					if (err != nil) != s.wantErr {
+						t.Fatalf("step %d: allow error = %v, want error %t", i, err, s.wantErr)
+					}
+					if err != nil && !errors.Is(err, errCircuitOpen) {
+						t.Fatalf("step %d: expected errCircuitOpen, got %v", i, err)
+					}
+				} else {
+					cb.record(s.err, defaultBreakerThreshold, now)
+				}
+				if s.wantState != "" && cb.state != s.wantState {
+					t.Fatalf("step %d: state = %s, want %s", i, cb.state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+// Once the breaker opens, issuance fails fast without logging in again,
+// and rewriting the connection closes it
+func TestLoginBreakerOpens(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, nil)
+
+	device.setPassword("admin", "rotated")
+	before := device.loginCount("admin")
+
+	for i := 0; i < defaultBreakerThreshold; i++ {
+		if msg := testRequestError(t, b, storage, logical.UpdateOperation, "token/lb1", nil); !strings.Contains(msg, "authentication rejected") {
+			t.Fatalf("attempt %d: unexpected error: %s", i, msg)
+		}
+	}
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "token/lb1", nil); !strings.Contains(msg, "circuit breaker open") {
+		t.Fatalf("expected the breaker to refuse the login, got: %s", msg)
+	}
+	if logins := device.loginCount("admin") - before; logins != defaultBreakerThreshold {
+		t.Fatalf("expected %d logins before the breaker opened, got %d", defaultBreakerThreshold, logins)
+	}
+
+	resp := testRequest(t, b, storage, logical.ReadOperation, "config/connection/lb1", nil)
+	if state := resp.Data["circuit_breaker"].(map[string]interface{})["state"]; state != breakerStateOpen {
+		t.Fatalf("circuit_breaker state = %v, want open", state)
+	}
+
+	testConnection(t, b, storage, "lb1", srv, map[string]interface{}{"password": "rotated"})
+	testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil)
+	if state := b.breakerState("lb1"); state != breakerStateClosed {
+		t.Fatalf("breaker state = %s, want closed after the connection was rewritten", state)
+	}
+}
+
+// A rejected primary credential falls back to the secondary one, which is
+// then used directly until the cooldown passes
+func TestSecondaryCredentialFallback(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	device.setPassword("backup", "secret")
+	testConnection(t, b, storage, "lb1", srv, map[string]interface{}{
+		"secondary_username": "backup",
+		"secondary_password": "secret",
+	})
+
+	device.setPassword("admin", "")
+	before := device.loginCount("admin")
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil)
+	if resp.Data["credential"] != api.CredentialSecondary {
+		t.Fatalf("credential = %v, want secondary", resp.Data["credential"])
+	}
+	if logins := device.loginCount("admin") - before; logins != 1 {
+		t.Fatalf("expected the primary credential to be tried once, got %d logins", logins)
+	}
+
+	resp = testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil)
+	if resp.Data["credential"] != api.CredentialSecondary {
+		t.Fatalf("credential = %v, want secondary", resp.Data["credential"])
+	}
+	if logins := device.loginCount("admin") - before; logins != 1 {
+		t.Fatalf("expected the primary credential to be skipped, got %d logins", logins)
+	}
+
+	status := b.breaker("lb1").status()
+	if status["state"] != breakerStateClosed || status["primary_rejected_at"] == nil {
+		t.Fatalf("unexpected breaker status: %v", status)
+	}
+}
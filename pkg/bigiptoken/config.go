@@ -0,0 +1,222 @@
+package bigiptoken
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// mountConfigStoragePath is where mount-wide settings are stored
+const mountConfigStoragePath = "config/mount"
+
+// errAdminIssuanceDisabled is returned for requests for a connection user's
+// token while allow_admin_issuance is off
+const errAdminIssuanceDisabled = "tokens for connection users are disabled on this mount; request a token for a role instead"
+
+// mountConfig holds settings that apply to the whole mount rather than a single connection
+type mountConfig struct {
+	// AllowGetIssuance keeps the legacy behaviour of minting a token on a
+	// GET of token/<name>. It defaults to true for backwards compatibility.
+	AllowGetIssuance bool `json:"allow_get_issuance"`
+
+	// AllowAdminIssuance permits tokens for the connections' own users, which
+	// are usually administrators. Turning it off once roles are in place
+	// leaves role tokens as the only ones the mount issues.
+	AllowAdminIssuance bool `json:"allow_admin_issuance"`
+
+	// ReconcileInterval is how often (in seconds) every connection is
+	// reconciled against its device's token store; zero disables it
+	ReconcileInterval int64 `json:"reconcile_interval"`
+
+	// ReconcileRevokeUnknown makes scheduled reconciliation revoke tokens
+	// the device holds for the connection user that Vault did not issue
+	ReconcileRevokeUnknown bool `json:"reconcile_revoke_unknown"`
+
+	// HealthCheckInterval is how often (in seconds) every connection is
+	// probed in the background; zero disables background probing
+	HealthCheckInterval int64 `json:"health_check_interval"`
+
+	// HealthHistorySize is how many probe results are kept per connection
+	HealthHistorySize int `json:"health_history_size"`
+
+	// HealthFailureThreshold is how many consecutive failed probes make
+	// issuance refuse early; zero disables the check
+	HealthFailureThreshold int `json:"health_failure_threshold"`
+
+	// ConnectionVersionHistory is how many versions of each connection
+	// configuration are kept for rollback
+	ConnectionVersionHistory int `json:"connection_version_history"`
+}
+
+// defaultMountConfig returns the settings used before config has been written
+func defaultMountConfig() *mountConfig {
+	return &mountConfig{
+		AllowGetIssuance:         true,
+		AllowAdminIssuance:       true,
+		HealthHistorySize:        defaultHealthHistorySize,
+		HealthFailureThreshold:   defaultHealthFailureThreshold,
+		ConnectionVersionHistory: defaultConnectionVersionHistory,
+	}
+}
+
+// pathConfig defines the path for mount-wide settings
+func pathConfig(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config$",
+		Fields: map[string]*framework.FieldSchema{
+			"allow_get_issuance": {
+				Type:        framework.TypeBool,
+				Description: "Allow tokens to be issued by reading token/<name>. Deprecated; issue tokens by writing to token/<name> instead.",
+				Default:     true,
+			},
+			"allow_admin_issuance": {
+				Type:        framework.TypeBool,
+				Description: "Allow tokens to be issued for the connections' own users. Disable to only issue tokens for roles.",
+				Default:     true,
+			},
+			"reconcile_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often to reconcile every connection against the F5 BIG-IP token store (in seconds). 0 disables scheduled reconciliation.",
+				Default:     0,
+			},
+			"reconcile_revoke_unknown": {
+				Type:        framework.TypeBool,
+				Description: "Revoke tokens found during scheduled reconciliation that were not issued by Vault",
+				Default:     false,
+			},
+			"health_check_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often to probe every connection in the background (in seconds). 0 disables background probing.",
+				Default:     0,
+			},
+			"health_history_size": {
+				Type:        framework.TypeInt,
+				Description: "Number of probe results to keep per connection",
+				Default:     defaultHealthHistorySize,
+			},
+			"health_failure_threshold": {
+				Type:        framework.TypeInt,
+				Description: "Refuse to issue tokens for a connection whose last N background probes failed. 0 disables the check.",
+				Default:     defaultHealthFailureThreshold,
+			},
+			"connection_version_history": {
+				Type:        framework.TypeInt,
+				Description: "Number of versions of each connection configuration to keep for rollback",
+				Default:     defaultConnectionVersionHistory,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigWrite,
+			},
+		},
+
+		HelpSynopsis:    "Configure mount-wide settings for the F5 token backend",
+		HelpDescription: "This endpoint configures settings that apply to every connection on this mount.",
+	}
+}
+
+// getMountConfig loads the mount-wide settings, falling back to the defaults
+func (b *f5TokenBackend) getMountConfig(ctx context.Context, storage logical.Storage) (*mountConfig, error) {
+	config := defaultMountConfig()
+
+	entry, err := storage.Get(ctx, mountConfigStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return config, nil
+	}
+
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// pathConfigRead handles config read operations
+func (b *f5TokenBackend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"allow_get_issuance":         config.AllowGetIssuance,
+			"allow_admin_issuance":       config.AllowAdminIssuance,
+			"reconcile_interval":         config.ReconcileInterval,
+			"reconcile_revoke_unknown":   config.ReconcileRevokeUnknown,
+			"health_check_interval":      config.HealthCheckInterval,
+			"health_history_size":        config.HealthHistorySize,
+			"health_failure_threshold":   config.HealthFailureThreshold,
+			"connection_version_history": config.ConnectionVersionHistory,
+		},
+	}, nil
+}
+
+// pathConfigWrite handles config write operations
+func (b *f5TokenBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := data.GetOk("allow_get_issuance"); ok {
+		config.AllowGetIssuance = v.(bool)
+	}
+	if v, ok := data.GetOk("allow_admin_issuance"); ok {
+		config.AllowAdminIssuance = v.(bool)
+	}
+	if v, ok := data.GetOk("reconcile_interval"); ok {
+		config.ReconcileInterval = int64(v.(int))
+	}
+	if v, ok := data.GetOk("reconcile_revoke_unknown"); ok {
+		config.ReconcileRevokeUnknown = v.(bool)
+	}
+
+	if v, ok := data.GetOk("health_check_interval"); ok {
+		config.HealthCheckInterval = int64(v.(int))
+	}
+	if v, ok := data.GetOk("health_history_size"); ok {
+		config.HealthHistorySize = v.(int)
+	}
+	if v, ok := data.GetOk("health_failure_threshold"); ok {
+		config.HealthFailureThreshold = v.(int)
+	}
+	if v, ok := data.GetOk("connection_version_history"); ok {
+		config.ConnectionVersionHistory = v.(int)
+	}
+
+	if config.ReconcileInterval < 0 {
+		return logical.ErrorResponse("reconcile_interval cannot be negative"), nil
+	}
+	if config.HealthCheckInterval < 0 {
+		return logical.ErrorResponse("health_check_interval cannot be negative"), nil
+	}
+	if config.HealthHistorySize < 1 {
+		return logical.ErrorResponse("health_history_size must be at least 1"), nil
+	}
+	if config.HealthFailureThreshold < 0 || config.HealthFailureThreshold > config.HealthHistorySize {
+		return logical.ErrorResponse("health_failure_threshold must be between 0 and health_history_size"), nil
+	}
+	if config.ConnectionVersionHistory < 1 {
+		return logical.ErrorResponse("connection_version_history must be at least 1"), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(mountConfigStoragePath, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
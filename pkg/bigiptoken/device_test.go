@@ -0,0 +1,301 @@
+package bigiptoken
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// deviceToken is a token held in the stand-in's token store
+type deviceToken struct {
+	user             string
+	timeout          int64
+	expirationMicros int64
+	lastUpdateMicros int64
+}
+
+// bigipDevice is a local stand-in for the login, token store, user and
+// status endpoints of a BIG-IP management interface. With managed devices
+// set it also answers the BIG-IQ device inventory.
+type bigipDevice struct {
+	mu           sync.Mutex
+	passwords    map[string]string
+	descriptions map[string]string
+	access       map[string][]api.PartitionAccess
+	tokens       map[string]*deviceToken
+	issued       int
+	logins       map[string]int
+	failover     string
+	managed      []map[string]string
+
+	// onListTokens, when set, runs before the token store is listed
+	onListTokens func()
+}
+
+// newBigIPDevice starts a BIG-IP stand-in that accepts admin/password;
+// the server is closed when the test ends
+func newBigIPDevice(t *testing.T) (*bigipDevice, *httptest.Server) {
+	t.Helper()
+
+	device := &bigipDevice{
+		passwords:    map[string]string{"admin": "password"},
+		descriptions: make(map[string]string),
+		access:       make(map[string][]api.PartitionAccess),
+		tokens:       make(map[string]*deviceToken),
+		logins:       make(map[string]int),
+		failover:     "ACTIVE",
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(device.serveHTTP))
+	t.Cleanup(srv.Close)
+
+	return device, srv
+}
+
+func (d *bigipDevice) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/mgmt/shared/authz/tokens" && d.onListTokens != nil {
+		d.onListTokens()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r.URL.Path == "/mgmt/shared/authn/login" {
+		d.login(w, r)
+		return
+	}
+	if _, ok := d.tokens[r.Header.Get("X-F5-Auth-Token")]; !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/mgmt/shared/authz/tokens":
+		items := []map[string]interface{}{}
+		for _, token := range d.tokenValues() {
+			items = append(items, d.tokens[token].item(token))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case strings.HasPrefix(r.URL.Path, "/mgmt/shared/authz/tokens/"):
+		token := strings.TrimPrefix(r.URL.Path, "/mgmt/shared/authz/tokens/")
+		held, ok := d.tokens[token]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "PATCH":
+			var body struct {
+				Timeout int64 `json:"timeout"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			now := time.Now()
+			held.timeout = body.Timeout
+			held.expirationMicros = now.Add(time.Duration(body.Timeout) * time.Second).UnixMicro()
+			held.lastUpdateMicros = now.UnixMicro()
+		case "DELETE":
+			delete(d.tokens, token)
+		}
+		json.NewEncoder(w).Encode(held.item(token))
+
+	case strings.HasPrefix(r.URL.Path, "/mgmt/tm/auth/user"):
+		d.user(w, r)
+
+	case r.URL.Path == "/mgmt/tm/sys/version":
+		writeStats(w, map[string]string{"Product": "BIG-IP", "Version": "17.1.0", "Build": "0.0.4"})
+
+	case r.URL.Path == "/mgmt/shared/resolver/device-groups/cm-bigip-allBigIpDevices/devices":
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": d.managed})
+
+	case r.URL.Path == "/mgmt/tm/cm/failover-status":
+		writeStats(w, map[string]string{"status": d.failover})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// login issues a token for a known user and password
+func (d *bigipDevice) login(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d.logins[body.Username]++
+	if password, ok := d.passwords[body.Username]; !ok || password != body.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token := d.addToken(body.Username, time.Now())
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": d.tokens[token].item(token)})
+}
+
+// user serves the local user endpoints used for role service users
+func (d *bigipDevice) user(w http.ResponseWriter, r *http.Request) {
+	var body api.ManagedUser
+	if r.Method == "POST" || r.Method == "PATCH" {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/mgmt/tm/auth/user"), "/")
+
+	switch r.Method {
+	case "GET":
+		if _, ok := d.passwords[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "description": d.descriptions[name]})
+		return
+	case "POST":
+		if _, ok := d.passwords[body.Name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		d.passwords[body.Name] = body.Password
+		d.descriptions[body.Name] = body.Description
+		d.access[body.Name] = body.PartitionAccess
+	case "PATCH":
+		d.passwords[name] = body.Password
+		d.descriptions[name] = body.Description
+		d.access[name] = body.PartitionAccess
+	case "DELETE":
+		delete(d.passwords, name)
+		delete(d.descriptions, name)
+		delete(d.access, name)
+		for token, held := range d.tokens {
+			if held.user == name {
+				delete(d.tokens, token)
+			}
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+// addToken adds a token for user, last updated at updated; d.mu must be held
+func (d *bigipDevice) addToken(user string, updated time.Time) string {
+	d.issued++
+	token := fmt.Sprintf("%06dTOKEN", d.issued)
+	d.tokens[token] = &deviceToken{
+		user:             user,
+		timeout:          1200,
+		expirationMicros: updated.Add(1200 * time.Second).UnixMicro(),
+		lastUpdateMicros: updated.UnixMicro(),
+	}
+	return token
+}
+
+// tokenValues returns the tokens in the store in order; d.mu must be held
+func (d *bigipDevice) tokenValues() []string {
+	tokens := make([]string, 0, len(d.tokens))
+	for token := range d.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// item renders a held token as the token store does
+func (t *deviceToken) item(token string) map[string]interface{} {
+	return map[string]interface{}{
+		"token":            token,
+		"userName":         t.user,
+		"timeout":          t.timeout,
+		"expirationMicros": t.expirationMicros,
+		"lastUpdateMicros": t.lastUpdateMicros,
+	}
+}
+
+// inject adds a token to the store as if it were issued outside Vault
+func (d *bigipDevice) inject(user string, updated time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.addToken(user, updated)
+}
+
+// holds reports whether the token store holds a token
+func (d *bigipDevice) holds(token string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.tokens[token]
+	return ok
+}
+
+// heldTokens returns the tokens in the store in order
+func (d *bigipDevice) heldTokens() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.tokenValues()
+}
+
+// setPassword changes or, with an empty password, removes a user's password
+func (d *bigipDevice) setPassword(user, password string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if password == "" {
+		delete(d.passwords, user)
+		return
+	}
+	d.passwords[user] = password
+}
+
+// userState returns a local user's password, description and partition
+// access, and whether the user exists
+func (d *bigipDevice) userState(user string) (string, string, []api.PartitionAccess, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	password, ok := d.passwords[user]
+	return password, d.descriptions[user], d.access[user], ok
+}
+
+// tokenUser returns the user a held token belongs to
+func (d *bigipDevice) tokenUser(token string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if held, ok := d.tokens[token]; ok {
+		return held.user
+	}
+	return ""
+}
+
+// loginCount returns how many logins were attempted as user
+func (d *bigipDevice) loginCount(user string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.logins[user]
+}
+
+// writeStats renders a /mgmt/tm stats response with a single entry
+func writeStats(w http.ResponseWriter, stats map[string]string) {
+	entries := make(map[string]interface{}, len(stats))
+	for key, value := range stats {
+		entries[key] = map[string]string{"description": value}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": map[string]interface{}{
+			"https://localhost/mgmt/stats/0": map[string]interface{}{
+				"nestedStats": map[string]interface{}{"entries": entries},
+			},
+		},
+	})
+}
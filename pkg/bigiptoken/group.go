@@ -0,0 +1,510 @@
+package bigiptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// groupStoragePrefix is where connection groups are stored
+const groupStoragePrefix = "config/group/"
+
+// secretGroupTokenType is the lease type for tokens issued across a group
+const secretGroupTokenType = "f5_group_token"
+
+// maxConcurrentGroupIssuance bounds how many members of a group are logged in to at once
+const maxConcurrentGroupIssuance = 10
+
+// connectionGroup is a named set of connections, either listed explicitly
+// or selected by their tags
+type connectionGroup struct {
+	Members  []string          `json:"members,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// pathConfigGroup defines the path for connection group configuration
+func pathConfigGroup(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/group/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Unique name for the connection group",
+				Required:    true,
+			},
+			"members": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of the connections in the group",
+			},
+			"selector": {
+				Type:        framework.TypeString,
+				Description: "Tag selector matching the connections in the group, e.g. env=prod,site=fra",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathGroupRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathGroupWrite,
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathGroupWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathGroupDelete,
+			},
+		},
+
+		ExistenceCheck: b.groupExistenceCheck,
+
+		HelpSynopsis:    "Configure a group of F5 BIG-IP connections",
+		HelpDescription: "This endpoint configures a named group of connections, given either as a static member list or as a tag selector, for issuing tokens across all of them at once.",
+	}
+}
+
+// pathConfigGroupList defines the path for listing connection groups
+func pathConfigGroupList(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/groups/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathGroupList,
+			},
+		},
+
+		HelpSynopsis:    "List all configured connection groups",
+		HelpDescription: "This endpoint lists all configured connection groups by name.",
+	}
+}
+
+// pathGroupToken defines the path for issuing tokens on every member of a group
+func pathGroupToken(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "group-token/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the connection group to use",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "TTL for the tokens (in seconds)",
+				Default:     3600,
+			},
+			"purpose": {
+				Type:        framework.TypeString,
+				Description: "Free-form reason the tokens are being requested, recorded with each token",
+			},
+			"ticket": {
+				Type:        framework.TypeString,
+				Description: "Change or incident ticket reference, recorded with each token",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathGroupTokenWrite,
+			},
+		},
+
+		HelpSynopsis:    "Generate F5 BIG-IP tokens on every member of a group",
+		HelpDescription: "This endpoint generates a token on every connection in the group concurrently and returns them under a single lease. If any member fails, every token issued so far is revoked.",
+	}
+}
+
+// secretGroupToken defines the lease returned by group issuance
+func secretGroupToken(b *f5TokenBackend) *framework.Secret {
+	return &framework.Secret{
+		Type: secretGroupTokenType,
+		Fields: map[string]*framework.FieldSchema{
+			"tokens": {
+				Type:        framework.TypeMap,
+				Description: "Tokens by connection name",
+			},
+		},
+		Revoke: b.secretGroupTokenRevoke,
+	}
+}
+
+// groupExistenceCheck checks if a connection group exists
+func (b *f5TokenBackend) groupExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	group, err := b.getGroup(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return group != nil, nil
+}
+
+// pathGroupRead handles config/group read operations
+func (b *f5TokenBackend) pathGroupRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	group, err := b.getGroup(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, nil
+	}
+
+	members, err := b.groupMembers(ctx, req.Storage, group)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"members":          group.Members,
+			"selector":         formatKeyValues(group.Selector),
+			"resolved_members": members,
+		},
+	}, nil
+}
+
+// pathGroupWrite handles config/group write operations
+func (b *f5TokenBackend) pathGroupWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("group name cannot be empty"), nil
+	}
+
+	group := &connectionGroup{}
+	if v, ok := data.GetOk("members"); ok {
+		group.Members = v.([]string)
+	}
+	if v, ok := data.GetOk("selector"); ok {
+		selector, err := parseKeyValues(v.(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		group.Selector = selector
+	}
+
+	if (len(group.Members) == 0) == (len(group.Selector) == 0) {
+		return logical.ErrorResponse("exactly one of members or selector is required"), nil
+	}
+
+	var missing, refreshable []string
+	for _, member := range group.Members {
+		connection, err := b.getConnection(ctx, req.Storage, member)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case connection == nil:
+			missing = append(missing, member)
+		case connection.platform() == api.PlatformNextCM:
+			refreshable = append(refreshable, member)
+		}
+	}
+	if len(missing) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("unknown connection(s): %s", strings.Join(missing, ", "))), nil
+	}
+	if len(refreshable) > 0 {
+		return logical.ErrorResponse(errGroupNextCMMembers(refreshable)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(groupStoragePrefix+name, group)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathGroupDelete handles config/group delete operations
+func (b *f5TokenBackend) pathGroupDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, groupStoragePrefix+data.Get("name").(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// pathGroupList handles config/groups list operations
+func (b *f5TokenBackend) pathGroupList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	groups, err := req.Storage.List(ctx, groupStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(groups), nil
+}
+
+// pathGroupTokenWrite handles group-token/ write operations
+func (b *f5TokenBackend) pathGroupTokenWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	ttl := data.Get("ttl").(int)
+
+	group, err := b.getGroup(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return logical.ErrorResponse(fmt.Sprintf("group %s not found", name)), nil
+	}
+
+	// Group tokens are issued for each member connection's own user
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if !config.AllowAdminIssuance {
+		return logical.ErrorResponse(errAdminIssuanceDisabled), nil
+	}
+
+	members, err := b.groupMembers(ctx, req.Storage, group)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return logical.ErrorResponse(fmt.Sprintf("group %s has no members", name)), nil
+	}
+
+	// A selector can match connections added after the group was written
+	var refreshable []string
+	for _, member := range members {
+		connection, err := b.getConnection(ctx, req.Storage, member)
+		if err != nil {
+			return nil, err
+		}
+		if connection != nil && connection.platform() == api.PlatformNextCM {
+			refreshable = append(refreshable, member)
+		}
+	}
+	if len(refreshable) > 0 {
+		return logical.ErrorResponse(errGroupNextCMMembers(refreshable)), nil
+	}
+
+	template := requestTokenEntry(req, data.Get("purpose").(string), data.Get("ticket").(string))
+	template.Group = name
+
+	b.Backend.Logger().Info("issuing tokens for group", "group", name, "members", len(members))
+
+	issued := make(map[string]*issuedToken, len(members))
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentGroupIssuance)
+
+	for _, member := range members {
+		wg.Add(1)
+		go func(member string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			token, err := b.issueToken(ctx, req.Storage, member, ttl, template)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[member] = err
+				return
+			}
+			issued[member] = token
+		}(member)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		// All or nothing: roll back what was issued
+		rollbackFailed := b.revokeIssued(ctx, req.Storage, issued)
+
+		failures := make([]string, 0, len(failed))
+		for _, member := range sortedKeys(failed) {
+			failures = append(failures, fmt.Sprintf("%s: %s", member, failed[member]))
+		}
+		msg := fmt.Sprintf("failed to issue tokens for %d of %d member(s) of group %s, all tokens revoked: %s",
+			len(failed), len(members), name, strings.Join(failures, "; "))
+		if len(rollbackFailed) > 0 {
+			msg += fmt.Sprintf("; could not revoke %s", strings.Join(rollbackFailed, ", "))
+		}
+		return logical.ErrorResponse(msg), nil
+	}
+
+	tokens := make(map[string]interface{}, len(issued))
+	tokenIDs := make(map[string]interface{}, len(issued))
+	expiresAt := make(map[string]interface{}, len(issued))
+	for member, token := range issued {
+		tokens[member] = token.Entry.Token
+		tokenIDs[member] = token.ID
+		expiresAt[member] = token.Entry.ExpiresAt.Format(time.RFC3339)
+	}
+
+	resp := b.Secret(secretGroupTokenType).Response(map[string]interface{}{
+		"group":      name,
+		"tokens":     tokens,
+		"token_ids":  tokenIDs,
+		"expires_at": expiresAt,
+	}, map[string]interface{}{
+		"group":     name,
+		"token_ids": tokenIDs,
+	})
+	resp.Secret.TTL = time.Duration(ttl) * time.Second
+	resp.Secret.MaxTTL = resp.Secret.TTL
+
+	return resp, nil
+}
+
+// secretGroupTokenRevoke revokes every token issued under a group lease
+func (b *f5TokenBackend) secretGroupTokenRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	raw, ok := req.Secret.InternalData["token_ids"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("group lease is missing its token IDs")
+	}
+
+	var errs []error
+	for member, v := range raw {
+		tokenID, _ := v.(string)
+		tokenEntry, err := b.getTokenEntry(ctx, req.Storage, member, tokenID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if tokenEntry == nil || !tokenEntry.IsActive {
+			continue
+		}
+
+		connection, err := b.getConnection(ctx, req.Storage, member)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if connection == nil {
+			// The connection was force-deleted; the token is orphaned
+			continue
+		}
+
+		if err := b.revokeTokenEntry(ctx, req.Storage, connection, tokenID, tokenEntry); err != nil {
+			// The device rejects revocation of tokens it has already timed out
+			if time.Now().After(tokenEntry.ExpiresAt) {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", member, err))
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// revokeIssued revokes tokens issued during a failed group issuance and
+// returns the members whose token could not be revoked
+func (b *f5TokenBackend) revokeIssued(ctx context.Context, storage logical.Storage, issued map[string]*issuedToken) []string {
+	var failed []string
+	for _, member := range sortedKeys(issued) {
+		token := issued[member]
+		connection, err := b.requireConnection(ctx, storage, member)
+		if err == nil {
+			err = b.revokeTokenEntry(ctx, storage, connection, token.ID, token.Entry)
+		}
+		if err != nil {
+			b.Backend.Logger().Error("failed to roll back group token", "name", member, "token_id", token.ID, "error", err)
+			failed = append(failed, member)
+		}
+	}
+	return failed
+}
+
+// getGroup loads a named connection group, returning nil if it does not exist
+func (b *f5TokenBackend) getGroup(ctx context.Context, storage logical.Storage, name string) (*connectionGroup, error) {
+	entry, err := storage.Get(ctx, groupStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var group connectionGroup
+	if err := entry.DecodeJSON(&group); err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// errGroupNextCMMembers explains why a group cannot issue tokens for the
+// given BIG-IP Next Central Manager connections
+func errGroupNextCMMembers(members []string) string {
+	return fmt.Sprintf("%s connection(s) cannot be group members, as their access tokens need a renewable lease of their own: %s",
+		api.PlatformNextCM, strings.Join(members, ", "))
+}
+
+// groupMembers resolves the connections in a group, sorted by name
+func (b *f5TokenBackend) groupMembers(ctx context.Context, storage logical.Storage, group *connectionGroup) ([]string, error) {
+	if len(group.Members) > 0 {
+		members := append([]string(nil), group.Members...)
+		sort.Strings(members)
+		return members, nil
+	}
+
+	members, _, err := b.findConnections(ctx, storage, group.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// parseKeyValues parses key=value pairs of the form key=value,key=value, as
+// used for tag selectors and inventory cells
+func parseKeyValues(raw string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, term := range strings.Split(raw, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid term %q, expected key=value", term)
+		}
+		pairs[key] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
+
+// formatKeyValues renders key=value pairs in the form accepted by parseKeyValues
+func formatKeyValues(pairs map[string]string) string {
+	terms := make([]string, 0, len(pairs))
+	for _, key := range sortedKeys(pairs) {
+		terms = append(terms, key+"="+pairs[key])
+	}
+	return strings.Join(terms, ",")
+}
+
+// matchesSelector reports whether tags contain every key=value in selector
+func matchesSelector(tags, selector map[string]string) bool {
+	for key, value := range selector {
+		if tag, ok := tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of a map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
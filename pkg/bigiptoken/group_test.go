@@ -0,0 +1,96 @@
+package bigiptoken
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestGroupToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		group       map[string]interface{}
+		failing     string
+		wantErr     string
+		wantMembers []string
+	}{
+		{
+			name:        "members",
+			group:       map[string]interface{}{"members": "lb1,lb2,lb3"},
+			wantMembers: []string{"lb1", "lb2", "lb3"},
+		},
+		{
+			name:        "selector",
+			group:       map[string]interface{}{"selector": "env=prod"},
+			wantMembers: []string{"lb1", "lb2"},
+		},
+		{
+			name:    "member failure rolls back",
+			group:   map[string]interface{}{"members": "lb1,lb2,lb3"},
+			failing: "lb3",
+			wantErr: "failed to issue tokens for 1 of 3 member(s) of group edge, all tokens revoked: lb3:",
+		},
+		{
+			name:    "selector without matches",
+			group:   map[string]interface{}{"selector": "env=staging"},
+			wantErr: "group edge has no members",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+
+			devices := make(map[string]*bigipDevice)
+			for name, env := range map[string]string{"lb1": "prod", "lb2": "prod", "lb3": "dev"} {
+				device, srv := newBigIPDevice(t)
+				testConnection(t, b, storage, name, srv, map[string]interface{}{
+					"tags": map[string]interface{}{"env": env},
+				})
+				devices[name] = device
+			}
+			if tt.failing != "" {
+				devices[tt.failing].setPassword("admin", "rotated")
+			}
+			testRequest(t, b, storage, logical.UpdateOperation, "config/group/edge", tt.group)
+
+			held := make(map[string][]string)
+			for name, device := range devices {
+				held[name] = device.heldTokens()
+			}
+
+			if tt.wantErr != "" {
+				if msg := testRequestError(t, b, storage, logical.UpdateOperation, "group-token/edge", nil); !strings.Contains(msg, tt.wantErr) {
+					t.Fatalf("unexpected error: %s", msg)
+				}
+				for name, device := range devices {
+					if tokens := device.heldTokens(); !slices.Equal(tokens, held[name]) {
+						t.Errorf("%s: tokens = %v, want the rolled back set %v", name, tokens, held[name])
+					}
+				}
+				resp := testRequest(t, b, storage, logical.ListOperation, "tokens/", nil)
+				if keys := resp.Data["keys"]; keys != nil {
+					t.Errorf("expected no active token records, got %v", keys)
+				}
+				return
+			}
+
+			resp := testRequest(t, b, storage, logical.UpdateOperation, "group-token/edge", nil)
+			if resp.Secret == nil {
+				t.Fatal("expected the tokens under a lease")
+			}
+			tokens := resp.Data["tokens"].(map[string]interface{})
+			if len(tokens) != len(tt.wantMembers) {
+				t.Fatalf("tokens = %v, want one for each of %v", tokens, tt.wantMembers)
+			}
+			for _, member := range tt.wantMembers {
+				token, _ := tokens[member].(string)
+				if !devices[member].holds(token) {
+					t.Errorf("%s: token %q not held by the device", member, token)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package bigiptoken
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// Host selection policies for connections with several management hosts
+const (
+	hostSelectionFirstHealthy = "first_healthy"
+	hostSelectionPreferActive = "prefer_active"
+	hostSelectionRoundRobin   = "round_robin"
+)
+
+// unhealthyHostBackoff is how long a host that could not be reached is
+// tried last under the first_healthy and prefer_active policies
+const unhealthyHostBackoff = time.Minute
+
+// failoverStatusActive is the failover status reported by the active unit
+const failoverStatusActive = "ACTIVE"
+
+// deviceLogin is a token obtained from one management host of a connection
+type deviceLogin struct {
+	Host     string
+	Client   api.DeviceClient
+	Response *api.TokenResponse
+}
+
+// managementHosts returns every management address of the connection,
+// starting with Host
+func (c *Connection) managementHosts() []string {
+	hosts := []string{c.Host}
+	for _, host := range c.Hosts {
+		if host != "" && host != c.Host && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hostSelection returns the host selection policy of the connection
+func (c *Connection) hostSelection() string {
+	if c.HostSelection == "" {
+		return hostSelectionFirstHealthy
+	}
+	return c.HostSelection
+}
+
+// validateHostSelection checks a host selection policy name
+func validateHostSelection(policy string) error {
+	switch policy {
+	case "", hostSelectionFirstHealthy, hostSelectionPreferActive, hostSelectionRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("host_selection must be one of %s, %s or %s",
+		hostSelectionFirstHealthy, hostSelectionPreferActive, hostSelectionRoundRobin)
+}
+
+// deviceHost returns the management host that issued a token, falling back
+// to the connection's first host for tokens issued before this was tracked
+func (t *TokenEntry) deviceHost(connection *Connection) string {
+	if t.DeviceHost != "" {
+		return t.DeviceHost
+	}
+	return connection.Host
+}
+
+// newClientForHost creates an F5 API client for one management host of a
+// connection, of the kind its platform needs
+func newClientForHost(connection *Connection, host string) api.DeviceClient {
+	switch connection.platform() {
+	case api.PlatformF5OS:
+		client := api.NewF5OSClient(host, connection.Username, connection.Password, connection.InsecureSSL)
+		client.SecondaryUsername = connection.SecondaryUsername
+		client.SecondaryPassword = connection.SecondaryPassword
+		return client
+	case api.PlatformNextCM:
+		client := api.NewNextCMClient(host, connection.Username, connection.Password, connection.InsecureSSL)
+		client.SecondaryUsername = connection.SecondaryUsername
+		client.SecondaryPassword = connection.SecondaryPassword
+		return client
+	}
+
+	client := api.NewClient(host, connection.Username, connection.Password, connection.InsecureSSL)
+	client.SecondaryUsername = connection.SecondaryUsername
+	client.SecondaryPassword = connection.SecondaryPassword
+	client.Platform = connection.platform()
+	client.LoginProvider = connection.LoginProvider
+	return client
+}
+
+// candidateHosts orders a connection's management hosts for a login attempt
+// according to its host selection policy
+func (b *f5TokenBackend) candidateHosts(name string, connection *Connection) []string {
+	hosts := connection.managementHosts()
+	if len(hosts) == 1 {
+		return hosts
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch connection.hostSelection() {
+	case hostSelectionRoundRobin:
+		start := b.roundRobin[name] % len(hosts)
+		b.roundRobin[name] = start + 1
+		return append(hosts[start:], hosts[:start]...)
+	case hostSelectionPreferActive:
+		// Try the last unit seen active first
+		if active, ok := b.activeHosts[name]; ok {
+			for i, host := range hosts {
+				if host == active {
+					hosts = append([]string{host}, append(hosts[:i:i], hosts[i+1:]...)...)
+					break
+				}
+			}
+		}
+	}
+
+	// Hosts that recently could not be reached go last
+	now := time.Now()
+	healthy := make([]string, 0, len(hosts))
+	var unhealthy []string
+	for _, host := range hosts {
+		if failedAt, ok := b.unreachableHosts[name+"|"+host]; ok && now.Sub(failedAt) < unhealthyHostBackoff {
+			unhealthy = append(unhealthy, host)
+			continue
+		}
+		healthy = append(healthy, host)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// markHostReachable records whether a management host could be reached
+func (b *f5TokenBackend) markHostReachable(name, host string, reachable bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if reachable {
+		delete(b.unreachableHosts, name+"|"+host)
+		return
+	}
+	b.unreachableHosts[name+"|"+host] = time.Now()
+}
+
+// resetHosts discards the host selection state held for the named connection
+func (b *f5TokenBackend) resetHosts(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.roundRobin, name)
+	delete(b.activeHosts, name)
+	for key := range b.unreachableHosts {
+		if strings.HasPrefix(key, name+"|") {
+			delete(b.unreachableHosts, key)
+		}
+	}
+}
+
+// loginHosts tries each host in turn until one issues a token. Unreachable
+// hosts are skipped; an authentication failure stops the attempt so that a
+// bad password is not tried against every unit. Under prefer_active a token
+// from a standby unit is only used when no active unit can be reached.
+func (b *f5TokenBackend) loginHosts(name string, connection *Connection, hosts []string, ttl int64, credential string) (*deviceLogin, error) {
+	preferActive := connection.hostSelection() == hostSelectionPreferActive && len(hosts) > 1
+
+	var standby *deviceLogin
+	var errs []error
+	for _, host := range hosts {
+		client := newClientForHost(connection, host)
+		tokenResp, err := getToken(client, ttl, credential)
+		if err != nil {
+			if len(hosts) > 1 {
+				err = fmt.Errorf("%s: %w", host, err)
+			}
+			errs = append(errs, err)
+			if errors.Is(err, api.ErrTransport) {
+				b.markHostReachable(name, host, false)
+				continue
+			}
+			break
+		}
+		b.markHostReachable(name, host, true)
+
+		login := &deviceLogin{Host: host, Client: client, Response: tokenResp}
+		if !preferActive {
+			return login, nil
+		}
+
+		status, err := client.GetFailoverStatus(tokenResp.Token.Token)
+		if err == nil && strings.EqualFold(status.Status, failoverStatusActive) {
+			b.lock.Lock()
+			b.activeHosts[name] = host
+			b.lock.Unlock()
+			if standby != nil {
+				b.discardLogin(name, standby)
+			}
+			return login, nil
+		}
+
+		if standby == nil {
+			standby = login
+			continue
+		}
+		b.discardLogin(name, login)
+	}
+
+	if standby != nil {
+		b.Backend.Logger().Warn("no active unit reachable, using standby", "name", name, "host", standby.Host)
+		return standby, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// discardLogin revokes a token that was obtained but is not going to be used
+func (b *f5TokenBackend) discardLogin(name string, login *deviceLogin) {
+	if err := login.Client.RevokeToken(login.Response.Token.Token); err != nil {
+		b.Backend.Logger().Warn("failed to revoke unused token", "name", name, "host", login.Host, "error", err)
+	}
+}
+
+// revokeOnDevice revokes a token on the unit that issued it. BIG-IP tokens
+// are local to a unit, but if the issuing unit cannot revoke it the other
+// units in the connection are tried as well, and any success counts.
+func (b *f5TokenBackend) revokeOnDevice(connection *Connection, tokenEntry *TokenEntry) error {
+	issuer := tokenEntry.deviceHost(connection)
+
+	err := revokeSession(newClientForHost(connection, issuer), tokenEntry)
+	if err == nil {
+		return nil
+	}
+
+	errs := []error{fmt.Errorf("%s: %w", issuer, err)}
+	for _, host := range connection.managementHosts() {
+		if host == issuer {
+			continue
+		}
+		if err := revokeSession(newClientForHost(connection, host), tokenEntry); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			continue
+		}
+		return nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// revokeSession revokes a token record's session through client. Sessions
+// held with a refresh token are ended through it, so that a lapsed access
+// token does not leave the refresh token valid.
+func revokeSession(client api.DeviceClient, tokenEntry *TokenEntry) error {
+	if nextcm, ok := client.(*api.NextCMClient); ok && tokenEntry.RefreshToken != "" {
+		return nextcm.EndSession(tokenEntry.Token, tokenEntry.RefreshToken)
+	}
+	return client.RevokeToken(tokenEntry.Token)
+}
@@ -0,0 +1,537 @@
+package bigiptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// maxConcurrentHealthChecks bounds how many devices the mount-wide health check probes at once
+const maxConcurrentHealthChecks = 10
+
+// Defaults for the stored health history
+const (
+	defaultHealthHistorySize      = 10
+	defaultHealthFailureThreshold = 3
+)
+
+// healthStoragePrefix is where probe history is stored, as health/<connection>
+const healthStoragePrefix = "health/"
+
+// Error classes recorded in the health history
+const (
+	errorClassAuth        = "auth"
+	errorClassTransport   = "transport"
+	errorClassCircuitOpen = "circuit_open"
+	errorClassAPI         = "api"
+)
+
+// healthRecord is a single stored probe result
+type healthRecord struct {
+	CheckedAt  time.Time `json:"checked_at"`
+	Success    bool      `json:"success"`
+	LatencyMs  int64     `json:"latency_ms"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Version    string    `json:"version,omitempty"`
+}
+
+// pathConnectionStatus defines the path for checking the health of a single connection
+func pathConnectionStatus(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/connection/" + framework.GenericNameRegex("name") + "/status",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection to check",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConnectionStatusRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConnectionStatusWrite,
+			},
+		},
+
+		HelpSynopsis:    "Check the health of an F5 BIG-IP connection",
+		HelpDescription: "READ returns the circuit breaker state and the last stored probe result without contacting the device. WRITE logs in to the F5 BIG-IP and reports reachability, latency, TMOS version, HA failover state and management certificate expiry. The probe token is revoked afterwards.",
+	}
+}
+
+// pathHealth defines the path for checking the health of every connection
+func pathHealth(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "health$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathHealthRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathHealthWrite,
+			},
+		},
+
+		HelpSynopsis:    "Check the health of all F5 BIG-IP connections",
+		HelpDescription: "READ returns the stored health of every configured connection without contacting the devices. WRITE checks every connection concurrently and reports the same details as a write to config/connection/<name>/status.",
+	}
+}
+
+// pathHealthHistory defines the path for reading the stored probe history of a connection
+func pathHealthHistory(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "health/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathHealthHistoryRead,
+			},
+		},
+
+		HelpSynopsis:    "Read the stored health history of an F5 BIG-IP connection",
+		HelpDescription: "This endpoint returns the most recent probe results for a connection, oldest first, without contacting the device.",
+	}
+}
+
+// pathConnectionStatusRead handles config/connection/<name>/status read
+// operations. Reads only report what is stored, so that read access to
+// config paths cannot trigger device logins or storage writes.
+func (b *f5TokenBackend) pathConnectionStatusRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return nil, nil
+	}
+
+	summary, err := b.healthSummary(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	summary["host"] = connection.Host
+
+	return &logical.Response{
+		Data: summary,
+	}, nil
+}
+
+// pathConnectionStatusWrite handles config/connection/<name>/status write operations
+func (b *f5TokenBackend) pathConnectionStatusWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", name)), nil
+	}
+
+	return &logical.Response{
+		Data: b.probeConnection(ctx, req.Storage, name, connection),
+	}, nil
+}
+
+// pathHealthRead handles health read operations, from stored results only
+func (b *f5TokenBackend) pathHealthRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "config/connection/")
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := 0
+	connections := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		summary, err := b.healthSummary(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		connections[name] = summary
+		if summary["success"] == true {
+			healthy++
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"connections": connections,
+			"total":       len(names),
+			"healthy":     healthy,
+		},
+	}, nil
+}
+
+// pathHealthWrite handles health write operations
+func (b *f5TokenBackend) pathHealthWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	results, err := b.probeAllConnections(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := 0
+	connections := make(map[string]interface{}, len(results))
+	for name, status := range results {
+		connections[name] = status
+		if status["reachable"] == true {
+			healthy++
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"connections": connections,
+			"total":       len(results),
+			"healthy":     healthy,
+		},
+	}, nil
+}
+
+// pathHealthHistoryRead handles health/<name> read operations
+func (b *f5TokenBackend) pathHealthHistoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	history, err := b.getHealthHistory(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		return nil, nil
+	}
+
+	results := make([]map[string]interface{}, 0, len(history))
+	for _, record := range history {
+		result := map[string]interface{}{
+			"checked_at": record.CheckedAt.Format(time.RFC3339),
+			"success":    record.Success,
+			"latency_ms": record.LatencyMs,
+		}
+		if record.ErrorClass != "" {
+			result["error_class"] = record.ErrorClass
+			result["error"] = record.Error
+		}
+		if record.Version != "" {
+			result["version"] = record.Version
+		}
+		results = append(results, result)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":    name,
+			"history": results,
+		},
+	}, nil
+}
+
+// probeAllConnections checks every configured connection concurrently and
+// records each result in its health history
+func (b *f5TokenBackend) probeAllConnections(ctx context.Context, storage logical.Storage) (map[string]map[string]interface{}, error) {
+	names, err := storage.List(ctx, "config/connection/")
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make(map[string]*Connection, len(names))
+	for _, name := range names {
+		connection, err := b.getConnection(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if connection != nil {
+			connections[name] = connection
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]map[string]interface{}, len(connections))
+		sem     = make(chan struct{}, maxConcurrentHealthChecks)
+	)
+
+	for name, connection := range connections {
+		wg.Add(1)
+		go func(name string, connection *Connection) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			status := b.probeConnection(ctx, storage, name, connection)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = status
+		}(name, connection)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// probeConnection checks a device and appends the result to its health history
+func (b *f5TokenBackend) probeConnection(ctx context.Context, storage logical.Storage, name string, connection *Connection) map[string]interface{} {
+	status := b.checkConnection(name, connection)
+
+	record := &healthRecord{
+		CheckedAt: time.Now(),
+		Success:   status["reachable"] == true,
+	}
+	if latency, ok := status["latency_ms"].(int64); ok {
+		record.LatencyMs = latency
+	} else if latency, ok := status["login_latency_ms"].(int64); ok {
+		record.LatencyMs = latency
+	}
+	if class, ok := status["error_class"].(string); ok {
+		record.ErrorClass = class
+		record.Error, _ = status["error"].(string)
+	}
+	if version, ok := status["version"].(string); ok {
+		record.Version = version
+	}
+
+	if err := b.appendHealthRecord(ctx, storage, name, record); err != nil {
+		b.Backend.Logger().Error("error storing health history", "name", name, "error", err)
+	}
+
+	return status
+}
+
+// getHealthHistory loads the stored probe history of a connection, oldest first
+func (b *f5TokenBackend) getHealthHistory(ctx context.Context, storage logical.Storage, name string) ([]*healthRecord, error) {
+	entry, err := storage.Get(ctx, healthStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var history []*healthRecord
+	if err := entry.DecodeJSON(&history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// healthSummary returns the circuit breaker state and the latest stored
+// probe result of a connection, without probing the device
+func (b *f5TokenBackend) healthSummary(ctx context.Context, storage logical.Storage, name string) (map[string]interface{}, error) {
+	history, err := b.getHealthHistory(ctx, storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := map[string]interface{}{
+		"circuit_breaker": b.breakerState(name),
+	}
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		summary["checked_at"] = latest.CheckedAt.Format(time.RFC3339)
+		summary["success"] = latest.Success
+		if latest.ErrorClass != "" {
+			summary["error_class"] = latest.ErrorClass
+		}
+	}
+
+	return summary, nil
+}
+
+// appendHealthRecord adds a probe result to a connection's history, keeping
+// only the configured number of most recent results
+func (b *f5TokenBackend) appendHealthRecord(ctx context.Context, storage logical.Storage, name string, record *healthRecord) error {
+	config, err := b.getMountConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	history, err := b.getHealthHistory(ctx, storage, name)
+	if err != nil {
+		return err
+	}
+
+	history = append(history, record)
+	if len(history) > config.HealthHistorySize {
+		history = history[len(history)-config.HealthHistorySize:]
+	}
+
+	entry, err := logical.StorageEntryJSON(healthStoragePrefix+name, history)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+// checkIssuanceHealth refuses issuance for a connection whose most recent
+// background probes have all failed. It only applies while background probing
+// is enabled and the history is recent enough to be trusted.
+func (b *f5TokenBackend) checkIssuanceHealth(ctx context.Context, storage logical.Storage, name string) error {
+	config, err := b.getMountConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if config.HealthCheckInterval <= 0 || config.HealthFailureThreshold <= 0 {
+		return nil
+	}
+
+	history, err := b.getHealthHistory(ctx, storage, name)
+	if err != nil {
+		return err
+	}
+	if len(history) < config.HealthFailureThreshold {
+		return nil
+	}
+
+	latest := history[len(history)-1]
+	maxAge := 3 * time.Duration(config.HealthCheckInterval) * time.Second
+	if time.Since(latest.CheckedAt) > maxAge {
+		return nil
+	}
+
+	for _, record := range history[len(history)-config.HealthFailureThreshold:] {
+		if record.Success {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("connection %s has failed its last %d health checks (last failure at %s, %s error: %s); refusing to issue tokens until it recovers",
+		name, config.HealthFailureThreshold, latest.CheckedAt.Format(time.RFC3339), latest.ErrorClass, latest.Error)
+}
+
+// scheduledHealthChecks probes every connection when the configured interval has elapsed
+func (b *f5TokenBackend) scheduledHealthChecks(ctx context.Context, storage logical.Storage) error {
+	// Only the node that owns storage may rewrite it
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	config, err := b.getMountConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if config.HealthCheckInterval <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	b.lock.Lock()
+	due := now.Sub(b.lastHealthCheck) >= time.Duration(config.HealthCheckInterval)*time.Second
+	if due {
+		b.lastHealthCheck = now
+	}
+	b.lock.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	_, err = b.probeAllConnections(ctx, storage)
+	return err
+}
+
+// errorClass classifies a probe error for the health history
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return errorClassCircuitOpen
+	case errors.Is(err, api.ErrAuthentication):
+		return errorClassAuth
+	case errors.Is(err, api.ErrTransport):
+		return errorClassTransport
+	default:
+		return errorClassAPI
+	}
+}
+
+// checkConnection probes a device and returns its health for API output.
+// Failures are reported in the result rather than returned as errors.
+func (b *f5TokenBackend) checkConnection(name string, connection *Connection) map[string]interface{} {
+	status := map[string]interface{}{
+		"host":       connection.Host,
+		"reachable":  false,
+		"checked_at": time.Now().Format(time.RFC3339),
+	}
+
+	start := time.Now()
+	probe, err := b.login(name, connection, 60)
+	status["login_latency_ms"] = time.Since(start).Milliseconds()
+	status["circuit_breaker"] = b.breaker(name).status()
+	if err != nil {
+		status["error"] = err.Error()
+		status["error_class"] = errorClass(err)
+		return status
+	}
+	status["credential"] = probe.Response.Credential
+	status["device_host"] = probe.Host
+	client := probe.Client
+	probeToken := probe.Response.Token.Token
+	defer func() {
+		if err := client.RevokeToken(probeToken); err != nil {
+			b.Backend.Logger().Warn("failed to revoke health probe token", "name", name, "error", err)
+		}
+	}()
+
+	start = time.Now()
+	version, err := client.GetVersion(probeToken)
+	status["latency_ms"] = time.Since(start).Milliseconds()
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		// The login itself showed the device is up
+		status["reachable"] = true
+	case err != nil:
+		status["error"] = err.Error()
+		status["error_class"] = errorClass(err)
+		return status
+	default:
+		status["reachable"] = true
+		status["product"] = version.Product
+		status["version"] = version.Version
+		status["build"] = version.Build
+	}
+
+	// BIG-IQ does not report a device failover state
+	if connection.platform() == api.PlatformBIGIP {
+		if failover, err := client.GetFailoverStatus(probeToken); err != nil {
+			status["failover_error"] = err.Error()
+		} else {
+			status["failover_status"] = failover.Status
+			status["failover_color"] = failover.Color
+		}
+	}
+
+	if notAfter, err := client.CertificateExpiry(); err != nil {
+		status["certificate_error"] = err.Error()
+	} else {
+		status["certificate_expires_at"] = notAfter.Format(time.RFC3339)
+		status["certificate_days_remaining"] = int(time.Until(notAfter).Hours() / 24)
+	}
+
+	if skew := b.skewStatus(name); skew != nil {
+		status["clock_skew"] = skew
+	}
+
+	return status
+}
@@ -0,0 +1,43 @@
+package bigiptoken
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Reads report stored results only; probing the device takes a write
+func TestHealthReadDoesNotProbe(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, map[string]interface{}{"verify_connection": false})
+
+	resp := testRequest(t, b, storage, logical.ReadOperation, "config/connection/lb1/status", nil)
+	if _, ok := resp.Data["checked_at"]; ok {
+		t.Fatalf("expected no stored result before the first probe, got %v", resp.Data)
+	}
+	testRequest(t, b, storage, logical.ReadOperation, "health", nil)
+	if logins := device.loginCount("admin"); logins != 0 {
+		t.Fatalf("expected reads not to log in, got %d logins", logins)
+	}
+
+	resp = testRequest(t, b, storage, logical.UpdateOperation, "config/connection/lb1/status", nil)
+	if resp.Data["reachable"] != true || resp.Data["version"] != "17.1.0" {
+		t.Fatalf("unexpected probe result: %v", resp.Data)
+	}
+	if logins := device.loginCount("admin"); logins != 1 {
+		t.Fatalf("expected the write to log in once, got %d logins", logins)
+	}
+
+	resp = testRequest(t, b, storage, logical.ReadOperation, "health", nil)
+	if resp.Data["healthy"] != 1 {
+		t.Fatalf("expected the stored probe to count as healthy, got %v", resp.Data)
+	}
+	resp = testRequest(t, b, storage, logical.ReadOperation, "health/lb1", nil)
+	if history := resp.Data["history"].([]map[string]interface{}); len(history) != 1 {
+		t.Fatalf("expected one history entry, got %v", history)
+	}
+	if logins := device.loginCount("admin"); logins != 1 {
+		t.Fatalf("expected reads not to log in, got %d logins", logins)
+	}
+}
@@ -0,0 +1,539 @@
+package bigiptoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Inventory formats accepted by import and produced by export
+const (
+	inventoryFormatJSON = "json"
+	inventoryFormatCSV  = "csv"
+)
+
+// maxConcurrentImportVerifications bounds how many imported connections are verified at once
+const maxConcurrentImportVerifications = 10
+
+// Per-row import outcomes
+const (
+	importStatusCreated    = "created"
+	importStatusUpdated    = "updated"
+	importStatusValid      = "valid"
+	importStatusInvalid    = "invalid"
+	importStatusExists     = "exists"
+	importStatusUnverified = "verification_failed"
+)
+
+// inventoryColumns are the fields of an inventory row, in CSV column order
+var inventoryColumns = []string{
+	"name", "host", "hosts", "host_selection", "username", "password",
+	"secondary_username", "secondary_password", "insecure_ssl",
+	"breaker_threshold", "breaker_cooldown", "tags", "metadata",
+	"platform", "login_provider",
+}
+
+// connectionNameRegex matches the connection names accepted by config/connection
+var connectionNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("name") + "$")
+
+// inventoryRow is a single connection in an imported or exported inventory
+type inventoryRow struct {
+	Name              string            `json:"name"`
+	Host              string            `json:"host,omitempty"`
+	Hosts             []string          `json:"hosts,omitempty"`
+	HostSelection     string            `json:"host_selection,omitempty"`
+	Username          string            `json:"username"`
+	Password          string            `json:"password,omitempty"`
+	SecondaryUsername string            `json:"secondary_username,omitempty"`
+	SecondaryPassword string            `json:"secondary_password,omitempty"`
+	InsecureSSL       bool              `json:"insecure_ssl"`
+	BreakerThreshold  int               `json:"breaker_threshold,omitempty"`
+	BreakerCooldown   int64             `json:"breaker_cooldown,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	Platform          string            `json:"platform,omitempty"`
+	LoginProvider     string            `json:"login_provider,omitempty"`
+}
+
+// importResult is the outcome of importing one inventory row
+type importResult struct {
+	row        int
+	name       string
+	status     string
+	err        string
+	connection *Connection
+	exists     bool
+}
+
+// pathConfigImport defines the path for importing a connection inventory
+func pathConfigImport(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/import$",
+		Fields: map[string]*framework.FieldSchema{
+			"inventory": {
+				Type:        framework.TypeString,
+				Description: "Connection inventory, as a JSON array of objects or as CSV with a header row",
+				Required:    true,
+			},
+			"format": {
+				Type:          framework.TypeString,
+				Description:   "Format of the inventory: json or csv",
+				Default:       inventoryFormatJSON,
+				AllowedValues: []interface{}{inventoryFormatJSON, inventoryFormatCSV},
+			},
+			"overwrite": {
+				Type:        framework.TypeBool,
+				Description: "Replace connections that already exist instead of reporting them",
+				Default:     false,
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "Log in to every F5 BIG-IP, in parallel, before saving its connection",
+				Default:     false,
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Validate (and optionally verify) the inventory without saving anything",
+				Default:     false,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigImportWrite,
+			},
+		},
+
+		HelpSynopsis:    "Import F5 BIG-IP connections in bulk",
+		HelpDescription: "This endpoint validates every entry of a JSON or CSV connection inventory and saves the valid ones, reporting the outcome for each row. Invalid rows do not stop the others from being imported.",
+	}
+}
+
+// pathConfigExport defines the path for exporting the connection inventory
+func pathConfigExport(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/export$",
+		Fields: map[string]*framework.FieldSchema{
+			"format": {
+				Type:          framework.TypeString,
+				Description:   "Format of the inventory: json or csv",
+				Default:       inventoryFormatJSON,
+				AllowedValues: []interface{}{inventoryFormatJSON, inventoryFormatCSV},
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigExportRead,
+			},
+		},
+
+		HelpSynopsis:    "Export the F5 BIG-IP connection inventory",
+		HelpDescription: "This endpoint returns every connection configuration, without passwords, in the same JSON or CSV format accepted by config/import.",
+	}
+}
+
+// pathConfigImportWrite handles config/import write operations
+func (b *f5TokenBackend) pathConfigImportWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	format := data.Get("format").(string)
+	overwrite := data.Get("overwrite").(bool)
+	verify := data.Get("verify_connection").(bool)
+	dryRun := data.Get("dry_run").(bool)
+
+	var rows []*inventoryRow
+	var rowErrs []error
+	var err error
+	switch format {
+	case inventoryFormatCSV:
+		rows, rowErrs, err = parseCSVInventory(data.Get("inventory").(string))
+	default:
+		rows, rowErrs, err = parseJSONInventory(data.Get("inventory").(string))
+	}
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error parsing inventory: %s", err)), nil
+	}
+
+	b.Backend.Logger().Info("importing connections", "rows", len(rows), "verify", verify, "dry_run", dryRun)
+
+	results := make([]*importResult, len(rows))
+	seen := make(map[string]int)
+	for i, row := range rows {
+		result := &importResult{row: i + 1, status: importStatusInvalid}
+		results[i] = result
+		if rowErrs[i] != nil {
+			result.err = rowErrs[i].Error()
+			continue
+		}
+		result.name = row.Name
+
+		if !connectionNameRegex.MatchString(row.Name) {
+			result.err = fmt.Sprintf("invalid connection name %q", row.Name)
+			continue
+		}
+		if first, ok := seen[row.Name]; ok {
+			result.err = fmt.Sprintf("duplicate of row %d", first)
+			continue
+		}
+		seen[row.Name] = result.row
+
+		connection := row.connection()
+		if err := connection.validate(); err != nil {
+			result.err = err.Error()
+			continue
+		}
+
+		existing, err := b.getConnection(ctx, req.Storage, row.Name)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil && !overwrite {
+			result.status = importStatusExists
+			result.err = "connection already exists; set overwrite=true to replace it"
+			continue
+		}
+
+		result.status = importStatusValid
+		result.connection = connection
+		result.exists = existing != nil
+	}
+
+	if verify {
+		b.verifyImport(results, dryRun)
+	}
+
+	if !dryRun {
+		for _, result := range results {
+			if result.status != importStatusValid {
+				continue
+			}
+			if _, err := b.saveConnection(ctx, req, result.name, result.connection, versionOperationImport, 0); err != nil {
+				return nil, err
+			}
+			b.resetBreaker(result.name)
+			b.resetHosts(result.name)
+			if err := req.Storage.Delete(ctx, healthStoragePrefix+result.name); err != nil {
+				return nil, err
+			}
+
+			result.status = importStatusCreated
+			if result.exists {
+				result.status = importStatusUpdated
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	out := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		counts[result.status]++
+		entry := map[string]interface{}{
+			"row":    result.row,
+			"name":   result.name,
+			"status": result.status,
+		}
+		if result.err != "" {
+			entry["error"] = result.err
+		}
+		out = append(out, entry)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":  dryRun,
+			"verified": verify,
+			"total":    len(results),
+			"summary":  counts,
+			"results":  out,
+		},
+	}
+	if failed := counts[importStatusInvalid] + counts[importStatusExists] + counts[importStatusUnverified]; failed > 0 {
+		resp.AddWarning(fmt.Sprintf("%d of %d row(s) were not imported; see results", failed, len(results)))
+	}
+
+	return resp, nil
+}
+
+// verifyImport logs in to the device of every valid row concurrently and
+// marks the rows whose credentials do not work. A dry run verifies without
+// touching the state of existing connections.
+func (b *f5TokenBackend) verifyImport(results []*importResult, dryRun bool) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentImportVerifications)
+
+	for _, result := range results {
+		if result.status != importStatusValid {
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *importResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if _, err := b.verifyCredentials(result.name, result.connection, dryRun); err != nil {
+				result.status = importStatusUnverified
+				result.err = err.Error()
+			}
+		}(result)
+	}
+
+	wg.Wait()
+}
+
+// pathConfigExportRead handles config/export read operations
+func (b *f5TokenBackend) pathConfigExportRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, connections, err := b.findConnections(ctx, req.Storage, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]*inventoryRow, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, exportRow(name, connections[name]))
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"exported_at": time.Now().UTC().Format(time.RFC3339),
+			"count":       len(rows),
+		},
+	}
+
+	if data.Get("format").(string) == inventoryFormatCSV {
+		inventory, err := formatCSVInventory(rows)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data["inventory"] = inventory
+		return resp, nil
+	}
+
+	resp.Data["connections"] = rows
+	return resp, nil
+}
+
+// connection builds a connection configuration from an inventory row,
+// applying the same defaults as config/connection
+func (r *inventoryRow) connection() *Connection {
+	connection := &Connection{
+		Host:              r.Host,
+		Username:          r.Username,
+		Password:          r.Password,
+		InsecureSSL:       r.InsecureSSL,
+		Hosts:             r.Hosts,
+		HostSelection:     r.HostSelection,
+		Tags:              r.Tags,
+		Metadata:          r.Metadata,
+		BreakerThreshold:  r.BreakerThreshold,
+		BreakerCooldown:   r.BreakerCooldown,
+		SecondaryUsername: r.SecondaryUsername,
+		SecondaryPassword: r.SecondaryPassword,
+		Platform:          r.Platform,
+		LoginProvider:     r.LoginProvider,
+	}
+	if connection.Host == "" && len(connection.Hosts) > 0 {
+		connection.Host = connection.Hosts[0]
+	}
+
+	// Omitted breaker settings take the defaults; anything else is validated
+	if connection.BreakerThreshold == 0 {
+		connection.BreakerThreshold = defaultBreakerThreshold
+	}
+	if connection.BreakerCooldown == 0 {
+		connection.BreakerCooldown = int64(defaultBreakerCooldown / time.Second)
+	}
+
+	return connection
+}
+
+// exportRow renders a stored connection as an inventory row, without passwords
+func exportRow(name string, connection *Connection) *inventoryRow {
+	threshold, cooldown := connection.breakerSettings()
+	return &inventoryRow{
+		Name:              name,
+		Host:              connection.Host,
+		Hosts:             connection.Hosts,
+		HostSelection:     connection.HostSelection,
+		Username:          connection.Username,
+		SecondaryUsername: connection.SecondaryUsername,
+		InsecureSSL:       connection.InsecureSSL,
+		BreakerThreshold:  threshold,
+		BreakerCooldown:   int64(cooldown / time.Second),
+		Tags:              connection.Tags,
+		Metadata:          connection.Metadata,
+		Platform:          connection.platform(),
+		LoginProvider:     connection.LoginProvider,
+	}
+}
+
+// parseJSONInventory parses a JSON array of inventory rows. A row that does
+// not decode is reported in the matching slot of the returned errors.
+func parseJSONInventory(raw string) ([]*inventoryRow, []error, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		return nil, nil, err
+	}
+
+	rows := make([]*inventoryRow, len(items))
+	errs := make([]error, len(items))
+	for i, item := range items {
+		row := &inventoryRow{}
+		dec := json.NewDecoder(bytes.NewReader(item))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(row); err != nil {
+			errs[i] = err
+		}
+		rows[i] = row
+	}
+
+	return rows, errs, nil
+}
+
+// parseCSVInventory parses CSV inventory rows. The first record is a header
+// naming the columns; unknown columns are rejected. A row with more or fewer
+// columns than the header is reported as invalid on its own.
+func parseCSVInventory(raw string) ([]*inventoryRow, []error, error) {
+	reader := csv.NewReader(strings.NewReader(raw))
+	reader.TrimLeadingSpace = true
+	// Column counts are checked per row, so one bad row does not abort the import
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing header row: %w", err)
+	}
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if !slices.Contains(inventoryColumns, header[i]) {
+			return nil, nil, fmt.Errorf("unknown column %q", column)
+		}
+	}
+
+	var rows []*inventoryRow
+	var errs []error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		row, err := csvRow(header, record)
+		rows = append(rows, row)
+		errs = append(errs, err)
+	}
+
+	return rows, errs, nil
+}
+
+// csvRow converts one CSV record to an inventory row
+func csvRow(header, record []string) (*inventoryRow, error) {
+	row := &inventoryRow{}
+	if len(record) != len(header) {
+		return row, fmt.Errorf("row has %d columns, but the header has %d", len(record), len(header))
+	}
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		var err error
+		switch header[i] {
+		case "name":
+			row.Name = value
+		case "host":
+			row.Host = value
+		case "hosts":
+			for _, host := range strings.Split(value, ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					row.Hosts = append(row.Hosts, host)
+				}
+			}
+		case "host_selection":
+			row.HostSelection = value
+		case "username":
+			row.Username = value
+		case "password":
+			row.Password = value
+		case "secondary_username":
+			row.SecondaryUsername = value
+		case "secondary_password":
+			row.SecondaryPassword = value
+		case "insecure_ssl":
+			row.InsecureSSL, err = strconv.ParseBool(value)
+		case "breaker_threshold":
+			row.BreakerThreshold, err = strconv.Atoi(value)
+		case "breaker_cooldown":
+			row.BreakerCooldown, err = strconv.ParseInt(value, 10, 64)
+		case "tags":
+			row.Tags, err = parseKeyValues(value)
+		case "metadata":
+			row.Metadata, err = parseKeyValues(value)
+		case "platform":
+			row.Platform = value
+		case "login_provider":
+			row.LoginProvider = value
+		}
+		if err != nil {
+			return row, fmt.Errorf("column %s: %w", header[i], err)
+		}
+	}
+
+	return row, nil
+}
+
+// formatCSVInventory renders inventory rows as CSV, without password columns
+func formatCSVInventory(rows []*inventoryRow) (string, error) {
+	columns := make([]string, 0, len(inventoryColumns))
+	for _, column := range inventoryColumns {
+		if column != "password" && column != "secondary_password" {
+			columns = append(columns, column)
+		}
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(columns); err != nil {
+		return "", err
+	}
+
+	for _, row := range rows {
+		record := []string{
+			row.Name,
+			row.Host,
+			strings.Join(row.Hosts, ","),
+			row.HostSelection,
+			row.Username,
+			row.SecondaryUsername,
+			strconv.FormatBool(row.InsecureSSL),
+			strconv.Itoa(row.BreakerThreshold),
+			strconv.FormatInt(row.BreakerCooldown, 10),
+			formatKeyValues(row.Tags),
+			formatKeyValues(row.Metadata),
+			row.Platform,
+			row.LoginProvider,
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
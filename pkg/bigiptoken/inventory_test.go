@@ -0,0 +1,164 @@
+package bigiptoken
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestImportErrors(t *testing.T) {
+	// Each want entry is a row status, optionally followed by ": " and a
+	// fragment of the row's error
+	tests := []struct {
+		name    string
+		format  string
+		data    map[string]interface{}
+		input   string
+		wantErr string
+		want    []string
+	}{
+		{
+			name:    "json not an array",
+			format:  inventoryFormatJSON,
+			input:   `{"name": "lb1"}`,
+			wantErr: "error parsing inventory",
+		},
+		{
+			name:   "json rows",
+			format: inventoryFormatJSON,
+			input: `[
+				{"name": "lb1", "host": "192.0.2.1", "username": "admin", "password": "password"},
+				{"name": "lb2", "host": "192.0.2.2", "username": "admin", "password": "password", "colour": "blue"},
+				{"name": "lb3", "host": "192.0.2.3", "username": "admin"},
+				{"name": "lb 4", "host": "192.0.2.4", "username": "admin", "password": "password"},
+				{"name": "lb1", "host": "192.0.2.5", "username": "admin", "password": "password"},
+				{"name": "lb0", "host": "192.0.2.6", "username": "admin", "password": "password"},
+				{"name": "lb5", "host": "192.0.2.7/mgmt", "username": "admin", "password": "password"}
+			]`,
+			want: []string{
+				"created",
+				`invalid: unknown field "colour"`,
+				"invalid: host, username, and password are required",
+				"invalid: invalid connection name",
+				"invalid: duplicate of row 1",
+				"exists: set overwrite=true",
+				"invalid: is not a valid hostname",
+			},
+		},
+		{
+			name:    "csv without header",
+			format:  inventoryFormatCSV,
+			input:   "",
+			wantErr: "missing header row",
+		},
+		{
+			name:    "csv unknown column",
+			format:  inventoryFormatCSV,
+			input:   "name,host,colour\nlb1,192.0.2.1,blue\n",
+			wantErr: `unknown column "colour"`,
+		},
+		{
+			name:   "csv rows",
+			format: inventoryFormatCSV,
+			input: "name,host,username,password,insecure_ssl,breaker_threshold,tags\n" +
+				"lb1,192.0.2.1,admin,password,true,5,site=dc1\n" +
+				"lb2,192.0.2.2,admin\n" +
+				"lb3,192.0.2.3,admin,password,maybe,,\n" +
+				"lb4,192.0.2.4,admin,password,,three,\n" +
+				"lb5,192.0.2.5,admin,password,,,site\n" +
+				"lb0,192.0.2.6,admin,password,,,\n",
+			want: []string{
+				"created",
+				"invalid: row has 3 columns, but the header has 7",
+				"invalid: column insecure_ssl",
+				"invalid: column breaker_threshold",
+				"invalid: column tags",
+				"exists",
+			},
+		},
+		{
+			name:   "overwrite",
+			format: inventoryFormatCSV,
+			data:   map[string]interface{}{"overwrite": true},
+			input:  "name,host,username,password\nlb0,192.0.2.9,admin,password\n",
+			want:   []string{"updated"},
+		},
+		{
+			name:   "dry run",
+			format: inventoryFormatCSV,
+			data:   map[string]interface{}{"dry_run": true},
+			input:  "name,host,username,password\nlb1,192.0.2.1,admin,password\nlb2,192.0.2.2,admin,\n",
+			want:   []string{"valid", "invalid: host, username, and password are required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			testRequest(t, b, storage, logical.UpdateOperation, "config/connection/lb0", map[string]interface{}{
+				"host":              "192.0.2.100",
+				"username":          "admin",
+				"password":          "password",
+				"verify_connection": false,
+			})
+
+			data := map[string]interface{}{"format": tt.format, "inventory": tt.input}
+			for key, value := range tt.data {
+				data[key] = value
+			}
+
+			if tt.wantErr != "" {
+				if msg := testRequestError(t, b, storage, logical.UpdateOperation, "config/import", data); !strings.Contains(msg, tt.wantErr) {
+					t.Fatalf("unexpected error: %s", msg)
+				}
+				return
+			}
+
+			resp := testRequest(t, b, storage, logical.UpdateOperation, "config/import", data)
+			results := resp.Data["results"].([]map[string]interface{})
+			if len(results) != len(tt.want) {
+				t.Fatalf("got %d results, want %d: %v", len(results), len(tt.want), results)
+			}
+
+			created := make(map[string]bool)
+			failed := 0
+			for i, want := range tt.want {
+				status, fragment, _ := strings.Cut(want, ": ")
+				result := results[i]
+				if result["status"] != status {
+					t.Errorf("row %d: status = %v, want %s (%v)", i+1, result["status"], status, result["error"])
+				}
+				if msg, _ := result["error"].(string); !strings.Contains(msg, fragment) {
+					t.Errorf("row %d: error = %q, want one containing %q", i+1, msg, fragment)
+				}
+
+				switch status {
+				case importStatusCreated:
+					created[result["name"].(string)] = true
+				case importStatusInvalid, importStatusExists:
+					failed++
+				}
+			}
+
+			// Only created rows add connections to storage
+			names, err := storage.List(context.Background(), "config/connection/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != len(created)+1 {
+				t.Errorf("stored connections = %v, want lb0 and %v", names, created)
+			}
+			for _, name := range names {
+				if name != "lb0" && !created[name] {
+					t.Errorf("connection %s was stored from a row that was not imported", name)
+				}
+			}
+
+			if (failed > 0) != (len(resp.Warnings) > 0) {
+				t.Errorf("warnings = %v with %d row(s) not imported", resp.Warnings, failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package bigiptoken
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// secretRefreshableTokenType is the lease type for access tokens issued with
+// a refresh token, such as BIG-IP Next Central Manager tokens
+const secretRefreshableTokenType = "f5_refreshable_token"
+
+// secretRefreshableToken defines the lease returned for access tokens that
+// are kept alive with a refresh token. Renewing the lease refreshes the
+// access token; revoking it logs the session out.
+func secretRefreshableToken(b *f5TokenBackend) *framework.Secret {
+	return &framework.Secret{
+		Type: secretRefreshableTokenType,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "Access token",
+			},
+		},
+		Renew:  b.secretRefreshableTokenRenew,
+		Revoke: b.secretRefreshableTokenRevoke,
+	}
+}
+
+// refreshableTokenResponse wraps an issued token's response data in a lease.
+// The lease lasts as long as the access token and can be renewed up to the
+// requested TTL. Both tokens are kept in the lease's internal data.
+func (b *f5TokenBackend) refreshableTokenResponse(data map[string]interface{}, tokenID string, tokenEntry *TokenEntry, ttl int) *logical.Response {
+	resp := b.Secret(secretRefreshableTokenType).Response(data, map[string]interface{}{
+		"connection":    tokenEntry.Host,
+		"token_id":      tokenID,
+		"access_token":  tokenEntry.Token,
+		"refresh_token": tokenEntry.RefreshToken,
+	})
+	resp.Secret.TTL = time.Until(tokenEntry.ExpiresAt).Round(time.Second)
+	resp.Secret.MaxTTL = time.Duration(ttl) * time.Second
+	return resp
+}
+
+// secretRefreshableTokenRenew exchanges the refresh token for a new access
+// and refresh token and extends the lease to the new access token's lifetime
+func (b *f5TokenBackend) secretRefreshableTokenRenew(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, tokenID, err := leaseToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenEntry, err := b.getTokenEntry(ctx, req.Storage, name, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if tokenEntry == nil || !tokenEntry.IsActive {
+		return logical.ErrorResponse(fmt.Sprintf("token %s is no longer active", tokenID)), nil
+	}
+
+	connection, err := b.requireConnection(ctx, req.Storage, name)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if _, err := b.refreshTokenEntry(ctx, req.Storage, connection, tokenID, tokenEntry, 0); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error refreshing token: %s", err)), nil
+	}
+
+	b.Backend.Logger().Debug("renewed token lease", "name", name, "token_id", tokenID)
+
+	resp := &logical.Response{
+		Secret: req.Secret,
+		Data: map[string]interface{}{
+			"token_id":   tokenID,
+			"token":      tokenEntry.Token,
+			"host":       name,
+			"expires_at": tokenEntry.ExpiresAt.Format(time.RFC3339),
+		},
+	}
+	resp.Secret.InternalData["access_token"] = tokenEntry.Token
+	resp.Secret.InternalData["refresh_token"] = tokenEntry.RefreshToken
+	resp.Secret.TTL = time.Until(tokenEntry.ExpiresAt).Round(time.Second)
+
+	return resp, nil
+}
+
+// secretRefreshableTokenRevoke logs out the session behind a token lease
+func (b *f5TokenBackend) secretRefreshableTokenRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, tokenID, err := leaseToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenEntry, err := b.getTokenEntry(ctx, req.Storage, name, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if tokenEntry == nil || !tokenEntry.IsActive {
+		return nil, nil
+	}
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		// The connection was force-deleted; the token is orphaned
+		return nil, nil
+	}
+
+	// Sessions that have already ended count as revoked; any other failure
+	// leaves the lease for Vault to retry
+	return nil, b.revokeTokenEntry(ctx, req.Storage, connection, tokenID, tokenEntry)
+}
+
+// leaseToken returns the connection and token ID recorded in a token lease
+func leaseToken(req *logical.Request) (string, string, error) {
+	name, _ := req.Secret.InternalData["connection"].(string)
+	tokenID, _ := req.Secret.InternalData["token_id"].(string)
+	if name == "" || tokenID == "" {
+		return "", "", fmt.Errorf("token lease is missing its connection or token ID")
+	}
+	return name, tokenID, nil
+}
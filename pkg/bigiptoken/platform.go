@@ -0,0 +1,33 @@
+package bigiptoken
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// platform returns the kind of device the connection points at, defaulting
+// to BIG-IP for connections stored before platforms existed
+func (c *Connection) platform() string {
+	if c.Platform == "" {
+		return api.PlatformBIGIP
+	}
+	return c.Platform
+}
+
+// validatePlatform checks the platform and the settings that depend on it
+func (c *Connection) validatePlatform() error {
+	if !api.ValidPlatform(c.platform()) {
+		return fmt.Errorf("platform must be one of %s", strings.Join(api.Platforms(), ", "))
+	}
+	// Login providers are a TMOS concept
+	if c.LoginProvider != "" && c.platform() != api.PlatformBIGIP && c.platform() != api.PlatformBIGIQ {
+		return fmt.Errorf("login_provider is not supported on %s", c.platform())
+	}
+	// prefer_active relies on the BIG-IP failover status
+	if c.platform() != api.PlatformBIGIP && c.hostSelection() == hostSelectionPreferActive {
+		return fmt.Errorf("host_selection %s is only supported on %s", hostSelectionPreferActive, api.PlatformBIGIP)
+	}
+	return nil
+}
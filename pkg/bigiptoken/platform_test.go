@@ -0,0 +1,308 @@
+package bigiptoken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// f5osDevice is a local stand-in for the F5OS RESTCONF session endpoints.
+// Any request with basic auth opens a session; a request made with a
+// session token rotates it, as F5OS does.
+type f5osDevice struct {
+	mu       sync.Mutex
+	password string
+	sessions map[string]bool
+	issued   int
+}
+
+// newF5OSDevice starts an F5OS stand-in that accepts admin/password; the
+// server is closed when the test ends
+func newF5OSDevice(t *testing.T) (*f5osDevice, *httptest.Server) {
+	t.Helper()
+
+	device := &f5osDevice{password: "password", sessions: make(map[string]bool)}
+	srv := httptest.NewTLSServer(http.HandlerFunc(device.serveHTTP))
+	t.Cleanup(srv.Close)
+
+	return device, srv
+}
+
+func (d *f5osDevice) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	token := r.Header.Get("X-Auth-Token")
+	if token == "" {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != d.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if !d.sessions[token] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/restconf/data/openconfig-system:system/aaa":
+		delete(d.sessions, token)
+		d.issued++
+		token = fmt.Sprintf("%06dF5OS", d.issued)
+		d.sessions[token] = true
+		w.Header().Set("X-Auth-Token", token)
+		w.Write([]byte("{}"))
+
+	case "/restconf/operations/openconfig-system:system/aaa/authentication/f5-aaa-confd-restconf-token:logout":
+		delete(d.sessions, token)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "/restconf/data/openconfig-system:system/f5-system-version:version":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"f5-system-version:version": map[string]string{"os-version": "1.7.0", "service-version": "1.7.0-1234"},
+		})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// holds reports whether a session token is still valid
+func (d *f5osDevice) holds(token string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.sessions[token]
+}
+
+func TestF5OSRefreshAndLogout(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newF5OSDevice(t)
+	testConnection(t, b, storage, "r5k", srv, map[string]interface{}{"platform": "f5os"})
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "token/r5k", map[string]interface{}{"ttl": 600})
+	tokenID := resp.Data["token_id"].(string)
+	issued := resp.Data["token"].(string)
+	if !device.holds(issued) {
+		t.Fatalf("expected token %s to be a live session", issued)
+	}
+
+	resp = testRequest(t, b, storage, logical.UpdateOperation, "tokens/r5k/"+tokenID+"/refresh", nil)
+	refreshed := resp.Data["token"].(string)
+	if refreshed == issued || !device.holds(refreshed) || device.holds(issued) {
+		t.Fatalf("expected the refresh to replace %s with a new session, got %s", issued, refreshed)
+	}
+	if resp.Data["ttl"] != int64(600) {
+		t.Errorf("ttl = %v, want the issued 600", resp.Data["ttl"])
+	}
+
+	// The stored record follows the rotated token, so revocation logs out
+	// the live session
+	testRequest(t, b, storage, logical.UpdateOperation, "revoke-all/r5k", nil)
+	if device.holds(refreshed) {
+		t.Fatalf("expected session %s to be logged out", refreshed)
+	}
+
+	resp = testRequest(t, b, storage, logical.ReadOperation, "tokens/r5k/"+tokenID, nil)
+	if resp.Data["active"] != false {
+		t.Errorf("expected the record to be inactive after revocation, got %v", resp.Data)
+	}
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "tokens/r5k/"+tokenID+"/refresh", nil); msg != fmt.Sprintf("token %s is no longer active", tokenID) {
+		t.Errorf("unexpected error refreshing a revoked token: %s", msg)
+	}
+}
+
+// nextcmDevice is a local stand-in for the BIG-IP Next Central Manager
+// login, refresh and logout endpoints. Each login or refresh issues an
+// access and refresh token pair; a refresh or logout ends the old pair.
+type nextcmDevice struct {
+	mu       sync.Mutex
+	password string
+	access   map[string]string // access token to its refresh token
+	refresh  map[string]string // refresh token to its access token
+	issued   int
+}
+
+// newNextCMDevice starts a Next CM stand-in that accepts admin/password;
+// the server is closed when the test ends
+func newNextCMDevice(t *testing.T) (*nextcmDevice, *httptest.Server) {
+	t.Helper()
+
+	device := &nextcmDevice{
+		password: "password",
+		access:   make(map[string]string),
+		refresh:  make(map[string]string),
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(device.serveHTTP))
+	t.Cleanup(srv.Close)
+
+	return device, srv
+}
+
+func (d *nextcmDevice) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var body map[string]string
+	if r.Method == "POST" && r.Header.Get("Content-Type") == "application/json" {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch r.URL.Path {
+	case "/api/login":
+		if body["username"] != "admin" || body["password"] != d.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		d.issue(w)
+
+	case "/api/token-refresh":
+		access, ok := d.refresh[body["refresh_token"]]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		d.end(access, body["refresh_token"])
+		d.issue(w)
+
+	case "/api/logout":
+		access := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		refresh, ok := d.access[access]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		d.end(access, refresh)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// issue opens a session and writes its token pair; d.mu must be held
+func (d *nextcmDevice) issue(w http.ResponseWriter) {
+	d.issued++
+	access, refresh := fmt.Sprintf("%06dACCESS", d.issued), fmt.Sprintf("%06dREFRESH", d.issued)
+	d.access[access] = refresh
+	d.refresh[refresh] = access
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    300,
+	})
+}
+
+// end ends the session of a token pair; d.mu must be held
+func (d *nextcmDevice) end(access, refresh string) {
+	delete(d.access, access)
+	delete(d.refresh, refresh)
+}
+
+// expire lets an access token lapse while its refresh token stays valid
+func (d *nextcmDevice) expire(access string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.access, access)
+}
+
+// sessions returns how many access and refresh tokens are still valid
+func (d *nextcmDevice) sessions() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.access), len(d.refresh)
+}
+
+func TestNextCMLeaseRenewAndRevoke(t *testing.T) {
+	tests := []struct {
+		name         string
+		expireAccess bool
+	}{
+		{name: "live access token"},
+		// A lapsed access token cannot log out; its refresh token must not
+		// outlive the lease
+		{name: "lapsed access token", expireAccess: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := testBackend(t)
+			device, srv := newNextCMDevice(t)
+			testConnection(t, b, storage, "cm1", srv, map[string]interface{}{"platform": "nextcm"})
+			ctx := context.Background()
+
+			resp := testRequest(t, b, storage, logical.UpdateOperation, "token/cm1", nil)
+			if resp.Secret == nil || !resp.Secret.Renewable {
+				t.Fatalf("expected a renewable lease, got %v", resp.Secret)
+			}
+			issued := resp.Data["token"].(string)
+
+			renewed, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RenewOperation,
+				Path:      "token/cm1",
+				Storage:   storage,
+				Secret:    resp.Secret,
+			})
+			if err != nil || renewed.IsError() {
+				t.Fatalf("renewing the lease: %v %v", renewed, err)
+			}
+			current := renewed.Data["token"].(string)
+			if current == issued {
+				t.Fatalf("expected the renewal to exchange the token pair, still have %s", current)
+			}
+			if access, refresh := device.sessions(); access != 1 || refresh != 1 {
+				t.Fatalf("expected only the renewed session to be live, got %d access and %d refresh tokens", access, refresh)
+			}
+
+			if tt.expireAccess {
+				device.expire(current)
+			}
+			revoked, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RevokeOperation,
+				Path:      "token/cm1",
+				Storage:   storage,
+				Secret:    renewed.Secret,
+			})
+			if err != nil || (revoked != nil && revoked.IsError()) {
+				t.Fatalf("revoking the lease: %v %v", revoked, err)
+			}
+			if access, refresh := device.sessions(); access != 0 || refresh != 0 {
+				t.Fatalf("expected the session to be ended, got %d access and %d refresh tokens", access, refresh)
+			}
+		})
+	}
+}
+
+// Next CM tokens need a lease each to be kept alive, so Next CM
+// connections cannot join a group, even through a selector matching a
+// connection added after the group was written
+func TestNextCMGroupRefused(t *testing.T) {
+	b, storage := testBackend(t)
+	_, srv := newNextCMDevice(t)
+	testConnection(t, b, storage, "cm1", srv, map[string]interface{}{"platform": "nextcm"})
+
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "config/group/all", map[string]interface{}{
+		"members": "cm1",
+	}); !strings.Contains(msg, "cm1") {
+		t.Fatalf("unexpected error writing the group: %s", msg)
+	}
+
+	testRequest(t, b, storage, logical.UpdateOperation, "config/group/managers", map[string]interface{}{"selector": "role=manager"})
+	testConnection(t, b, storage, "cm2", srv, map[string]interface{}{
+		"platform": "nextcm",
+		"tags":     map[string]interface{}{"role": "manager"},
+	})
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "group-token/managers", nil); !strings.Contains(msg, "cm2") {
+		t.Fatalf("unexpected error issuing for the group: %s", msg)
+	}
+}
@@ -0,0 +1,363 @@
+package bigiptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// errNoTokenStore is returned when reconciling a connection whose platform
+// does not expose the tokens a device holds
+var errNoTokenStore = errors.New("platform has no token store to reconcile against")
+
+// reconcileUnknownGrace is how long before the reconcile started a token must
+// have been created or last updated on the device before an unknown token is
+// revoked. Younger tokens may belong to an issuance that has not stored its
+// record yet, or to another node's probe.
+const reconcileUnknownGrace = time.Minute
+
+// reconcileResult describes the drift between Vault's token records and the device's token store
+type reconcileResult struct {
+	Matched        int
+	Unknown        []map[string]string
+	Stale          []string
+	Missing        []string
+	Corrected      map[string]interface{}
+	RevokedUnknown int
+	Errors         []string
+}
+
+// pathReconcile defines the path for reconciling a connection against its device's token store
+func pathReconcile(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "reconcile/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection to reconcile",
+				Required:    true,
+			},
+			"revoke_unknown": {
+				Type:        framework.TypeBool,
+				Description: "Revoke tokens held by the device for the connection user that Vault did not issue or has already revoked",
+				Default:     false,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathReconcileWrite,
+			},
+		},
+
+		HelpSynopsis:    "Reconcile Vault's token records with the F5 BIG-IP token store",
+		HelpDescription: "This endpoint lists the tokens the F5 BIG-IP holds for the connection user, reports drift against the tokens stored in Vault, corrects expiry times from the device and optionally revokes tokens Vault does not know about.",
+	}
+}
+
+// pathReconcileWrite handles reconcile/ write operations
+func (b *f5TokenBackend) pathReconcileWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("connection name cannot be empty"), nil
+	}
+
+	result, err := b.reconcileConnection(ctx, req.Storage, name, data.Get("revoke_unknown").(bool))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error reconciling connection: %s", err)), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":            name,
+			"matched":         result.Matched,
+			"unknown":         result.Unknown,
+			"stale":           result.Stale,
+			"missing":         result.Missing,
+			"corrected":       result.Corrected,
+			"revoked_unknown": result.RevokedUnknown,
+		},
+	}
+	for _, e := range result.Errors {
+		resp.AddWarning(e)
+	}
+
+	return resp, nil
+}
+
+// reconcileConnection compares the tokens each unit of the connection holds
+// for the connection users with the tokens stored for the connection. Vault
+// records are corrected to match the device: expiry times are taken from
+// expirationMicros and active tokens the device no longer holds are marked
+// inactive. Units that cannot be reached are reported and left untouched.
+func (b *f5TokenBackend) reconcileConnection(ctx context.Context, storage logical.Storage, name string, revokeUnknown bool) (*reconcileResult, error) {
+	connection, err := b.requireConnection(ctx, storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if !api.HasTokenStore(connection.platform()) {
+		return nil, fmt.Errorf("connection %s (%s): %w", name, connection.platform(), errNoTokenStore)
+	}
+
+	result := &reconcileResult{
+		Unknown:   []map[string]string{},
+		Stale:     []string{},
+		Missing:   []string{},
+		Corrected: map[string]interface{}{},
+		Errors:    []string{},
+	}
+
+	hosts := connection.managementHosts()
+	var errs []error
+	for _, host := range hosts {
+		if err := b.reconcileHost(ctx, storage, name, connection, host, revokeUnknown, result); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to reconcile %s: %s", host, err))
+		}
+	}
+	if len(errs) == len(hosts) {
+		return nil, errors.Join(errs...)
+	}
+
+	if len(result.Unknown) > 0 || len(result.Stale) > 0 || len(result.Missing) > 0 {
+		b.Backend.Logger().Warn("token drift detected", "name", name,
+			"unknown", len(result.Unknown), "stale", len(result.Stale), "missing", len(result.Missing))
+	}
+
+	return result, nil
+}
+
+// reconcileHost reconciles the tokens issued by one management host of a
+// connection against that host's token store, adding to result. Vault's
+// records are loaded only after the device has been listed, so a token
+// issued while the listing runs is matched rather than reported as unknown.
+func (b *f5TokenBackend) reconcileHost(ctx context.Context, storage logical.Storage, name string, connection *Connection, host string, revokeUnknown bool, result *reconcileResult) error {
+	// Log in with a short-lived probe token to read the token store
+	probe, err := b.loginWithCredential(name, connection, []string{host}, 60, "")
+	if err != nil {
+		return err
+	}
+	client := probe.Client
+	probeToken := probe.Response.Token.Token
+	defer func() {
+		if err := client.RevokeToken(probeToken); err != nil {
+			b.Backend.Logger().Warn("failed to revoke reconcile probe token", "name", name, "host", host, "error", err)
+		}
+	}()
+
+	items, err := client.ListTokens(probeToken)
+	if err != nil {
+		return err
+	}
+
+	records, err := b.hostTokenRecords(ctx, storage, name, connection, host)
+	if err != nil {
+		return err
+	}
+
+	// Measure token age on the device clock, from when the probe was issued
+	cutoff := time.Now().Add(-reconcileUnknownGrace).UnixMicro()
+	for _, item := range items {
+		if item.Token == probeToken && item.LastUpdateMicros != 0 {
+			cutoff = item.LastUpdateMicros - reconcileUnknownGrace.Microseconds()
+		}
+	}
+
+	// Role tokens belong to the roles' service users rather than the
+	// connection's own users
+	roleUsers := make(map[string]bool)
+	for _, record := range records {
+		if record.Entry.Role != "" && record.Entry.Username != "" {
+			roleUsers[record.Entry.Username] = true
+		}
+	}
+
+	onDevice := make(map[string]*api.TokenItem)
+	for i := range items {
+		item := &items[i]
+		if item.Token == probeToken || !(connection.ownsToken(item) || roleUsers[item.Owner()]) {
+			continue
+		}
+		onDevice[item.Token] = item
+	}
+
+	for _, record := range records {
+		tokenEntry := record.Entry
+		item, held := onDevice[tokenEntry.Token]
+		delete(onDevice, tokenEntry.Token)
+
+		switch {
+		case held && tokenEntry.IsActive:
+			result.Matched++
+			if item.ExpirationMicros == 0 {
+				continue
+			}
+			// Shift the local expiry by however far the device's expiry has
+			// moved, so clock skew between Vault and the device cancels out
+			expiresAt := time.UnixMicro(item.ExpirationMicros)
+			if tokenEntry.ExpirationMicros != 0 {
+				expiresAt = tokenEntry.ExpiresAt.Add(time.Duration(item.ExpirationMicros-tokenEntry.ExpirationMicros) * time.Microsecond)
+			}
+			// Ignore sub-second differences from local rounding
+			if drift := expiresAt.Sub(tokenEntry.ExpiresAt); drift > -time.Second && drift < time.Second {
+				continue
+			}
+			result.Corrected[record.ID] = map[string]interface{}{
+				"old_expires_at": tokenEntry.ExpiresAt.Format(time.RFC3339),
+				"new_expires_at": expiresAt.Format(time.RFC3339),
+			}
+			tokenEntry.ExpiresAt = expiresAt
+			tokenEntry.ExpirationMicros = item.ExpirationMicros
+			if err := b.putTokenEntry(ctx, storage, record.ID, tokenEntry); err != nil {
+				return err
+			}
+		case held:
+			// Vault considers the token revoked but the device still honours it
+			result.Stale = append(result.Stale, record.ID)
+			if revokeUnknown {
+				if err := client.DeleteToken(probeToken, item.Token); err != nil {
+					result.Errors = append(result.Errors, fmt.Sprintf("failed to revoke stale token %s: %s", record.ID, err))
+				}
+			}
+		case tokenEntry.IsActive:
+			// The device has already dropped the token
+			result.Missing = append(result.Missing, record.ID)
+			if tokenEntry.DynamicUser {
+				if err := b.deleteDynamicUser(connection, tokenEntry); err != nil {
+					result.Errors = append(result.Errors, fmt.Sprintf("failed to delete dynamic user of missing token %s: %s", record.ID, err))
+					continue
+				}
+			}
+			tokenEntry.IsActive = false
+			if err := b.putTokenEntry(ctx, storage, record.ID, tokenEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Drop tokens whose records were stored while the device was compared
+	if len(onDevice) > 0 {
+		current, err := b.hostTokenRecords(ctx, storage, name, connection, host)
+		if err != nil {
+			return err
+		}
+		for _, record := range current {
+			delete(onDevice, record.Entry.Token)
+		}
+	}
+
+	unknown := make([]string, 0, len(onDevice))
+	for token := range onDevice {
+		unknown = append(unknown, token)
+	}
+	sort.Strings(unknown)
+
+	for _, token := range unknown {
+		item := onDevice[token]
+		entry := map[string]string{
+			"token_hint": maskToken(token),
+			"user":       item.Owner(),
+			"host":       host,
+		}
+		if item.ExpirationMicros != 0 {
+			entry["expires_at"] = time.UnixMicro(item.ExpirationMicros).UTC().Format(time.RFC3339)
+		}
+		// A token created after the reconcile started may be one Vault is
+		// still issuing, so it is reported but never revoked
+		recent := item.LastUpdateMicros > cutoff
+		if recent {
+			entry["recent"] = "true"
+		}
+		result.Unknown = append(result.Unknown, entry)
+
+		if revokeUnknown && !recent {
+			if err := client.DeleteToken(probeToken, token); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("failed to revoke unknown token %s: %s", maskToken(token), err))
+				continue
+			}
+			result.RevokedUnknown++
+		}
+	}
+
+	return nil
+}
+
+// hostTokenRecords returns every token record of a connection that was
+// issued by the given management host
+func (b *f5TokenBackend) hostTokenRecords(ctx context.Context, storage logical.Storage, name string, connection *Connection, host string) ([]*tokenRecord, error) {
+	records, err := b.findTokens(ctx, storage, &tokenFilter{Connection: name, State: tokenStateAll})
+	if err != nil {
+		return nil, err
+	}
+
+	hostRecords := records[:0]
+	for _, record := range records {
+		if record.Entry.deviceHost(connection) == host {
+			hostRecords = append(hostRecords, record)
+		}
+	}
+	return hostRecords, nil
+}
+
+// scheduledReconcile reconciles every connection when the configured interval has elapsed
+func (b *f5TokenBackend) scheduledReconcile(ctx context.Context, storage logical.Storage) error {
+	// Only the node that owns storage may rewrite it
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	config, err := b.getMountConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if config.ReconcileInterval <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	b.lock.Lock()
+	due := now.Sub(b.lastReconcile) >= time.Duration(config.ReconcileInterval)*time.Second
+	if due {
+		b.lastReconcile = now
+	}
+	b.lock.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	names, err := storage.List(ctx, "config/connection/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err := b.reconcileConnection(ctx, storage, name, config.ReconcileRevokeUnknown); err != nil && !errors.Is(err, errNoTokenStore) {
+			b.Backend.Logger().Error("scheduled reconcile failed", "name", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// maskToken returns a short, non-usable prefix of a token for display
+func maskToken(token string) string {
+	if len(token) <= 6 {
+		return "***"
+	}
+	return token[:6] + "***"
+}
+
+// ownsToken reports whether a device token belongs to one of the connection's users
+func (c *Connection) ownsToken(item *api.TokenItem) bool {
+	owner := item.Owner()
+	return owner == c.Username || (c.SecondaryUsername != "" && owner == c.SecondaryUsername)
+}
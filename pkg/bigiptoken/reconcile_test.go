@@ -0,0 +1,131 @@
+package bigiptoken
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// A token Vault issues while the device is being listed, and a probe token
+// another node has just created, must never be revoked as unknown
+func TestReconcileSparesTokensIssuedDuringTheRun(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, nil)
+
+	issued := testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil).Data["token"].(string)
+	leftover := device.inject("admin", time.Now().Add(-time.Hour))
+	probe := device.inject("admin", time.Now())
+
+	var concurrent string
+	device.onListTokens = func() {
+		device.onListTokens = nil
+		concurrent = testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil).Data["token"].(string)
+	}
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "reconcile/lb1", map[string]interface{}{
+		"revoke_unknown": true,
+	})
+
+	if matched := resp.Data["matched"]; matched != 2 {
+		t.Errorf("expected the issued and concurrent tokens to match, got %v", matched)
+	}
+	if revoked := resp.Data["revoked_unknown"]; revoked != 1 {
+		t.Errorf("expected only the leftover token to be revoked, got %v", revoked)
+	}
+
+	unknown := resp.Data["unknown"].([]map[string]string)
+	if len(unknown) != 2 {
+		t.Fatalf("expected the leftover and probe tokens to be reported, got %v", unknown)
+	}
+	for _, entry := range unknown {
+		recent := entry["token_hint"] == maskToken(probe)
+		if (entry["recent"] == "true") != recent {
+			t.Errorf("unexpected recent flag on %v", entry)
+		}
+	}
+
+	for token, want := range map[string]bool{issued: true, concurrent: true, probe: true, leftover: false} {
+		if device.holds(token) != want {
+			t.Errorf("token %s held = %v, want %v", token, !want, want)
+		}
+	}
+}
+
+func TestReconcileDrift(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, nil)
+	ctx := context.Background()
+
+	issue := func() (string, string) {
+		data := testRequest(t, b, storage, logical.UpdateOperation, "token/lb1", nil).Data
+		return data["token_id"].(string), data["token"].(string)
+	}
+	matchedID, _ := issue()
+	missingID, missingToken := issue()
+	staleID, staleToken := issue()
+
+	// The device drops one token, and Vault has revoked another the device still holds
+	device.mu.Lock()
+	delete(device.tokens, missingToken)
+	device.mu.Unlock()
+
+	stale, err := b.getTokenEntry(ctx, storage, "lb1", staleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.IsActive = false
+	if err := b.putTokenEntry(ctx, storage, staleID, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// And the device has moved the expiry of the matched token
+	matched, err := b.getTokenEntry(ctx, storage, "lb1", matchedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := matched.ExpiresAt
+	device.mu.Lock()
+	for _, held := range device.tokens {
+		if held.user == "admin" {
+			held.expirationMicros += (5 * time.Minute).Microseconds()
+		}
+	}
+	device.mu.Unlock()
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "reconcile/lb1", map[string]interface{}{
+		"revoke_unknown": true,
+	})
+
+	if got := resp.Data["missing"].([]string); len(got) != 1 || got[0] != missingID {
+		t.Errorf("missing = %v, want [%s]", got, missingID)
+	}
+	if got := resp.Data["stale"].([]string); len(got) != 1 || got[0] != staleID {
+		t.Errorf("stale = %v, want [%s]", got, staleID)
+	}
+	if device.holds(staleToken) {
+		t.Error("expected the stale token to be revoked on the device")
+	}
+	if _, ok := resp.Data["corrected"].(map[string]interface{})[matchedID]; !ok {
+		t.Errorf("expected the expiry of %s to be corrected, got %v", matchedID, resp.Data["corrected"])
+	}
+
+	missing, err := b.getTokenEntry(ctx, storage, "lb1", missingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing.IsActive {
+		t.Error("expected the missing token to be marked inactive")
+	}
+
+	matched, err = b.getTokenEntry(ctx, storage, "lb1", matchedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := before.Add(5 * time.Minute); matched.ExpiresAt.Sub(want).Abs() > time.Second {
+		t.Errorf("expires_at = %s, want %s", matched.ExpiresAt, want)
+	}
+}
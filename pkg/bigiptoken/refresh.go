@@ -0,0 +1,129 @@
+package bigiptoken
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// pathTokenRefresh defines the path for refreshing an issued token
+func pathTokenRefresh(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tokens/" + framework.GenericNameRegex("connection") + "/" + framework.GenericNameRegex("token_id") + "/refresh",
+		Fields: map[string]*framework.FieldSchema{
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 connection the token was issued through",
+				Required:    true,
+			},
+			"token_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the token to refresh",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "New TTL for the token (in seconds); defaults to the TTL it was issued with",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathTokenRefreshWrite,
+			},
+		},
+
+		HelpSynopsis:    "Refresh an issued F5 token",
+		HelpDescription: "This endpoint extends the lifetime of an active token on the device that issued it. BIG-IP and BIG-IQ keep the same token with a new timeout; F5OS and BIG-IP Next Central Manager return a refreshed token, which replaces the stored one.",
+	}
+}
+
+// pathTokenRefreshWrite handles tokens/<connection>/<token_id>/refresh write operations
+func (b *f5TokenBackend) pathTokenRefreshWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("connection").(string)
+	tokenID := data.Get("token_id").(string)
+
+	tokenEntry, err := b.getTokenEntry(ctx, req.Storage, name, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if tokenEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("token %s not found", tokenID)), nil
+	}
+
+	now := time.Now()
+	if !tokenEntry.IsActive || !now.Before(tokenEntry.ExpiresAt) {
+		return logical.ErrorResponse(fmt.Sprintf("token %s is no longer active", tokenID)), nil
+	}
+
+	connection, err := b.requireConnection(ctx, req.Storage, name)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error getting connection: %s", err)), nil
+	}
+
+	ttl := int64(data.Get("ttl").(int))
+	if ttl <= 0 {
+		ttl = int64(tokenEntry.ExpiresAt.Sub(tokenEntry.CreatedAt) / time.Second)
+	}
+
+	tokenResp, err := b.refreshTokenEntry(ctx, req.Storage, connection, tokenID, tokenEntry, ttl)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error refreshing token: %s", err)), nil
+	}
+	host := tokenEntry.deviceHost(connection)
+
+	b.Backend.Logger().Info("refreshed token", "name", name, "token_id", tokenID, "host", host, "ttl", ttl)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"token_id":    tokenID,
+			"token":       tokenEntry.Token,
+			"host":        name,
+			"expires_at":  tokenEntry.ExpiresAt.Format(time.RFC3339),
+			"ttl":         tokenResp.Token.Timeout,
+			"device_host": host,
+		},
+	}, nil
+}
+
+// refreshTokenEntry refreshes a token on the unit that issued it and stores
+// the refreshed token and expiry. Where the platform issued a refresh token
+// it is used, and replaced by the new one.
+func (b *f5TokenBackend) refreshTokenEntry(ctx context.Context, storage logical.Storage, connection *Connection, tokenID string, tokenEntry *TokenEntry, ttl int64) (*api.TokenResponse, error) {
+	token := tokenEntry.Token
+	if tokenEntry.RefreshToken != "" {
+		token = tokenEntry.RefreshToken
+	}
+
+	now := time.Now()
+	tokenResp, err := newClientForHost(connection, tokenEntry.deviceHost(connection)).RefreshToken(token, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, _, ok := deviceExpiry(tokenResp, now)
+	if !ok {
+		timeout := ttl
+		if tokenResp.Token.Timeout > 0 && (timeout <= 0 || tokenResp.Token.Timeout < timeout) {
+			timeout = tokenResp.Token.Timeout
+		}
+		expiresAt = now.Add(time.Duration(timeout) * time.Second)
+	}
+
+	tokenEntry.Token = tokenResp.Token.Token
+	tokenEntry.ExpiresAt = expiresAt
+	tokenEntry.ExpirationMicros = tokenResp.Token.ExpirationMicros
+	tokenEntry.LastUpdateMicros = tokenResp.Token.LastUpdateMicros
+	if tokenResp.RefreshToken != "" {
+		tokenEntry.RefreshToken = tokenResp.RefreshToken
+	}
+	if err := b.putTokenEntry(ctx, storage, tokenID, tokenEntry); err != nil {
+		return nil, err
+	}
+
+	return tokenResp, nil
+}
@@ -0,0 +1,201 @@
+package bigiptoken
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathRevokeAll defines the break-glass path for revoking every token issued through a connection
+func pathRevokeAll(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "revoke-all/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP or XC connection whose tokens and credentials should be revoked",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRevokeAllWrite,
+			},
+		},
+
+		HelpSynopsis:    "Revoke every outstanding token for an F5 BIG-IP connection",
+		HelpDescription: "This endpoint immediately revokes all outstanding tokens issued through the named connection, and all outstanding API credentials issued through the XC connection of that name. Use it when a device is suspected to be compromised.",
+	}
+}
+
+// pathRevokeEntity defines the path for revoking every token requested by a Vault entity
+func pathRevokeEntity(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "revoke-entity/" + framework.GenericNameRegex("entity_id"),
+		Fields: map[string]*framework.FieldSchema{
+			"entity_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the Vault entity whose tokens should be revoked",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRevokeEntityWrite,
+			},
+		},
+
+		HelpSynopsis:    "Revoke every outstanding token requested by a Vault entity",
+		HelpDescription: "This endpoint revokes all outstanding tokens and XC API credentials requested by the given Vault entity, across all connections.",
+	}
+}
+
+// pathRevokeAllWrite handles revoke-all/ write operations
+func (b *f5TokenBackend) pathRevokeAllWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("connection name cannot be empty"), nil
+	}
+
+	connection, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	xcConnection, err := b.getXCConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil && xcConnection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", name)), nil
+	}
+
+	var records []*tokenRecord
+	if connection != nil {
+		records, err = b.findTokens(ctx, req.Storage, &tokenFilter{Connection: name, State: tokenStateAll})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var credentials []*xcCredentialEntry
+	if xcConnection != nil {
+		credentials, err = b.outstandingXCCredentials(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.Backend.Logger().Warn("revoking all outstanding tokens for connection", "name", name)
+
+	resp, err := b.revokeRecords(ctx, req.Storage, records, credentials)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["name"] = name
+
+	return resp, nil
+}
+
+// pathRevokeEntityWrite handles revoke-entity/ write operations
+func (b *f5TokenBackend) pathRevokeEntityWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entityID := data.Get("entity_id").(string)
+	if entityID == "" {
+		return logical.ErrorResponse("entity_id cannot be empty"), nil
+	}
+
+	records, err := b.findTokens(ctx, req.Storage, &tokenFilter{EntityID: entityID, State: tokenStateAll})
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := b.findXCCredentials(ctx, req.Storage, "", func(credential *xcCredentialEntry) bool {
+		return credential.IsActive && credential.EntityID == entityID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.Backend.Logger().Info("revoking all outstanding tokens for entity", "entity_id", entityID)
+
+	resp, err := b.revokeRecords(ctx, req.Storage, records, credentials)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["entity_id"] = entityID
+
+	return resp, nil
+}
+
+// revokeRecords revokes every outstanding token in records on its F5 BIG-IP
+// and every credential in credentials on its XC tenant, and reports which
+// ones were revoked and which failed. Credentials are reported by name.
+func (b *f5TokenBackend) revokeRecords(ctx context.Context, storage logical.Storage, records []*tokenRecord, credentials []*xcCredentialEntry) (*logical.Response, error) {
+	now := time.Now()
+	connections := make(map[string]*Connection)
+	revoked := []string{}
+	failed := map[string]interface{}{}
+
+	for _, record := range records {
+		tokenEntry := record.Entry
+		if !tokenEntry.IsActive {
+			continue
+		}
+
+		connection, ok := connections[tokenEntry.Host]
+		if !ok {
+			var err error
+			connection, err = b.requireConnection(ctx, storage, tokenEntry.Host)
+			if err != nil {
+				failed[record.ID] = err.Error()
+				continue
+			}
+			connections[tokenEntry.Host] = connection
+		}
+
+		if err := b.revokeTokenEntry(ctx, storage, connection, record.ID, tokenEntry); err != nil {
+			// The device rejects revocation of tokens it has already timed
+			// out, but a dynamic user must still be deleted and a refresh
+			// token outlives its access token
+			if now.After(tokenEntry.ExpiresAt) && !tokenEntry.DynamicUser && tokenEntry.RefreshToken == "" {
+				tokenEntry.IsActive = false
+				if err := b.putTokenEntry(ctx, storage, record.ID, tokenEntry); err != nil {
+					return nil, err
+				}
+				revoked = append(revoked, record.ID)
+				continue
+			}
+
+			b.Backend.Logger().Error("failed to revoke token", "token_id", record.ID, "error", err)
+			failed[record.ID] = err.Error()
+			continue
+		}
+
+		revoked = append(revoked, record.ID)
+	}
+
+	xcRevoked, xcFailed, err := b.revokeXCRecords(ctx, storage, credentials)
+	if err != nil {
+		return nil, err
+	}
+	revoked = append(revoked, xcRevoked...)
+	for name, err := range xcFailed {
+		failed[name] = err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"revoked": revoked,
+			"failed":  failed,
+		},
+	}
+	if len(failed) > 0 {
+		resp.AddWarning(fmt.Sprintf("%d token(s) or credential(s) could not be revoked; retry or rotate the connection credentials", len(failed)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,615 @@
+package bigiptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// roleStoragePrefix is where roles are stored
+const roleStoragePrefix = "roles/"
+
+// serviceUserAdminTTL is the timeout, in seconds, of the administrative
+// token used to maintain a role's service user
+const serviceUserAdminTTL = 300
+
+// bigipUsernameMaxLength is the longest username BIG-IP accepts
+const bigipUsernameMaxLength = 32
+
+// bigipUsernameRegex matches valid names for local BIG-IP users
+var bigipUsernameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*$`)
+
+// maxDisplayNameLength is the display name length a username_template is
+// checked against when a role is written
+const maxDisplayNameLength = 256
+
+// reservedUsernames are built-in BIG-IP accounts a role may never manage
+var reservedUsernames = []string{"admin", "root"}
+
+// allPartitionsRoles are BIG-IP roles that can only be granted on all partitions
+var allPartitionsRoles = []string{"admin", "resource-admin", "auditor"}
+
+// tokenRole maps Vault requests to a BIG-IP role and partition access. Tokens
+// issued for a role belong to a service user the plugin manages on the
+// role's connection, with exactly those rights.
+type tokenRole struct {
+	Connection string   `json:"connection"`
+	BIGIPRole  string   `json:"bigip_role"`
+	Partitions []string `json:"partitions,omitempty"`
+
+	// ServiceUser is the local BIG-IP user the role's tokens are issued for,
+	// unless UsernameTemplate is set, in which case every token gets a
+	// dynamic user of its own, named from the template
+	ServiceUser      string `json:"service_user,omitempty"`
+	UsernameTemplate string `json:"username_template,omitempty"`
+
+	// TTL is the default and MaxTTL the longest token TTL, in seconds;
+	// zero values fall back to the issuance default and the platform limit
+	TTL    int64 `json:"ttl,omitempty"`
+	MaxTTL int64 `json:"max_ttl,omitempty"`
+}
+
+// pathRole defines the path for role configuration
+func pathRole(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Unique name for the role",
+				Required:    true,
+			},
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection the role issues tokens on",
+				Required:    true,
+			},
+			"bigip_role": {
+				Type:        framework.TypeString,
+				Description: "BIG-IP role granted to the service user, e.g. guest, operator, manager or certificate-manager",
+				Required:    true,
+			},
+			"partitions": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Partitions the BIG-IP role is granted on; empty grants it on all partitions",
+			},
+			"service_user": {
+				Type:        framework.TypeString,
+				Description: "Local BIG-IP user the role's tokens are issued for (defaults to vault- and the role name)",
+			},
+			"username_template": {
+				Type:        framework.TypeString,
+				Description: "Template naming a dynamic BIG-IP user created for each token, e.g. {{ printf \"v-%s-%s\" (.DisplayName | truncate 12) (random 8) }}; replaces service_user",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Default TTL for the role's tokens (in seconds)",
+			},
+			"max_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum TTL for the role's tokens (in seconds); defaults to the platform maximum",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleWrite,
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathRoleWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathRoleDelete,
+			},
+		},
+
+		ExistenceCheck: b.roleExistenceCheck,
+
+		HelpSynopsis:    "Configure a role issuing least-privilege F5 BIG-IP tokens",
+		HelpDescription: "This endpoint configures a role that maps to a BIG-IP role and partition access. Tokens for the role are issued for a service user the plugin creates and maintains with exactly those rights, instead of for the connection's administrative user.",
+	}
+}
+
+// pathRoleList defines the path for listing roles
+func pathRoleList(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathRoleList,
+			},
+		},
+
+		HelpSynopsis:    "List all configured roles",
+		HelpDescription: "This endpoint lists all configured roles by name.",
+	}
+}
+
+// pathRoleToken defines the path for issuing tokens for a role
+func pathRoleToken(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "role-token/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the role to use",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "TTL for the token (in seconds); defaults to the role's TTL",
+			},
+			"purpose": {
+				Type:        framework.TypeString,
+				Description: "Free-form reason the token is being requested, recorded with the token",
+			},
+			"ticket": {
+				Type:        framework.TypeString,
+				Description: "Change or incident ticket reference, recorded with the token",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleTokenWrite,
+			},
+		},
+
+		HelpSynopsis:    "Generate a least-privilege F5 BIG-IP token for a role",
+		HelpDescription: "This endpoint brings the role's service user in line with the role, then issues a token for that user rather than for the connection's administrative user.",
+	}
+}
+
+// roleExistenceCheck checks if a role exists
+func (b *f5TokenBackend) roleExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	role, err := b.getRole(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return role != nil, nil
+}
+
+// pathRoleRead handles roles/ read operations
+func (b *f5TokenBackend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	role, err := b.getRole(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"connection":        role.Connection,
+			"bigip_role":        role.BIGIPRole,
+			"partitions":        nonNilSlice(role.Partitions),
+			"service_user":      role.ServiceUser,
+			"username_template": role.UsernameTemplate,
+			"ttl":               role.TTL,
+			"max_ttl":           role.MaxTTL,
+		},
+	}, nil
+}
+
+// pathRoleWrite handles roles/ write operations
+func (b *f5TokenBackend) pathRoleWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("role name cannot be empty"), nil
+	}
+
+	role := &tokenRole{
+		Connection:       data.Get("connection").(string),
+		BIGIPRole:        data.Get("bigip_role").(string),
+		Partitions:       data.Get("partitions").([]string),
+		ServiceUser:      data.Get("service_user").(string),
+		UsernameTemplate: data.Get("username_template").(string),
+		TTL:              int64(data.Get("ttl").(int)),
+		MaxTTL:           int64(data.Get("max_ttl").(int)),
+	}
+	switch {
+	case role.UsernameTemplate != "" && role.ServiceUser != "":
+		return logical.ErrorResponse("service_user and username_template are mutually exclusive"), nil
+	case role.UsernameTemplate != "":
+		// Check against the longest display name an auth method may set, so
+		// that a role saved here cannot fail at issuance for a real user
+		if _, err := renderUsername(role.UsernameTemplate, usernameTemplateData{
+			DisplayName: strings.Repeat("d", maxDisplayNameLength),
+			RoleName:    name,
+			EntityID:    "00000000-0000-0000-0000-000000000000",
+		}); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid username_template: %s", err)), nil
+		}
+	case role.ServiceUser == "":
+		role.ServiceUser = defaultServiceUser(name)
+	}
+
+	if role.Connection == "" || role.BIGIPRole == "" {
+		return logical.ErrorResponse("connection and bigip_role are required"), nil
+	}
+
+	connection, err := b.getConnection(ctx, req.Storage, role.Connection)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", role.Connection)), nil
+	}
+
+	if err := role.validate(connection); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// Two roles maintaining the same user would keep overwriting its rights
+	names, err := req.Storage.List(ctx, roleStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+		otherRole, err := b.getRole(ctx, req.Storage, other)
+		if err != nil {
+			return nil, err
+		}
+		if role.ServiceUser != "" && otherRole != nil && otherRole.Connection == role.Connection && otherRole.ServiceUser == role.ServiceUser {
+			return logical.ErrorResponse(fmt.Sprintf("service user %s on connection %s is already managed by role %s", role.ServiceUser, role.Connection, other)), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(roleStoragePrefix+name, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathRoleDelete handles roles/ delete operations. The service user and the
+// tokens already issued for it are left on the device.
+func (b *f5TokenBackend) pathRoleDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, roleStoragePrefix+data.Get("name").(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// pathRoleList handles roles/ list operations
+func (b *f5TokenBackend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, roleStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(roles), nil
+}
+
+// pathRoleTokenWrite handles role-token/ write operations
+func (b *f5TokenBackend) pathRoleTokenWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return b.roleTokenResponse(ctx, req, data.Get("name").(string), "", int64(data.Get("ttl").(int)), data.Get("purpose").(string), data.Get("ticket").(string))
+}
+
+// roleTokenResponse issues a token for the named role and builds the
+// response shared by role-token/<role> and token/<connection> with a role.
+// A non-empty connection must be the role's connection; a ttl of zero
+// falls back to the role's TTL.
+func (b *f5TokenBackend) roleTokenResponse(ctx context.Context, req *logical.Request, name, connection string, ttl int64, purpose, ticket string) (*logical.Response, error) {
+	role, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role %s not found", name)), nil
+	}
+	if connection != "" && connection != role.Connection {
+		return logical.ErrorResponse(fmt.Sprintf("role %s issues tokens on connection %s, not %s", name, role.Connection, connection)), nil
+	}
+
+	if ttl <= 0 {
+		ttl = role.TTL
+	}
+	if ttl <= 0 {
+		ttl = 3600
+	}
+	if role.MaxTTL > 0 && ttl > role.MaxTTL {
+		return logical.ErrorResponse(fmt.Sprintf("ttl %d exceeds the role's max_ttl of %d seconds", ttl, role.MaxTTL)), nil
+	}
+
+	template := requestTokenEntry(req, purpose, ticket)
+	template.Role = name
+
+	issued, err := b.issueRoleToken(ctx, req.Storage, role, int(ttl), template)
+	if err != nil {
+		var coded logical.HTTPCodedError
+		if errors.As(err, &coded) {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+	tokenEntry := issued.Entry
+
+	b.Backend.Logger().Info("issued role token", "role", name, "name", role.Connection, "username", tokenEntry.Username, "token_id", issued.ID)
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"token_id":    issued.ID,
+			"token":       tokenEntry.Token,
+			"host":        role.Connection,
+			"expires_at":  tokenEntry.ExpiresAt.Format(time.RFC3339),
+			"ttl":         issued.Timeout,
+			"device_host": tokenEntry.DeviceHost,
+			"role":        name,
+			"username":    tokenEntry.Username,
+		},
+	}
+	if tokenEntry.Purpose != "" {
+		resp.Data["purpose"] = tokenEntry.Purpose
+	}
+	if tokenEntry.Ticket != "" {
+		resp.Data["ticket"] = tokenEntry.Ticket
+	}
+
+	return resp, nil
+}
+
+// issueRoleToken brings the role's service user in line with the role and
+// issues a token for it. The connection's own credentials are only used for
+// a short-lived administrative token that maintains the user. Failures the
+// caller should see are returned as coded errors.
+func (b *f5TokenBackend) issueRoleToken(ctx context.Context, storage logical.Storage, role *tokenRole, ttl int, template TokenEntry) (*issuedToken, error) {
+	name := role.Connection
+	tokenID, err := newTokenID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := b.requireConnection(ctx, storage, name)
+	if err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error getting connection: %s", err))
+	}
+	if connection.platform() != api.PlatformBIGIP {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("roles require a %s connection, not %s", api.PlatformBIGIP, connection.platform()))
+	}
+
+	if err := b.checkIssuanceHealth(ctx, storage, name); err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, err.Error())
+	}
+
+	if limit := api.MaxTokenTimeout(connection.platform()); int64(ttl) > limit {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("ttl %d exceeds the %s maximum of %d seconds", ttl, connection.platform(), limit))
+	}
+
+	username := role.ServiceUser
+	dynamic := role.UsernameTemplate != ""
+	if dynamic {
+		username, err = renderUsername(role.UsernameTemplate, usernameTemplateData{
+			DisplayName: template.DisplayName,
+			RoleName:    template.Role,
+			EntityID:    template.EntityID,
+		})
+		if err != nil {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error rendering username_template: %s", err))
+		}
+		if username == connection.Username || username == connection.SecondaryUsername {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("username %s is one of the connection's own users", username))
+		}
+		template.DynamicUser = true
+	}
+
+	// Rotating the password and logging in must not interleave with
+	// another issuance for the same user
+	unlock := b.lockServiceUser(name, username)
+	defer unlock()
+
+	admin, err := b.login(name, connection, serviceUserAdminTTL)
+	if err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error logging in to maintain service user: %s", err))
+	}
+	defer b.discardLogin(name, admin)
+
+	adminClient, ok := admin.Client.(*api.Client)
+	if !ok {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("connection %s cannot manage users", name))
+	}
+
+	// A fresh password on every issuance means it never needs storing;
+	// tokens already issued for the user stay valid
+	password, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &api.ManagedUser{
+		Name:            username,
+		Password:        password,
+		Description:     fmt.Sprintf("%s (%s)", api.ManagedUserDescription, template.Role),
+		Shell:           "none",
+		PartitionAccess: role.partitionAccess(),
+	}
+
+	// Dynamic users are created for this token alone and never take over
+	// an existing account; the shared service user is kept up to date as
+	// long as it carries the plugin's description
+	if dynamic {
+		user.Description = fmt.Sprintf("%s (%s) for %s", api.ManagedUserDescription, template.Role, template.DisplayName)
+		if err := adminClient.CreateUser(admin.Response.Token.Token, user); err != nil {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error creating dynamic user: %s", err))
+		}
+		b.Backend.Logger().Info("created dynamic user", "name", name, "username", username, "bigip_role", role.BIGIPRole)
+	} else {
+		created, err := adminClient.EnsureUser(admin.Response.Token.Token, user)
+		if err != nil {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error maintaining service user: %s", err))
+		}
+		if created {
+			b.Backend.Logger().Info("created service user", "name", name, "username", username, "bigip_role", role.BIGIPRole)
+		}
+	}
+
+	// Log in as the service user on the unit that holds its new password.
+	// Service users are always local, whatever provider the connection uses.
+	service := *connection
+	service.Username = username
+	service.Password = password
+	service.SecondaryUsername = ""
+	service.SecondaryPassword = ""
+	service.LoginProvider = ""
+
+	client := newClientForHost(&service, admin.Host)
+	tokenResp, err := client.GetTokenWithCredential(api.CredentialPrimary, int64(ttl))
+	if err == nil {
+		var issued *issuedToken
+		issued, err = b.recordToken(ctx, storage, tokenID, name, ttl, template, &deviceLogin{
+			Host:     admin.Host,
+			Client:   client,
+			Response: tokenResp,
+		})
+		if err == nil {
+			return issued, nil
+		}
+	}
+
+	// Don't leave a dynamic user behind that no token will clean up
+	if dynamic {
+		if deleteErr := adminClient.DeleteUser(admin.Response.Token.Token, username); deleteErr != nil {
+			b.Backend.Logger().Error("failed to roll back dynamic user", "name", name, "username", username, "error", deleteErr)
+		}
+	}
+
+	if tokenResp == nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("error generating token for user %s: %s", username, err))
+	}
+	return nil, err
+}
+
+// validate checks a role against the connection it issues tokens on
+func (r *tokenRole) validate(connection *Connection) error {
+	if connection.platform() != api.PlatformBIGIP {
+		return fmt.Errorf("roles require a %s connection, not %s", api.PlatformBIGIP, connection.platform())
+	}
+	if !slices.Contains(api.UserRoles, r.BIGIPRole) {
+		return fmt.Errorf("bigip_role must be one of %s", strings.Join(api.UserRoles, ", "))
+	}
+	if len(r.Partitions) > 0 && slices.Contains(allPartitionsRoles, r.BIGIPRole) {
+		return fmt.Errorf("bigip_role %s can only be granted on all partitions", r.BIGIPRole)
+	}
+	for _, partition := range r.Partitions {
+		if partition == "" || strings.ContainsAny(partition, "/ ") {
+			return fmt.Errorf("partition %q is not a valid partition name", partition)
+		}
+	}
+
+	if r.UsernameTemplate == "" {
+		if err := validateServiceUser(r.ServiceUser); err != nil {
+			return err
+		}
+		// The administrative user's password must never be rotated by a role
+		if r.ServiceUser == connection.Username || r.ServiceUser == connection.SecondaryUsername {
+			return fmt.Errorf("service_user %s is one of the connection's own users", r.ServiceUser)
+		}
+	}
+
+	if r.TTL < 0 || r.MaxTTL < 0 {
+		return fmt.Errorf("ttl and max_ttl cannot be negative")
+	}
+	limit := api.MaxTokenTimeout(connection.platform())
+	if r.MaxTTL > limit {
+		return fmt.Errorf("max_ttl %d exceeds the %s maximum of %d seconds", r.MaxTTL, connection.platform(), limit)
+	}
+	if r.MaxTTL > 0 && r.TTL > r.MaxTTL {
+		return fmt.Errorf("ttl cannot exceed max_ttl")
+	}
+
+	return nil
+}
+
+// partitionAccess returns the partition access granted to the service user
+func (r *tokenRole) partitionAccess() []api.PartitionAccess {
+	if len(r.Partitions) == 0 {
+		return []api.PartitionAccess{{Name: api.AllPartitions, Role: r.BIGIPRole}}
+	}
+
+	access := make([]api.PartitionAccess, 0, len(r.Partitions))
+	for _, partition := range r.Partitions {
+		access = append(access, api.PartitionAccess{Name: partition, Role: r.BIGIPRole})
+	}
+	return access
+}
+
+// validateServiceUser checks that a username is valid for a local BIG-IP user
+// the plugin may manage
+func validateServiceUser(username string) error {
+	if len(username) > bigipUsernameMaxLength {
+		return fmt.Errorf("service_user %s is longer than %d characters", username, bigipUsernameMaxLength)
+	}
+	if !bigipUsernameRegex.MatchString(username) {
+		return fmt.Errorf("service_user %q must start with a lowercase letter or '_' and contain only lowercase letters, digits, '_', '-' and '.'", username)
+	}
+	if slices.Contains(reservedUsernames, username) {
+		return fmt.Errorf("service_user %s is a built-in BIG-IP account", username)
+	}
+	return nil
+}
+
+// defaultServiceUser returns the service user name for a role without one
+func defaultServiceUser(role string) string {
+	username := "vault-" + strings.ToLower(invalidNameChars.ReplaceAllString(role, "-"))
+	if len(username) > bigipUsernameMaxLength {
+		username = username[:bigipUsernameMaxLength]
+	}
+	return username
+}
+
+// lockServiceUser serialises issuance for one service user on this node and
+// returns the function that releases it
+func (b *f5TokenBackend) lockServiceUser(name, username string) func() {
+	key := name + "/" + username
+
+	b.lock.Lock()
+	mu, ok := b.serviceUsers[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		b.serviceUsers[key] = mu
+	}
+	b.lock.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// getRole loads a named role, returning nil if it does not exist
+func (b *f5TokenBackend) getRole(ctx context.Context, storage logical.Storage, name string) (*tokenRole, error) {
+	entry, err := storage.Get(ctx, roleStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var role tokenRole
+	if err := entry.DecodeJSON(&role); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
@@ -0,0 +1,165 @@
+package bigiptoken
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+func TestRoleValidation(t *testing.T) {
+	b, storage := testBackend(t)
+	for name, extra := range map[string]map[string]interface{}{
+		"lb1": {"secondary_username": "backup", "secondary_password": "secret"},
+		"r5k": {"platform": "f5os"},
+	} {
+		data := map[string]interface{}{
+			"host":              "192.0.2.1",
+			"username":          "admin",
+			"password":          "password",
+			"verify_connection": false,
+		}
+		for key, value := range extra {
+			data[key] = value
+		}
+		testRequest(t, b, storage, logical.UpdateOperation, "config/connection/"+name, data)
+	}
+	testRequest(t, b, storage, logical.UpdateOperation, "roles/existing", map[string]interface{}{
+		"connection":   "lb1",
+		"bigip_role":   "guest",
+		"service_user": "vault-shared",
+	})
+
+	tests := []struct {
+		name    string
+		role    string
+		data    map[string]interface{}
+		wantErr string
+	}{
+		{"missing bigip_role", "ops", map[string]interface{}{}, "connection and bigip_role are required"},
+		{"unknown bigip_role", "ops", map[string]interface{}{"bigip_role": "superuser"}, "bigip_role must be one of"},
+		{"all-partitions role on a partition", "ops", map[string]interface{}{"bigip_role": "admin", "partitions": "Common"}, "can only be granted on all partitions"},
+		{"invalid partition", "ops", map[string]interface{}{"bigip_role": "operator", "partitions": "Common/app"}, "not a valid partition name"},
+		{"built-in account", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": "root"}, "built-in BIG-IP account"},
+		{"connection's own user", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": "backup"}, "one of the connection's own users"},
+		{"invalid service user", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": "Ops User"}, "must start with a lowercase letter"},
+		{"long service user", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": strings.Repeat("a", 33)}, "longer than 32 characters"},
+		{"template and service user", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": "ops", "username_template": "v-{{random 8}}"}, "mutually exclusive"},
+		{"ttl over max_ttl", "ops", map[string]interface{}{"bigip_role": "guest", "ttl": 600, "max_ttl": 300}, "ttl cannot exceed max_ttl"},
+		{"max_ttl over platform limit", "ops", map[string]interface{}{"bigip_role": "guest", "max_ttl": 1000000}, "exceeds the bigip maximum"},
+		{"shared service user", "ops", map[string]interface{}{"bigip_role": "guest", "service_user": "vault-shared"}, "already managed by role existing"},
+		{"missing connection", "ops", map[string]interface{}{"connection": "lb9", "bigip_role": "guest"}, "connection lb9 not found"},
+		{"platform without users", "ops", map[string]interface{}{"connection": "r5k", "bigip_role": "guest"}, "roles require a bigip connection"},
+		{"rewriting the same role", "existing", map[string]interface{}{"bigip_role": "operator", "service_user": "vault-shared"}, ""},
+		{"default service user", "Ops.Team", map[string]interface{}{"bigip_role": "guest"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]interface{}{"connection": "lb1"}
+			for key, value := range tt.data {
+				data[key] = value
+			}
+
+			if tt.wantErr != "" {
+				if msg := testRequestError(t, b, storage, logical.UpdateOperation, "roles/"+tt.role, data); !strings.Contains(msg, tt.wantErr) {
+					t.Fatalf("unexpected error: %s", msg)
+				}
+				return
+			}
+			testRequest(t, b, storage, logical.UpdateOperation, "roles/"+tt.role, data)
+		})
+	}
+
+	resp := testRequest(t, b, storage, logical.ReadOperation, "roles/Ops.Team", nil)
+	if user := resp.Data["service_user"]; user != "vault-ops.team" {
+		t.Errorf("service_user = %v, want vault-ops.team", user)
+	}
+}
+
+func TestRoleServiceUserMaintenance(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, nil)
+
+	testRequest(t, b, storage, logical.UpdateOperation, "roles/ops", map[string]interface{}{
+		"connection": "lb1",
+		"bigip_role": "operator",
+		"partitions": "Common,App",
+	})
+
+	first := testRequest(t, b, storage, logical.UpdateOperation, "role-token/ops", nil).Data["token"].(string)
+	password, description, access, ok := device.userState("vault-ops")
+	if !ok {
+		t.Fatal("expected the service user to be created")
+	}
+	if description != "Managed by Vault (ops)" {
+		t.Errorf("description = %q", description)
+	}
+	if want := []api.PartitionAccess{{Name: "Common", Role: "operator"}, {Name: "App", Role: "operator"}}; len(access) != 2 || access[0] != want[0] || access[1] != want[1] {
+		t.Errorf("partition access = %v, want %v", access, want)
+	}
+	if user := device.tokenUser(first); user != "vault-ops" {
+		t.Errorf("token belongs to %q, want vault-ops", user)
+	}
+
+	// Each issuance rotates the password and brings the rights in line
+	// with the role, without ending tokens already issued
+	testRequest(t, b, storage, logical.UpdateOperation, "roles/ops", map[string]interface{}{
+		"connection": "lb1",
+		"bigip_role": "guest",
+	})
+	second := testRequest(t, b, storage, logical.UpdateOperation, "role-token/ops", nil).Data["token"].(string)
+	rotated, _, access, _ := device.userState("vault-ops")
+	if rotated == password {
+		t.Error("expected the service user's password to be rotated")
+	}
+	if len(access) != 1 || access[0] != (api.PartitionAccess{Name: api.AllPartitions, Role: "guest"}) {
+		t.Errorf("partition access = %v, want guest on all partitions", access)
+	}
+	if !device.holds(first) || !device.holds(second) {
+		t.Error("expected both issued tokens to stay valid")
+	}
+
+	// A user the plugin did not create is never taken over
+	device.setPassword("legacy", "keep-me")
+	testRequest(t, b, storage, logical.UpdateOperation, "roles/legacy", map[string]interface{}{
+		"connection":   "lb1",
+		"bigip_role":   "guest",
+		"service_user": "legacy",
+	})
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "role-token/legacy", nil); !strings.Contains(msg, "not managed by Vault") {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+	if password, _, _, _ := device.userState("legacy"); password != "keep-me" {
+		t.Errorf("expected the unmanaged user's password to be left alone, got %q", password)
+	}
+}
+
+// Dynamic users are created per token and deleted with it
+func TestRoleDynamicUser(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	testConnection(t, b, storage, "lb1", srv, nil)
+
+	testRequest(t, b, storage, logical.UpdateOperation, "roles/dash", map[string]interface{}{
+		"connection":        "lb1",
+		"bigip_role":        "guest",
+		"username_template": "v-{{.RoleName}}-{{random 8}}",
+	})
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "role-token/dash", nil)
+	username := resp.Data["username"].(string)
+	if !strings.HasPrefix(username, "v-dash-") || device.tokenUser(resp.Data["token"].(string)) != username {
+		t.Fatalf("unexpected dynamic user %q", username)
+	}
+	if _, _, _, ok := device.userState(username); !ok {
+		t.Fatalf("expected dynamic user %s to be created", username)
+	}
+
+	testRequest(t, b, storage, logical.UpdateOperation, "revoke-all/lb1", nil)
+	if _, _, _, ok := device.userState(username); ok {
+		t.Errorf("expected dynamic user %s to be deleted with its token", username)
+	}
+}
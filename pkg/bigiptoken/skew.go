@@ -0,0 +1,55 @@
+package bigiptoken
+
+import (
+	"time"
+
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// clockSkew is the most recent clock offset observed between Vault and a device.
+// A positive Skew means the device clock is ahead of Vault's.
+type clockSkew struct {
+	Skew       time.Duration
+	ObservedAt time.Time
+}
+
+// deviceExpiry derives a token's expiry on Vault's clock from the device's own
+// timestamps. The remaining lifetime is measured entirely on the device clock,
+// so skew between the two clocks does not distort it. ok is false when the
+// device did not report its timestamps.
+func deviceExpiry(tokenResp *api.TokenResponse, observedAt time.Time) (expiresAt time.Time, skew time.Duration, ok bool) {
+	expirationMicros := tokenResp.Token.ExpirationMicros
+	lastUpdateMicros := tokenResp.Token.LastUpdateMicros
+	if expirationMicros == 0 || lastUpdateMicros == 0 {
+		return time.Time{}, 0, false
+	}
+
+	remaining := time.Duration(expirationMicros-lastUpdateMicros) * time.Microsecond
+	skew = time.UnixMicro(lastUpdateMicros).Sub(observedAt)
+
+	return observedAt.Add(remaining), skew, true
+}
+
+// recordSkew remembers the clock skew last observed for the named connection
+func (b *f5TokenBackend) recordSkew(name string, skew time.Duration, observedAt time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.skews[name] = clockSkew{Skew: skew, ObservedAt: observedAt}
+}
+
+// skewStatus returns the last observed clock skew for display, or nil if none has been observed
+func (b *f5TokenBackend) skewStatus(name string) map[string]interface{} {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	skew, ok := b.skews[name]
+	if !ok {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"skew_seconds": skew.Skew.Seconds(),
+		"observed_at":  skew.ObservedAt.Format(time.RFC3339),
+	}
+}
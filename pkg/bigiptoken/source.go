@@ -0,0 +1,688 @@
+package bigiptoken
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// sourceStoragePrefix is where BIG-IQ device sources are stored
+const sourceStoragePrefix = "config/source/"
+
+// sourceSyncStoragePrefix is where the result of each source's last sync is stored
+const sourceSyncStoragePrefix = "source-sync/"
+
+// sourceBreakerPrefix keys the circuit breaker guarding a source's BIG-IQ
+// logins. Connection names cannot contain '/', so the keys never collide.
+const sourceBreakerPrefix = "source/"
+
+// versionOperationSync is recorded against connection versions written by a source sync
+const versionOperationSync = "sync"
+
+// Connection metadata keys maintained by a source sync. A connection is
+// owned by the source named in metadataSource and tracks one BIG-IQ device.
+const (
+	metadataSource     = "bigiq_source"
+	metadataDeviceID   = "bigiq_device_id"
+	metadataHostname   = "bigiq_hostname"
+	metadataVersion    = "bigiq_device_version"
+	metadataRemovedAt  = "bigiq_removed_at"
+	metadataDiscovered = "bigiq_discovered_at"
+)
+
+// invalidNameChars matches the characters that cannot appear in a connection name
+var invalidNameChars = regexp.MustCompile(`[^\w.-]+`)
+
+// deviceSource is a BIG-IQ that connections are discovered from, with the
+// template used for the connections it creates
+type deviceSource struct {
+	Host        string `json:"host"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	InsecureSSL bool   `json:"insecure_ssl"`
+
+	// Credentials and settings applied to every discovered BIG-IP
+	TemplateUsername    string            `json:"template_username"`
+	TemplatePassword    string            `json:"template_password"`
+	TemplateInsecureSSL bool              `json:"template_insecure_ssl"`
+	TemplateTags        map[string]string `json:"template_tags,omitempty"`
+
+	// OverwriteCredentials applies the template credentials to existing
+	// connections on every sync; otherwise they are only set on creation,
+	// so that a password patched or rolled back on a connection is kept
+	OverwriteCredentials bool `json:"overwrite_credentials"`
+
+	// ConnectionPrefix is prepended to each device hostname to form the
+	// connection name; SyncInterval (in seconds) enables periodic syncs
+	ConnectionPrefix string `json:"connection_prefix"`
+	SyncInterval     int64  `json:"sync_interval"`
+}
+
+// sourceSyncResult is the outcome of syncing one source
+type sourceSyncResult struct {
+	SyncedAt  time.Time `json:"synced_at"`
+	Devices   int       `json:"devices"`
+	Created   []string  `json:"created"`
+	Updated   []string  `json:"updated"`
+	Unchanged []string  `json:"unchanged"`
+	Restored  []string  `json:"restored"`
+	Removed   []string  `json:"removed"`
+	Conflicts []string  `json:"conflicts"`
+	Errors    []string  `json:"errors"`
+}
+
+// pathConfigSource defines the path for BIG-IQ source configuration
+func pathConfigSource(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/source/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Unique name for the BIG-IQ source",
+				Required:    true,
+			},
+			"host": {
+				Type:        framework.TypeString,
+				Description: "BIG-IQ hostname or IP address",
+				Required:    true,
+			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Username for BIG-IQ authentication",
+				Required:    true,
+			},
+			"password": {
+				Type:        framework.TypeString,
+				Description: "Password for BIG-IQ authentication",
+				Required:    true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"insecure_ssl": {
+				Type:        framework.TypeBool,
+				Description: "Allow insecure SSL connections to the BIG-IQ (not recommended)",
+				Default:     false,
+			},
+			"template_username": {
+				Type:        framework.TypeString,
+				Description: "Username for the connections created for discovered BIG-IP devices",
+				Required:    true,
+			},
+			"template_password": {
+				Type:        framework.TypeString,
+				Description: "Password for the connections created for discovered BIG-IP devices",
+				Required:    true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"template_insecure_ssl": {
+				Type:        framework.TypeBool,
+				Description: "Allow insecure SSL connections to discovered BIG-IP devices",
+				Default:     false,
+			},
+			"template_tags": {
+				Type:        framework.TypeKVPairs,
+				Description: "Tags applied to every discovered connection, as key=value pairs",
+			},
+			"overwrite_credentials": {
+				Type:        framework.TypeBool,
+				Description: "Apply the template credentials to existing connections on every sync, rather than only when a connection is created",
+				Default:     false,
+			},
+			"connection_prefix": {
+				Type:        framework.TypeString,
+				Description: "Prefix for the names of discovered connections (defaults to the source name and a dash)",
+			},
+			"sync_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often to sync the source in the background; 0 disables periodic syncs",
+				Default:     0,
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "Log in to the BIG-IQ and list its devices before saving the source",
+				Default:     true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathSourceRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathSourceWrite,
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathSourceWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathSourceDelete,
+			},
+		},
+
+		ExistenceCheck: b.sourceExistenceCheck,
+
+		HelpSynopsis:    "Configure a BIG-IQ to discover F5 BIG-IP connections from",
+		HelpDescription: "This endpoint configures a BIG-IQ whose managed BIG-IP devices are onboarded as connections, using the template credentials and tags for each device.",
+	}
+}
+
+// pathConfigSourceList defines the path for listing BIG-IQ sources
+func pathConfigSourceList(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/sources/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathSourceList,
+			},
+		},
+
+		HelpSynopsis:    "List all configured BIG-IQ sources",
+		HelpDescription: "This endpoint lists all configured BIG-IQ sources by name.",
+	}
+}
+
+// pathSourceSync defines the path for syncing connections from a BIG-IQ source
+func pathSourceSync(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/source/" + framework.GenericNameRegex("name") + "/sync",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the BIG-IQ source",
+				Required:    true,
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Report what the sync would change without saving anything",
+				Default:     false,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathSourceSyncWrite,
+			},
+		},
+
+		HelpSynopsis:    "Sync F5 BIG-IP connections from a BIG-IQ source",
+		HelpDescription: "This endpoint lists the devices managed by the BIG-IQ, creates or updates a connection for each, and flags connections whose device is no longer managed.",
+	}
+}
+
+// sourceExistenceCheck checks if a BIG-IQ source exists
+func (b *f5TokenBackend) sourceExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	source, err := b.getSource(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return source != nil, nil
+}
+
+// pathSourceRead handles config/source read operations
+func (b *f5TokenBackend) pathSourceRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	source, err := b.getSource(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, nil
+	}
+
+	// Return all but the passwords
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"host":                  source.Host,
+			"username":              source.Username,
+			"insecure_ssl":          source.InsecureSSL,
+			"template_username":     source.TemplateUsername,
+			"template_insecure_ssl": source.TemplateInsecureSSL,
+			"template_tags":         nonNilMap(source.TemplateTags),
+			"overwrite_credentials": source.OverwriteCredentials,
+			"circuit_breaker":       b.breakerState(sourceBreakerPrefix + name),
+			"connection_prefix":     source.connectionPrefix(name),
+			"sync_interval":         source.SyncInterval,
+		},
+	}
+
+	entry, err := req.Storage.Get(ctx, sourceSyncStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		var last sourceSyncResult
+		if err := entry.DecodeJSON(&last); err != nil {
+			return nil, err
+		}
+		resp.Data["last_sync"] = last.summary()
+	}
+
+	return resp, nil
+}
+
+// pathSourceWrite handles config/source write operations
+func (b *f5TokenBackend) pathSourceWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("source name cannot be empty"), nil
+	}
+
+	source := &deviceSource{
+		Host:                 data.Get("host").(string),
+		Username:             data.Get("username").(string),
+		Password:             data.Get("password").(string),
+		InsecureSSL:          data.Get("insecure_ssl").(bool),
+		TemplateUsername:     data.Get("template_username").(string),
+		TemplatePassword:     data.Get("template_password").(string),
+		TemplateInsecureSSL:  data.Get("template_insecure_ssl").(bool),
+		TemplateTags:         data.Get("template_tags").(map[string]string),
+		OverwriteCredentials: data.Get("overwrite_credentials").(bool),
+		ConnectionPrefix:     data.Get("connection_prefix").(string),
+		SyncInterval:         int64(data.Get("sync_interval").(int)),
+	}
+
+	if source.Host == "" || source.Username == "" || source.Password == "" {
+		return logical.ErrorResponse("host, username, and password are required"), nil
+	}
+	if source.TemplateUsername == "" || source.TemplatePassword == "" {
+		return logical.ErrorResponse("template_username and template_password are required"), nil
+	}
+	if err := validateHost(source.Host); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if source.SyncInterval < 0 {
+		return logical.ErrorResponse("sync_interval cannot be negative"), nil
+	}
+	if prefix := source.ConnectionPrefix; prefix != "" && invalidNameChars.MatchString(prefix) {
+		return logical.ErrorResponse(fmt.Sprintf("connection_prefix %q may only contain letters, digits, '_', '-' and '.'", prefix)), nil
+	}
+
+	b.Backend.Logger().Info("configuring source", "name", name, "host", source.Host)
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"success": true,
+			"host":    source.Host,
+		},
+	}
+
+	if data.Get("verify_connection").(bool) {
+		devices, err := source.listDevices()
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to list devices on BIG-IQ: %s", err)), nil
+		}
+		resp.Data["devices"] = len(devices)
+	}
+
+	entry, err := logical.StorageEntryJSON(sourceStoragePrefix+name, source)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	// New credentials start with a clean breaker
+	b.resetBreaker(sourceBreakerPrefix + name)
+
+	return resp, nil
+}
+
+// pathSourceDelete handles config/source delete operations. Connections
+// created by the source are left in place.
+func (b *f5TokenBackend) pathSourceDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	if err := req.Storage.Delete(ctx, sourceStoragePrefix+name); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, sourceSyncStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	delete(b.lastSourceSync, name)
+	b.lock.Unlock()
+	b.resetBreaker(sourceBreakerPrefix + name)
+
+	return nil, nil
+}
+
+// pathSourceList handles config/sources list operations
+func (b *f5TokenBackend) pathSourceList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	sources, err := req.Storage.List(ctx, sourceStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(sources), nil
+}
+
+// pathSourceSyncWrite handles config/source/<name>/sync write operations
+func (b *f5TokenBackend) pathSourceSyncWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	dryRun := data.Get("dry_run").(bool)
+
+	source, err := b.getSource(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return logical.ErrorResponse(fmt.Sprintf("source %s not found", name)), nil
+	}
+
+	result, err := b.syncSource(ctx, req, name, source, dryRun)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error syncing source %s: %s", name, err)), nil
+	}
+
+	resp := &logical.Response{Data: result.summary()}
+	resp.Data["dry_run"] = dryRun
+	if len(result.Removed) > 0 {
+		resp.AddWarning(fmt.Sprintf("%d device(s) are no longer managed by the BIG-IQ: %s", len(result.Removed), strings.Join(result.Removed, ", ")))
+	}
+	if len(result.Conflicts) > 0 {
+		resp.AddWarning(fmt.Sprintf("%d connection name(s) are already used by connections not managed by this source", len(result.Conflicts)))
+	}
+
+	return resp, nil
+}
+
+// syncSource lists the devices managed by a BIG-IQ and brings the
+// connections owned by the source in line with them. Connections whose
+// device has disappeared are flagged rather than deleted, since they may
+// still hold outstanding tokens.
+func (b *f5TokenBackend) syncSource(ctx context.Context, req *logical.Request, name string, source *deviceSource, dryRun bool) (*sourceSyncResult, error) {
+	devices, err := b.listSourceDevices(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	names, connections, err := b.findConnections(ctx, req.Storage, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections already owned by this source, by BIG-IQ device
+	owned := make(map[string]string)
+	for _, connName := range names {
+		if metadata := connections[connName].Metadata; metadata[metadataSource] == name {
+			owned[metadata[metadataDeviceID]] = connName
+		}
+	}
+
+	now := time.Now().UTC()
+	result := &sourceSyncResult{SyncedAt: now, Devices: len(devices)}
+
+	save := func(connName string, connection *Connection) error {
+		if dryRun {
+			return nil
+		}
+		_, err := b.saveConnection(ctx, req, connName, connection, versionOperationSync, 0)
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		if device.UUID == "" || device.Address == "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("device %q has no uuid or management address", device.Hostname))
+			continue
+		}
+		seen[device.UUID] = true
+
+		if connName, ok := owned[device.UUID]; ok {
+			current := connections[connName]
+			updated := source.applyDevice(name, current, device, now, source.OverwriteCredentials)
+			switch {
+			case reflect.DeepEqual(current, updated):
+				result.Unchanged = append(result.Unchanged, connName)
+				continue
+			case current.Metadata[metadataRemovedAt] != "":
+				result.Restored = append(result.Restored, connName)
+			default:
+				result.Updated = append(result.Updated, connName)
+			}
+			if err := save(connName, updated); err != nil {
+				return nil, err
+			}
+			if !dryRun && current.Host != updated.Host {
+				b.resetHosts(connName)
+			}
+			if !dryRun && (current.Username != updated.Username || current.Password != updated.Password) {
+				b.resetBreaker(connName)
+			}
+			continue
+		}
+
+		label := device.Hostname
+		if label == "" {
+			label = device.UUID
+		}
+		connName := source.connectionPrefix(name) + strings.Trim(invalidNameChars.ReplaceAllString(label, "-"), "-.")
+		if _, ok := connections[connName]; ok {
+			result.Conflicts = append(result.Conflicts, connName)
+			continue
+		}
+
+		connection := source.applyDevice(name, &Connection{
+			BreakerThreshold: defaultBreakerThreshold,
+			BreakerCooldown:  int64(defaultBreakerCooldown / time.Second),
+		}, device, now, true)
+		if err := connection.validate(); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", connName, err))
+			continue
+		}
+		if err := save(connName, connection); err != nil {
+			return nil, err
+		}
+		connections[connName] = connection
+		result.Created = append(result.Created, connName)
+	}
+
+	for deviceID, connName := range owned {
+		current := connections[connName]
+		if seen[deviceID] || current.Metadata[metadataRemovedAt] != "" {
+			continue
+		}
+
+		flagged := *current
+		flagged.Metadata = cloneMap(current.Metadata)
+		flagged.Metadata[metadataRemovedAt] = now.Format(time.RFC3339)
+		if err := save(connName, &flagged); err != nil {
+			return nil, err
+		}
+		result.Removed = append(result.Removed, connName)
+		b.Backend.Logger().Warn("device no longer managed by BIG-IQ", "source", name, "name", connName, "device_id", deviceID)
+	}
+
+	if !dryRun {
+		entry, err := logical.StorageEntryJSON(sourceSyncStoragePrefix+name, result)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Backend.Logger().Info("synced source", "name", name, "devices", result.Devices,
+		"created", len(result.Created), "updated", len(result.Updated), "removed", len(result.Removed))
+
+	return result, nil
+}
+
+// scheduledSourceSyncs syncs every source whose sync interval has elapsed
+func (b *f5TokenBackend) scheduledSourceSyncs(ctx context.Context, req *logical.Request) error {
+	// Only the node that owns storage may rewrite it
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	names, err := req.Storage.List(ctx, sourceStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		source, err := b.getSource(ctx, req.Storage, name)
+		if err != nil || source == nil || source.SyncInterval <= 0 {
+			continue
+		}
+
+		b.lock.Lock()
+		due := now.Sub(b.lastSourceSync[name]) >= time.Duration(source.SyncInterval)*time.Second
+		if due {
+			b.lastSourceSync[name] = now
+		}
+		b.lock.Unlock()
+
+		if !due {
+			continue
+		}
+
+		if _, err := b.syncSource(ctx, req, name, source, false); err != nil {
+			b.Backend.Logger().Error("scheduled source sync failed", "name", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// getSource retrieves a BIG-IQ source configuration
+func (b *f5TokenBackend) getSource(ctx context.Context, storage logical.Storage, name string) (*deviceSource, error) {
+	entry, err := storage.Get(ctx, sourceStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var source deviceSource
+	if err := entry.DecodeJSON(&source); err != nil {
+		return nil, err
+	}
+
+	return &source, nil
+}
+
+// listSourceDevices lists the devices of a stored source, guarded by the
+// source's circuit breaker so that a wrong BIG-IQ password cannot lock the
+// account through repeated scheduled syncs
+func (b *f5TokenBackend) listSourceDevices(name string, source *deviceSource) ([]api.ManagedDevice, error) {
+	cb := b.breaker(sourceBreakerPrefix + name)
+	if err := cb.allow(defaultBreakerCooldown, time.Now()); err != nil {
+		return nil, fmt.Errorf("source %s: %w", name, err)
+	}
+
+	devices, err := source.listDevices()
+	now := time.Now()
+	cb.record(err, defaultBreakerThreshold, now)
+	if err != nil && cb.isOpen(defaultBreakerCooldown, now) {
+		b.Backend.Logger().Warn("circuit breaker opened for source", "name", name, "error", err)
+	}
+
+	return devices, err
+}
+
+// listDevices logs in to the BIG-IQ and lists the BIG-IP devices it manages
+func (s *deviceSource) listDevices() ([]api.ManagedDevice, error) {
+	client := api.NewClient(s.Host, s.Username, s.Password, s.InsecureSSL)
+	client.Platform = api.PlatformBIGIQ
+
+	tokenResp, err := client.GetToken(0)
+	if err != nil {
+		return nil, err
+	}
+	defer client.RevokeToken(tokenResp.Token.Token)
+
+	return client.ListManagedDevices(tokenResp.Token.Token)
+}
+
+// connectionPrefix returns the prefix for the names of discovered connections
+func (s *deviceSource) connectionPrefix(name string) string {
+	if s.ConnectionPrefix != "" {
+		return s.ConnectionPrefix
+	}
+	return name + "-"
+}
+
+// applyDevice returns a copy of the connection with the source template and
+// the device's management address and details applied. The template
+// credentials are only applied with withCredentials. Settings the template
+// does not cover, such as breaker tuning, are kept.
+func (s *deviceSource) applyDevice(name string, connection *Connection, device api.ManagedDevice, now time.Time, withCredentials bool) *Connection {
+	updated := *connection
+	updated.Host = device.Address
+	if withCredentials {
+		updated.Username = s.TemplateUsername
+		updated.Password = s.TemplatePassword
+	}
+	updated.InsecureSSL = s.TemplateInsecureSSL
+
+	updated.Tags = cloneMap(connection.Tags)
+	for key, value := range s.TemplateTags {
+		updated.Tags[key] = value
+	}
+	if len(updated.Tags) == 0 {
+		updated.Tags = nil
+	}
+
+	updated.Metadata = cloneMap(connection.Metadata)
+	updated.Metadata[metadataSource] = name
+	updated.Metadata[metadataDeviceID] = device.UUID
+	updated.Metadata[metadataHostname] = device.Hostname
+	updated.Metadata[metadataVersion] = device.Version
+	if updated.Metadata[metadataDiscovered] == "" {
+		updated.Metadata[metadataDiscovered] = now.Format(time.RFC3339)
+	}
+	delete(updated.Metadata, metadataRemovedAt)
+
+	return &updated
+}
+
+// summary returns the sync result for API output
+func (r *sourceSyncResult) summary() map[string]interface{} {
+	return map[string]interface{}{
+		"synced_at": r.SyncedAt.Format(time.RFC3339),
+		"devices":   r.Devices,
+		"created":   nonNilSlice(r.Created),
+		"updated":   nonNilSlice(r.Updated),
+		"unchanged": nonNilSlice(r.Unchanged),
+		"restored":  nonNilSlice(r.Restored),
+		"removed":   nonNilSlice(r.Removed),
+		"conflicts": nonNilSlice(r.Conflicts),
+		"errors":    nonNilSlice(r.Errors),
+	}
+}
+
+// cloneMap returns a copy of m that is safe to modify, never nil
+func cloneMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for key, value := range m {
+		out[key] = value
+	}
+	return out
+}
+
+// nonNilSlice returns s, or an empty slice if s is nil, for API output
+func nonNilSlice(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,109 @@
+package bigiptoken
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// testSource writes a source for a BIG-IQ stand-in managing one device
+func testSource(t *testing.T, b *f5TokenBackend, storage logical.Storage, bigiq *bigipDevice, srv string, extra map[string]interface{}) {
+	t.Helper()
+
+	bigiq.mu.Lock()
+	bigiq.managed = []map[string]string{
+		{"uuid": "device-1", "hostname": "lb1.example.com", "address": "192.0.2.10", "version": "17.1.0"},
+	}
+	bigiq.mu.Unlock()
+
+	data := map[string]interface{}{
+		"host":              srv,
+		"username":          "admin",
+		"password":          "password",
+		"insecure_ssl":      true,
+		"template_username": "vault",
+		"template_password": "template",
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	testRequest(t, b, storage, logical.UpdateOperation, "config/source/bigiq1", data)
+}
+
+func TestSourceSyncKeepsConnectionCredentials(t *testing.T) {
+	b, storage := testBackend(t)
+	bigiq, srv := newBigIPDevice(t)
+	ctx := context.Background()
+	testSource(t, b, storage, bigiq, srv.URL, nil)
+
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+	if created := resp.Data["created"].([]string); len(created) != 1 || created[0] != "bigiq1-lb1.example.com" {
+		t.Fatalf("unexpected sync result: %v", resp.Data)
+	}
+
+	testRequest(t, b, storage, logical.PatchOperation, "config/connection/bigiq1-lb1.example.com", map[string]interface{}{
+		"password":          "patched",
+		"verify_connection": false,
+	})
+
+	resp = testRequest(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+	if unchanged := resp.Data["unchanged"].([]string); len(unchanged) != 1 {
+		t.Fatalf("expected the connection to be left alone, got %v", resp.Data)
+	}
+	connection, err := b.getConnection(ctx, storage, "bigiq1-lb1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.Password != "patched" {
+		t.Fatalf("expected the patched password to be kept, got %q", connection.Password)
+	}
+
+	testSource(t, b, storage, bigiq, srv.URL, map[string]interface{}{"overwrite_credentials": true})
+	resp = testRequest(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+	if updated := resp.Data["updated"].([]string); len(updated) != 1 {
+		t.Fatalf("expected the credentials to be overwritten, got %v", resp.Data)
+	}
+	connection, err = b.getConnection(ctx, storage, "bigiq1-lb1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.Username != "vault" || connection.Password != "template" {
+		t.Fatalf("expected the template credentials, got %s/%s", connection.Username, connection.Password)
+	}
+}
+
+// A wrong BIG-IQ password must not cost a failed login on every sync
+func TestSourceSyncBreaker(t *testing.T) {
+	b, storage := testBackend(t)
+	bigiq, srv := newBigIPDevice(t)
+	testSource(t, b, storage, bigiq, srv.URL, nil)
+
+	bigiq.setPassword("admin", "rotated")
+	before := bigiq.loginCount("admin")
+
+	for i := 0; i < defaultBreakerThreshold; i++ {
+		msg := testRequestError(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+		if !strings.Contains(msg, api.ErrAuthentication.Error()) {
+			t.Fatalf("sync %d: unexpected error: %s", i+1, msg)
+		}
+	}
+	msg := testRequestError(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+	if !strings.Contains(msg, errCircuitOpen.Error()) {
+		t.Fatalf("expected the breaker to refuse the sync, got: %s", msg)
+	}
+	if logins := bigiq.loginCount("admin") - before; logins != defaultBreakerThreshold {
+		t.Fatalf("expected %d failed logins, got %d", defaultBreakerThreshold, logins)
+	}
+
+	resp := testRequest(t, b, storage, logical.ReadOperation, "config/source/bigiq1", nil)
+	if state := resp.Data["circuit_breaker"]; state != breakerStateOpen {
+		t.Fatalf("circuit_breaker = %v, want %s", state, breakerStateOpen)
+	}
+
+	// Fixing the source's password closes the breaker again
+	testSource(t, b, storage, bigiq, srv.URL, map[string]interface{}{"password": "rotated"})
+	testRequest(t, b, storage, logical.UpdateOperation, "config/source/bigiq1/sync", nil)
+}
@@ -0,0 +1,335 @@
+package bigiptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Token records are stored per connection as tokens/<connection>/<token_id>
+const tokenStoragePrefix = "tokens/"
+
+// Token states accepted by the tokens/ filters
+const (
+	tokenStateActive   = "active"
+	tokenStateInactive = "inactive"
+	tokenStateAll      = "all"
+)
+
+// tokenFilter selects token records when listing tokens/
+type tokenFilter struct {
+	Connection     string
+	State          string
+	ExpiringBefore time.Time
+	CreatedAfter   time.Time
+	EntityID       string
+	After          string
+	Limit          int
+}
+
+// tokenRecord is a token entry together with its ID and effective state
+type tokenRecord struct {
+	ID     string
+	Entry  *TokenEntry
+	Active bool
+}
+
+// newTokenID returns a unique ID for a token issued through the named
+// connection. The random suffix keeps tokens issued in the same second from
+// overwriting each other's records.
+func newTokenID(name string) (string, error) {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("token_%s_%d_%s", name, time.Now().Unix(), suffix), nil
+}
+
+// tokenStoragePath returns the storage key of a token record
+func tokenStoragePath(name, tokenID string) string {
+	return tokenStoragePrefix + name + "/" + tokenID
+}
+
+// initialize runs once when the backend is mounted or unsealed
+func (b *f5TokenBackend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	// Only the node that owns storage may rewrite it
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	return b.migrateFlatTokens(ctx, req.Storage)
+}
+
+// migrateFlatTokens moves token records written by earlier versions of the
+// plugin from tokens/<token_id> to tokens/<connection>/<token_id>
+func (b *f5TokenBackend) migrateFlatTokens(ctx context.Context, storage logical.Storage) error {
+	keys, err := storage.List(ctx, tokenStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		// Per-connection prefixes are already in the new layout
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+
+		entry, err := storage.Get(ctx, tokenStoragePrefix+key)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+
+		var tokenEntry TokenEntry
+		if err := entry.DecodeJSON(&tokenEntry); err != nil {
+			b.Backend.Logger().Error("skipping undecodable token during migration", "token_id", key, "error", err)
+			continue
+		}
+		if tokenEntry.Host == "" {
+			b.Backend.Logger().Error("skipping token without a connection during migration", "token_id", key)
+			continue
+		}
+
+		if err := b.putTokenEntry(ctx, storage, key, &tokenEntry); err != nil {
+			return err
+		}
+		if err := storage.Delete(ctx, tokenStoragePrefix+key); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		b.Backend.Logger().Info("migrated token records to per-connection storage", "count", migrated)
+	}
+
+	return nil
+}
+
+// listTokenConnections returns the names of all connections that have token records
+func (b *f5TokenBackend) listTokenConnections(ctx context.Context, storage logical.Storage) ([]string, error) {
+	keys, err := storage.List(ctx, tokenStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			names = append(names, strings.TrimSuffix(key, "/"))
+		}
+	}
+
+	return names, nil
+}
+
+// listTokenIDs returns the IDs of all token records for the named connection
+func (b *f5TokenBackend) listTokenIDs(ctx context.Context, storage logical.Storage, name string) ([]string, error) {
+	keys, err := storage.List(ctx, tokenStoragePrefix+name+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenIDs []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			tokenIDs = append(tokenIDs, key)
+		}
+	}
+
+	return tokenIDs, nil
+}
+
+// getTokenEntry loads a stored token record, returning nil if it does not exist
+func (b *f5TokenBackend) getTokenEntry(ctx context.Context, storage logical.Storage, name, tokenID string) (*TokenEntry, error) {
+	entry, err := storage.Get(ctx, tokenStoragePath(name, tokenID))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var tokenEntry TokenEntry
+	if err := entry.DecodeJSON(&tokenEntry); err != nil {
+		return nil, err
+	}
+
+	return &tokenEntry, nil
+}
+
+// putTokenEntry stores a token record under the connection it was issued through
+func (b *f5TokenBackend) putTokenEntry(ctx context.Context, storage logical.Storage, tokenID string, tokenEntry *TokenEntry) error {
+	entry, err := logical.StorageEntryJSON(tokenStoragePath(tokenEntry.Host, tokenID), tokenEntry)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+// outstandingTokens returns the active tokens issued through the named connection, keyed by token ID
+func (b *f5TokenBackend) outstandingTokens(ctx context.Context, storage logical.Storage, name string) (map[string]*TokenEntry, error) {
+	tokenIDs, err := b.listTokenIDs(ctx, storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	outstanding := make(map[string]*TokenEntry)
+	for _, tokenID := range tokenIDs {
+		tokenEntry, err := b.getTokenEntry(ctx, storage, name, tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if tokenEntry == nil || !tokenEntry.IsActive {
+			continue
+		}
+		outstanding[tokenID] = tokenEntry
+	}
+
+	return outstanding, nil
+}
+
+// revokeTokenEntry revokes a token on the F5 BIG-IP and marks its record
+// inactive. A dynamic user created for the token is deleted as well, which
+// also counts as revoking the token.
+func (b *f5TokenBackend) revokeTokenEntry(ctx context.Context, storage logical.Storage, connection *Connection, tokenID string, tokenEntry *TokenEntry) error {
+	err := b.revokeOnDevice(connection, tokenEntry)
+	if tokenEntry.DynamicUser {
+		if deleteErr := b.deleteDynamicUser(connection, tokenEntry); deleteErr != nil {
+			return errors.Join(err, deleteErr)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	tokenEntry.IsActive = false
+	return b.putTokenEntry(ctx, storage, tokenID, tokenEntry)
+}
+
+// sortedTokenIDs returns the keys of a token map in a stable order
+func sortedTokenIDs(tokens map[string]*TokenEntry) []string {
+	tokenIDs := make([]string, 0, len(tokens))
+	for tokenID := range tokens {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	sort.Strings(tokenIDs)
+	return tokenIDs
+}
+
+// tokenFilterFromData builds a tokenFilter from the tokens/ request fields
+func tokenFilterFromData(data *framework.FieldData) (*tokenFilter, error) {
+	filter := &tokenFilter{
+		Connection: data.Get("connection").(string),
+		State:      data.Get("state").(string),
+		EntityID:   data.Get("entity_id").(string),
+		After:      data.Get("after").(string),
+		Limit:      data.Get("limit").(int),
+	}
+
+	switch filter.State {
+	case tokenStateActive, tokenStateInactive, tokenStateAll:
+	default:
+		return nil, fmt.Errorf("state must be one of %s, %s or %s", tokenStateActive, tokenStateInactive, tokenStateAll)
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("limit cannot be negative")
+	}
+	if v, ok := data.GetOk("expiring_before"); ok {
+		filter.ExpiringBefore = v.(time.Time)
+	}
+	if v, ok := data.GetOk("created_after"); ok {
+		filter.CreatedAfter = v.(time.Time)
+	}
+
+	return filter, nil
+}
+
+// matches reports whether a token record passes every filter except pagination
+func (f *tokenFilter) matches(record *tokenRecord) bool {
+	switch f.State {
+	case tokenStateActive:
+		if !record.Active {
+			return false
+		}
+	case tokenStateInactive:
+		if record.Active {
+			return false
+		}
+	}
+	if !f.ExpiringBefore.IsZero() && !record.Entry.ExpiresAt.Before(f.ExpiringBefore) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !record.Entry.CreatedAt.After(f.CreatedAfter) {
+		return false
+	}
+	if f.EntityID != "" && record.Entry.EntityID != f.EntityID {
+		return false
+	}
+	return true
+}
+
+// findTokens returns the token records matching a filter, sorted by token ID
+// and paginated with the filter's after/limit settings
+func (b *f5TokenBackend) findTokens(ctx context.Context, storage logical.Storage, filter *tokenFilter) ([]*tokenRecord, error) {
+	names := []string{filter.Connection}
+	if filter.Connection == "" {
+		var err error
+		names, err = b.listTokenConnections(ctx, storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+
+	var records []*tokenRecord
+	for _, name := range names {
+		tokenIDs, err := b.listTokenIDs(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tokenID := range tokenIDs {
+			if filter.After != "" && tokenID <= filter.After {
+				continue
+			}
+
+			tokenEntry, err := b.getTokenEntry(ctx, storage, name, tokenID)
+			if err != nil {
+				return nil, err
+			}
+			if tokenEntry == nil {
+				continue
+			}
+
+			record := &tokenRecord{
+				ID:     tokenID,
+				Entry:  tokenEntry,
+				Active: tokenEntry.IsActive && now.Before(tokenEntry.ExpiresAt),
+			}
+			if filter.matches(record) {
+				records = append(records, record)
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+
+	return records, nil
+}
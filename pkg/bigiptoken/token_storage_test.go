@@ -0,0 +1,168 @@
+package bigiptoken
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestMigrateFlatTokens(t *testing.T) {
+	b, storage := testBackend(t)
+	ctx := context.Background()
+
+	flat := map[string]interface{}{
+		"token_lb1_1700000000": &TokenEntry{Token: "A", Host: "lb1", IsActive: true},
+		"token_lb2_1700000001": &TokenEntry{Token: "B", Host: "lb2"},
+		"token_none":           &TokenEntry{Token: "C"},
+		"token_garbled":        "not a token record",
+	}
+	for key, value := range flat {
+		entry, err := logical.StorageEntryJSON(tokenStoragePrefix+key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A record already in the per-connection layout is left alone
+	if err := b.putTokenEntry(ctx, storage, "token_lb1_1700000002", &TokenEntry{Token: "D", Host: "lb1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.migrateFlatTokens(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key       string
+		wantToken string
+	}{
+		{"tokens/lb1/token_lb1_1700000000", "A"},
+		{"tokens/lb2/token_lb2_1700000001", "B"},
+		{"tokens/lb1/token_lb1_1700000002", "D"},
+		{"tokens/token_lb1_1700000000", ""},
+		{"tokens/token_lb2_1700000001", ""},
+		// Records that cannot be placed stay where they are
+		{"tokens/token_none", "C"},
+	}
+	for _, tt := range tests {
+		entry, err := storage.Get(ctx, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantToken == "" {
+			if entry != nil {
+				t.Errorf("%s: expected the flat record to be removed", tt.key)
+			}
+			continue
+		}
+		if entry == nil {
+			t.Errorf("%s: record missing", tt.key)
+			continue
+		}
+		var tokenEntry TokenEntry
+		if err := entry.DecodeJSON(&tokenEntry); err != nil {
+			t.Fatal(err)
+		}
+		if tokenEntry.Token != tt.wantToken {
+			t.Errorf("%s: token = %q, want %q", tt.key, tokenEntry.Token, tt.wantToken)
+		}
+	}
+	if entry, _ := storage.Get(ctx, "tokens/token_garbled"); entry == nil {
+		t.Error("expected the undecodable record to be left in place")
+	}
+
+	// A second run finds nothing left to move
+	if err := b.migrateFlatTokens(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	names, err := b.listTokenConnections(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "lb1" || names[1] != "lb2" {
+		t.Errorf("connections = %v, want [lb1 lb2]", names)
+	}
+}
+
+// Tokens issued in the same second must not share a record
+func TestNewTokenIDUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		tokenID, err := newTokenID("lb1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[tokenID] {
+			t.Fatalf("duplicate token ID %s", tokenID)
+		}
+		seen[tokenID] = true
+	}
+}
+
+func TestTokenListing(t *testing.T) {
+	b, storage := testBackend(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	records := map[string]*TokenEntry{
+		"t1": {Host: "lb1", IsActive: true, EntityID: "e1", CreatedAt: now.Add(-3 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		"t2": {Host: "lb1", IsActive: true, EntityID: "e2", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(3 * time.Hour)},
+		"t3": {Host: "lb1", EntityID: "e1", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		"t4": {Host: "lb1", IsActive: true, EntityID: "e2", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Minute)},
+		"t5": {Host: "lb2", IsActive: true, EntityID: "e1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		"t6": {Host: "lb3", EntityID: "e2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	for tokenID, entry := range records {
+		if err := b.putTokenEntry(ctx, storage, tokenID, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		data     map[string]interface{}
+		wantKeys []string
+	}{
+		{"active by default", "tokens/lb1/", nil, []string{"t1", "t2"}},
+		{"all states", "tokens/lb1/", map[string]interface{}{"state": "all"}, []string{"t1", "t2", "t3", "t4"}},
+		{"revoked and expired are inactive", "tokens/lb1/", map[string]interface{}{"state": "inactive"}, []string{"t3", "t4"}},
+		{"entity", "tokens/lb1/", map[string]interface{}{"entity_id": "e1"}, []string{"t1"}},
+		{"created after", "tokens/lb1/", map[string]interface{}{"created_after": now.Add(-90 * time.Minute).Format(time.RFC3339)}, []string{"t2"}},
+		{"expiring before", "tokens/lb1/", map[string]interface{}{"expiring_before": now.Add(2 * time.Hour).Format(time.RFC3339)}, []string{"t1"}},
+		{"after", "tokens/lb1/", map[string]interface{}{"after": "t1"}, []string{"t2"}},
+		{"limit", "tokens/lb1/", map[string]interface{}{"state": "all", "limit": 2}, []string{"t1", "t2"}},
+		{"next page", "tokens/lb1/", map[string]interface{}{"state": "all", "after": "t2", "limit": 1}, []string{"t3"}},
+		{"unknown connection", "tokens/lb9/", nil, nil},
+		{"connections with active tokens", "tokens/", nil, []string{"lb1/", "lb2/"}},
+		{"connections in all states", "tokens/", map[string]interface{}{"state": "all"}, []string{"lb1/", "lb2/", "lb3/"}},
+		{"connections filtered by entity", "tokens/", map[string]interface{}{"state": "all", "entity_id": "e2"}, []string{"lb1/", "lb3/"}},
+		{"connections after", "tokens/", map[string]interface{}{"state": "all", "after": "lb1/"}, []string{"lb2/", "lb3/"}},
+		{"connections limit", "tokens/", map[string]interface{}{"state": "all", "limit": 1}, []string{"lb1/"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(t, b, storage, logical.ListOperation, tt.path, tt.data)
+
+			keys, _ := resp.Data["keys"].([]string)
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+
+	resp := testRequest(t, b, storage, logical.ListOperation, "tokens/", nil)
+	if info := resp.Data["key_info"].(map[string]interface{})["lb1/"].(map[string]interface{}); info["tokens"] != 2 {
+		t.Errorf("lb1/ key_info = %v, want 2 tokens", info)
+	}
+
+	for _, data := range []map[string]interface{}{{"state": "revoked"}, {"limit": -1}} {
+		testRequestError(t, b, storage, logical.ListOperation, "tokens/lb1/", data)
+	}
+}
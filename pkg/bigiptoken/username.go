@@ -0,0 +1,109 @@
+package bigiptoken
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/template"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// invalidUsernameChars matches the characters that cannot appear in a local BIG-IP username
+var invalidUsernameChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// usernameTemplateData is the data a role's username_template is rendered with
+type usernameTemplateData struct {
+	DisplayName string
+	RoleName    string
+	EntityID    string
+}
+
+// renderUsername renders a username template and makes the result a valid
+// local BIG-IP username: lowercase, with unsupported characters replaced by
+// '_' and starting with a letter or '_'. A name over the BIG-IP limit is
+// rendered again with its fields shortened, display name first, so that
+// literal text and random suffixes in the template are kept whole. Only a
+// template too long without any of its fields is rejected.
+func renderUsername(rawTemplate string, data usernameTemplateData) (string, error) {
+	tmpl, err := template.NewTemplate(template.Template(rawTemplate))
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		rendered, err := tmpl.Generate(data)
+		if err != nil {
+			return "", err
+		}
+
+		username := sanitizeUsername(rendered)
+		if username == "" {
+			return "", fmt.Errorf("template rendered an empty username")
+		}
+
+		excess := len(username) - bigipUsernameMaxLength
+		if excess <= 0 {
+			if slices.Contains(reservedUsernames, username) {
+				return "", fmt.Errorf("template rendered the built-in BIG-IP account %s", username)
+			}
+			return username, nil
+		}
+		if !data.shorten(excess) {
+			return "", fmt.Errorf("template renders %s even with its fields left empty, which is longer than %d characters", username, bigipUsernameMaxLength)
+		}
+	}
+}
+
+// shorten cuts up to n characters from the end of the first non-empty
+// field, in the order display name, entity ID and role name. It reports
+// false once every field is empty.
+func (d *usernameTemplateData) shorten(n int) bool {
+	for _, field := range []*string{&d.DisplayName, &d.EntityID, &d.RoleName} {
+		runes := []rune(*field)
+		if len(runes) == 0 {
+			continue
+		}
+		*field = string(runes[:len(runes)-min(n, len(runes))])
+		return true
+	}
+	return false
+}
+
+// sanitizeUsername rewrites a string into a valid local BIG-IP username
+func sanitizeUsername(name string) string {
+	username := invalidUsernameChars.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_")
+	if username == "" || username == "_" {
+		return ""
+	}
+	if c := username[0]; !(c >= 'a' && c <= 'z') && c != '_' {
+		username = "_" + username
+	}
+	return username
+}
+
+// deleteDynamicUser removes the dynamic user a token was issued for, using
+// a short-lived administrative token from the connection. Deleting the
+// user also ends any session it still holds.
+func (b *f5TokenBackend) deleteDynamicUser(connection *Connection, tokenEntry *TokenEntry) error {
+	name := tokenEntry.Host
+
+	admin, err := b.loginWithCredential(name, connection, []string{tokenEntry.deviceHost(connection)}, serviceUserAdminTTL, "")
+	if err != nil {
+		return fmt.Errorf("error logging in to delete dynamic user %s: %w", tokenEntry.Username, err)
+	}
+	defer b.discardLogin(name, admin)
+
+	adminClient, ok := admin.Client.(*api.Client)
+	if !ok {
+		return fmt.Errorf("connection %s cannot manage users", name)
+	}
+
+	if err := adminClient.DeleteUser(admin.Response.Token.Token, tokenEntry.Username); err != nil {
+		return err
+	}
+
+	b.Backend.Logger().Info("deleted dynamic user", "name", name, "username", tokenEntry.Username)
+	return nil
+}
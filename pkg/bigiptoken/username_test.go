@@ -0,0 +1,155 @@
+package bigiptoken
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestSanitizeUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"valid", "v-jane.doe_1", "v-jane.doe_1"},
+		{"lowercased", "V-Jane", "v-jane"},
+		{"invalid runs replaced", "ldap-Jane Doe@@Corp", "ldap-jane_doe_corp"},
+		{"leading digit prefixed", "9lives", "_9lives"},
+		{"leading dash prefixed", "-dash", "_-dash"},
+		{"surrounding space trimmed", "  jane  ", "jane"},
+		{"nothing valid", "ÄÖ", ""},
+		{"empty", "", ""},
+		{"not truncated", strings.Repeat("a", 40), strings.Repeat("a", 40)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeUsername(tt.in); got != tt.want {
+				t.Errorf("sanitizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderUsername(t *testing.T) {
+	data := usernameTemplateData{
+		DisplayName: "ldap-Jane Doe",
+		RoleName:    "dashboard",
+		EntityID:    "00000000-0000-0000-0000-000000000000",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{"fields", "{{.RoleName}}-{{.DisplayName}}", "dashboard-ldap-jane_doe", ""},
+		{"exactly at limit", "{{.EntityID | truncate 31}}", "_00000000-0000-0000-0000-0000000", ""},
+		{"prefix pushes over limit", "{{.EntityID | truncate 32}}", "_00000000-0000-0000-0000-0000000", ""},
+		{"field shortened", "v-{{.EntityID}}", "v-00000000-0000-0000-0000-000000", ""},
+		{"display name shortened first", "{{.RoleName}}-{{.DisplayName}}-{{.EntityID}}", "dashboard--00000000-0000-0000-00", ""},
+		{"literal over limit", "vault-managed-dashboard-operators", "", "longer than 32 characters"},
+		{"empty", "{{\"\"}}", "", "empty username"},
+		{"reserved", "Admin", "", "built-in BIG-IP account"},
+		{"invalid template", "{{.Nope", "", "unclosed action"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderUsername(tt.template, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderUsername(%q) error = %v, want one containing %q", tt.template, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderUsername(%q): %v", tt.template, err)
+			}
+			if got != tt.want {
+				t.Errorf("renderUsername(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+// A long field must never push a random suffix off the end of the name
+func TestRenderUsernameKeepsSuffix(t *testing.T) {
+	data := usernameTemplateData{DisplayName: strings.Repeat("x", 64)}
+	const tmpl = `{{ printf "v-%s-%s" .DisplayName (random 8) }}`
+
+	username, err := renderUsername(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(username) != bigipUsernameMaxLength || !strings.HasPrefix(username, "v-"+strings.Repeat("x", 21)+"-") {
+		t.Errorf("got %q, want the display name shortened and the full random suffix kept", username)
+	}
+
+	other, err := renderUsername(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username == other {
+		t.Errorf("two renders produced the same name %q", username)
+	}
+}
+
+func TestRoleWriteUsernameTemplate(t *testing.T) {
+	b, storage := testBackend(t)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "config/connection/lb1",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"host":              "192.0.2.1",
+			"username":          "admin",
+			"password":          "password",
+			"verify_connection": false,
+		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("writing connection: %v %v", resp, err)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{"fields shortened at issuance", "v-{{.DisplayName}}-{{.EntityID}}-{{random 8}}", ""},
+		{"literal over limit", "vault-managed-dashboard-role-{{random 8}}", "longer than 32 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "roles/dashboard",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"connection":        "lb1",
+					"bigip_role":        "guest",
+					"username_template": tt.template,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr == "" {
+				if resp != nil && resp.IsError() {
+					t.Fatalf("expected the role write to succeed, got %v", resp.Error())
+				}
+				return
+			}
+			if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), tt.wantErr) {
+				t.Fatalf("expected the role write to be rejected with %q, got %v", tt.wantErr, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package bigiptoken
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// defaultConnectionVersionHistory is how many versions of each connection are kept
+const defaultConnectionVersionHistory = 5
+
+// connectionVersionStoragePrefix is where previous connection configurations
+// are stored, as connection-versions/<connection>. Versions include the
+// password so a rollback can restore it, and are seal wrapped like the
+// connection itself.
+const connectionVersionStoragePrefix = "connection-versions/"
+
+// Operations recorded against a connection version
+const (
+	versionOperationWrite    = "write"
+	versionOperationPatch    = "patch"
+	versionOperationRollback = "rollback"
+	versionOperationImport   = "import"
+
+	// versionOperationExisting marks a configuration that was already
+	// stored when the connection's version history began
+	versionOperationExisting = "existing"
+)
+
+// connectionVersion is a single stored revision of a connection configuration
+type connectionVersion struct {
+	Version      int        `json:"version"`
+	Connection   Connection `json:"connection"`
+	WrittenAt    time.Time  `json:"written_at"`
+	Operation    string     `json:"operation"`
+	RestoredFrom int        `json:"restored_from,omitempty"`
+
+	// Identity of the Vault client that wrote the version
+	EntityID    string `json:"entity_id,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// pathConnectionVersions defines the path for listing previous versions of a connection
+func pathConnectionVersions(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/connection/" + framework.GenericNameRegex("name") + "/versions",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConnectionVersionsRead,
+			},
+		},
+
+		HelpSynopsis:    "List stored versions of an F5 BIG-IP connection",
+		HelpDescription: "This endpoint lists the most recent versions of a connection configuration, with when and by whom each was written. Passwords are never returned.",
+	}
+}
+
+// pathConnectionRollback defines the path for restoring a previous version of a connection
+func pathConnectionRollback(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/connection/" + framework.GenericNameRegex("name") + "/rollback",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the F5 BIG-IP connection",
+				Required:    true,
+			},
+			"version": {
+				Type:        framework.TypeInt,
+				Description: "Version of the connection to restore",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConnectionRollbackWrite,
+			},
+		},
+
+		HelpSynopsis:    "Restore a previous version of an F5 BIG-IP connection",
+		HelpDescription: "This endpoint logs in to the F5 BIG-IP with a stored version of the connection and, if that succeeds, makes it the current configuration.",
+	}
+}
+
+// pathConnectionVersionsRead handles config/connection/<name>/versions read operations
+func (b *f5TokenBackend) pathConnectionVersionsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	versions, err := b.getConnectionVersions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, nil
+	}
+
+	out := make([]map[string]interface{}, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		entry := map[string]interface{}{
+			"version":      version.Version,
+			"written_at":   version.WrittenAt.Format(time.RFC3339),
+			"operation":    version.Operation,
+			"entity_id":    version.EntityID,
+			"display_name": version.DisplayName,
+			"connection":   version.Connection.redacted(),
+		}
+		if version.RestoredFrom != 0 {
+			entry["restored_from"] = version.RestoredFrom
+		}
+		// Show that a password changed without revealing anything about it
+		if i > 0 {
+			entry["password_changed"] = version.Connection.Password != versions[i-1].Connection.Password ||
+				version.Connection.SecondaryPassword != versions[i-1].Connection.SecondaryPassword
+		}
+		out = append(out, entry)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"current_version": versions[len(versions)-1].Version,
+			"versions":        out,
+		},
+	}, nil
+}
+
+// pathConnectionRollbackWrite handles config/connection/<name>/rollback write operations
+func (b *f5TokenBackend) pathConnectionRollbackWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	target := data.Get("version").(int)
+
+	current, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return logical.ErrorResponse(fmt.Sprintf("connection %s not found", name)), nil
+	}
+
+	versions, err := b.getConnectionVersions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var restore *Connection
+	for i := range versions {
+		if versions[i].Version == target {
+			restore = &versions[i].Connection
+			break
+		}
+	}
+	if restore == nil {
+		return logical.ErrorResponse(fmt.Sprintf("version %d of connection %s not found", target, name)), nil
+	}
+
+	b.Backend.Logger().Info("rolling back connection", "name", name, "version", target)
+
+	// Only restore credentials that still work on the device
+	if _, err := b.verifyCredentials(name, restore, false); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to connect to F5 BIG-IP with version %d: %s", target, err)), nil
+	}
+
+	version, err := b.saveConnection(ctx, req, name, restore, versionOperationRollback, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// The restored settings start with a clean breaker and history, as a write does
+	b.resetBreaker(name)
+	b.resetHosts(name)
+	if err := req.Storage.Delete(ctx, healthStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"success":       true,
+			"host":          restore.Host,
+			"restored_from": target,
+			"version":       version,
+		},
+	}, nil
+}
+
+// getConnectionVersions loads the stored versions of a connection, oldest first
+func (b *f5TokenBackend) getConnectionVersions(ctx context.Context, storage logical.Storage, name string) ([]connectionVersion, error) {
+	entry, err := storage.Get(ctx, connectionVersionStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var versions []connectionVersion
+	if err := entry.DecodeJSON(&versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// saveConnection stores a connection and records it in its version
+// history, returning the new version number. A connection stored before
+// versioning existed has no history yet, so the configuration being
+// replaced is recorded first and can still be rolled back to.
+func (b *f5TokenBackend) saveConnection(ctx context.Context, req *logical.Request, name string, connection *Connection, operation string, restoredFrom int) (int, error) {
+	versions, err := b.getConnectionVersions(ctx, req.Storage, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		previous, err := b.getConnection(ctx, req.Storage, name)
+		if err != nil {
+			return 0, err
+		}
+		if previous != nil {
+			if _, err := b.appendConnectionVersion(ctx, req.Storage, name, connectionVersion{
+				Connection: *previous,
+				WrittenAt:  time.Now().UTC(),
+				Operation:  versionOperationExisting,
+			}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err := b.putConnection(ctx, req.Storage, name, connection); err != nil {
+		return 0, err
+	}
+
+	return b.appendConnectionVersion(ctx, req.Storage, name, connectionVersion{
+		Connection:   *connection,
+		WrittenAt:    time.Now().UTC(),
+		Operation:    operation,
+		RestoredFrom: restoredFrom,
+		EntityID:     req.EntityID,
+		DisplayName:  req.DisplayName,
+	})
+}
+
+// appendConnectionVersion numbers a version and appends it to the
+// connection's history, trimmed to the configured size
+func (b *f5TokenBackend) appendConnectionVersion(ctx context.Context, storage logical.Storage, name string, version connectionVersion) (int, error) {
+	config, err := b.getMountConfig(ctx, storage)
+	if err != nil {
+		return 0, err
+	}
+
+	versions, err := b.getConnectionVersions(ctx, storage, name)
+	if err != nil {
+		return 0, err
+	}
+
+	version.Version = 1
+	if len(versions) > 0 {
+		version.Version = versions[len(versions)-1].Version + 1
+	}
+
+	versions = append(versions, version)
+	if len(versions) > config.ConnectionVersionHistory {
+		versions = versions[len(versions)-config.ConnectionVersionHistory:]
+	}
+
+	entry, err := logical.StorageEntryJSON(connectionVersionStoragePrefix+name, versions)
+	if err != nil {
+		return 0, err
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		return 0, err
+	}
+
+	return version.Version, nil
+}
@@ -0,0 +1,97 @@
+package bigiptoken
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestConnectionVersionTrimming(t *testing.T) {
+	b, storage := testBackend(t)
+	testRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{
+		"connection_version_history": 3,
+	})
+
+	for threshold := 1; threshold <= 5; threshold++ {
+		testRequest(t, b, storage, logical.UpdateOperation, "config/connection/lb1", map[string]interface{}{
+			"host":              "192.0.2.1",
+			"username":          "admin",
+			"password":          "password",
+			"breaker_threshold": threshold,
+			"verify_connection": false,
+		})
+	}
+
+	resp := testRequest(t, b, storage, logical.ReadOperation, "config/connection/lb1/versions", nil)
+	if current := resp.Data["current_version"]; current != 5 {
+		t.Errorf("current_version = %v, want 5", current)
+	}
+
+	versions := resp.Data["versions"].([]map[string]interface{})
+	var got []int
+	for _, version := range versions {
+		got = append(got, version["version"].(int))
+	}
+	if len(got) != 3 || got[0] != 5 || got[2] != 3 {
+		t.Errorf("versions = %v, want the three newest, newest first", got)
+	}
+	if versions[0]["password_changed"] != false {
+		t.Errorf("expected password_changed to be false, got %v", versions[0]["password_changed"])
+	}
+}
+
+func TestConnectionRollback(t *testing.T) {
+	b, storage := testBackend(t)
+	device, srv := newBigIPDevice(t)
+	ctx := context.Background()
+
+	testConnection(t, b, storage, "lb1", srv, nil)
+	device.setPassword("admin", "rotated")
+	testConnection(t, b, storage, "lb1", srv, map[string]interface{}{"password": "rotated"})
+
+	// Version 1's password no longer works, so it is not restored
+	if msg := testRequestError(t, b, storage, logical.UpdateOperation, "config/connection/lb1/rollback", map[string]interface{}{
+		"version": 1,
+	}); !strings.Contains(msg, "with version 1") {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+
+	// Once the device accepts it again, the rollback goes through and
+	// clears the per-host state gathered under the replaced settings
+	device.setPassword("admin", "password")
+	b.markHostReachable("lb1", "https://192.0.2.2", false)
+	b.lock.Lock()
+	b.activeHosts["lb1"] = "https://192.0.2.2"
+	b.lock.Unlock()
+	resp := testRequest(t, b, storage, logical.UpdateOperation, "config/connection/lb1/rollback", map[string]interface{}{
+		"version": 1,
+	})
+	if resp.Data["version"] != 3 || resp.Data["restored_from"] != 1 {
+		t.Fatalf("unexpected rollback response: %v", resp.Data)
+	}
+
+	connection, err := b.getConnection(ctx, storage, "lb1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.Password != "password" {
+		t.Errorf("expected version 1's password to be restored")
+	}
+
+	b.lock.Lock()
+	_, unreachable := b.unreachableHosts["lb1|https://192.0.2.2"]
+	_, active := b.activeHosts["lb1"]
+	_, breaker := b.breakers["lb1"]
+	b.lock.Unlock()
+	if unreachable || active || breaker {
+		t.Errorf("expected the rollback to reset host and breaker state")
+	}
+
+	resp = testRequest(t, b, storage, logical.ReadOperation, "config/connection/lb1/versions", nil)
+	latest := resp.Data["versions"].([]map[string]interface{})[0]
+	if latest["operation"] != versionOperationRollback || latest["restored_from"] != 1 || latest["password_changed"] != true {
+		t.Errorf("unexpected rollback version: %v", latest)
+	}
+}
@@ -0,0 +1,768 @@
+package bigiptoken
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/smaniak/vault-plugin-f5/pkg/bigiptoken/api"
+)
+
+// xcConnectionStoragePrefix is where F5 Distributed Cloud tenant connections are stored
+const xcConnectionStoragePrefix = "config/xc-connection/"
+
+// XC credential records are stored per tenant connection as
+// xc-credentials/<connection>/<credential_name>
+const xcCredentialStoragePrefix = "xc-credentials/"
+
+// secretXCCredentialType is the lease type for XC API credentials
+const secretXCCredentialType = "f5_xc_credential"
+
+// xcMaxCredentialTTL is the longest lease, in seconds, an XC credential may be issued with
+const xcMaxCredentialTTL = 30 * 24 * 3600
+
+// XC credential types accepted by xc-credential/
+const (
+	xcTypeAPIToken       = "api_token"
+	xcTypeAPICertificate = "api_certificate"
+)
+
+// invalidXCNameChars matches the characters that cannot appear in an XC object name
+var invalidXCNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// xcConnection is an F5 Distributed Cloud tenant, reached with a bootstrap
+// API token allowed to manage the tenant's API credentials
+type xcConnection struct {
+	TenantURL   string `json:"tenant_url"`
+	APIToken    string `json:"api_token"`
+	InsecureSSL bool   `json:"insecure_ssl"`
+}
+
+// xcCredentialEntry is the record of an API credential issued on an XC tenant.
+// The credential itself is only returned to the caller, never stored.
+type xcCredentialEntry struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Connection string    `json:"connection"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IsActive   bool      `json:"is_active"`
+
+	// TenantExpiresAt is when the tenant itself expires the credential,
+	// as a backstop should revocation never happen
+	TenantExpiresAt string `json:"tenant_expires_at,omitempty"`
+
+	// Identity of the Vault client that requested the credential
+	EntityID            string `json:"entity_id,omitempty"`
+	DisplayName         string `json:"display_name,omitempty"`
+	ClientTokenAccessor string `json:"client_token_accessor,omitempty"`
+	MountPoint          string `json:"mount_point,omitempty"`
+
+	// Optional caller-supplied context for the request
+	Purpose string `json:"purpose,omitempty"`
+	Ticket  string `json:"ticket,omitempty"`
+}
+
+// xcCredentialStoragePath returns the storage key of an XC credential record
+func xcCredentialStoragePath(connection, name string) string {
+	return xcCredentialStoragePrefix + connection + "/" + name
+}
+
+// pathConfigXCConnection defines the path for F5 Distributed Cloud tenant configuration
+func pathConfigXCConnection(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/xc-connection/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Unique name for the XC tenant connection",
+				Required:    true,
+			},
+			"tenant_url": {
+				Type:        framework.TypeString,
+				Description: "URL of the XC tenant console, e.g. https://acme.console.ves.volterra.io",
+				Required:    true,
+			},
+			"api_token": {
+				Type:        framework.TypeString,
+				Description: "Bootstrap API token allowed to create and revoke the tenant's API credentials",
+				Required:    true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"insecure_ssl": {
+				Type:        framework.TypeBool,
+				Description: "Allow insecure SSL connections to the tenant (not recommended)",
+				Default:     false,
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "List the tenant's API credentials with the bootstrap token before saving the connection",
+				Default:     true,
+			},
+			"revoke_outstanding": {
+				Type:        framework.TypeBool,
+				Description: "On delete, revoke every outstanding credential issued through this connection first",
+				Default:     false,
+			},
+			"force": {
+				Type:        framework.TypeBool,
+				Description: "On delete, remove the connection even if credentials are outstanding or could not be revoked",
+				Default:     false,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathXCConnectionRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathXCConnectionWrite,
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathXCConnectionWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathXCConnectionDelete,
+			},
+		},
+
+		ExistenceCheck: b.xcConnectionExistenceCheck,
+
+		HelpSynopsis:    "Configure an F5 Distributed Cloud tenant connection",
+		HelpDescription: "This endpoint configures an F5 Distributed Cloud tenant and the bootstrap API token used to issue short-lived API credentials on it.",
+	}
+}
+
+// pathConfigXCConnectionList defines the path for listing XC tenant connections
+func pathConfigXCConnectionList(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/xc-connections/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathXCConnectionList,
+			},
+		},
+
+		HelpSynopsis:    "List all configured F5 Distributed Cloud tenant connections",
+		HelpDescription: "This endpoint lists all configured F5 Distributed Cloud tenant connections by name.",
+	}
+}
+
+// pathXCCredential defines the path for issuing XC API credentials
+func pathXCCredential(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "xc-credential/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the XC tenant connection to use",
+				Required:    true,
+			},
+			"type": {
+				Type:        framework.TypeString,
+				Description: "Kind of credential to issue: api_token or api_certificate",
+				Default:     xcTypeAPIToken,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "TTL for the credential lease (in seconds)",
+				Default:     3600,
+			},
+			"purpose": {
+				Type:        framework.TypeString,
+				Description: "Free-form reason the credential is being requested, recorded with the credential",
+			},
+			"ticket": {
+				Type:        framework.TypeString,
+				Description: "Change or incident ticket reference, recorded with the credential",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathXCCredentialWrite,
+			},
+		},
+
+		HelpSynopsis:    "Issue an F5 Distributed Cloud API credential",
+		HelpDescription: "This endpoint creates an API token or API certificate on the XC tenant under a lease. Revoking the lease, or its expiry, revokes the credential on the tenant.",
+	}
+}
+
+// pathXCCredentialList defines the path for listing XC credentials issued through a connection
+func pathXCCredentialList(b *f5TokenBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "xc-credentials/" + framework.GenericNameRegex("name") + "/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the XC tenant connection",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathXCCredentialListRead,
+			},
+		},
+
+		HelpSynopsis:    "List F5 Distributed Cloud API credentials issued through a connection",
+		HelpDescription: "This endpoint lists the API credentials issued through an XC tenant connection, with their type, expiry and requester.",
+	}
+}
+
+// secretXCCredential defines the lease returned for XC API credentials
+func secretXCCredential(b *f5TokenBackend) *framework.Secret {
+	return &framework.Secret{
+		Type: secretXCCredentialType,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "API token",
+			},
+			"certificate": {
+				Type:        framework.TypeString,
+				Description: "Base64-encoded PKCS#12 bundle of the API certificate",
+			},
+		},
+		Revoke: b.secretXCCredentialRevoke,
+	}
+}
+
+// xcConnectionExistenceCheck checks if an XC tenant connection exists
+func (b *f5TokenBackend) xcConnectionExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	connection, err := b.getXCConnection(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return connection != nil, nil
+}
+
+// pathXCConnectionRead handles config/xc-connection read operations
+func (b *f5TokenBackend) pathXCConnectionRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	connection, err := b.getXCConnection(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return nil, nil
+	}
+
+	// Return all but the bootstrap token
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"tenant_url":   connection.TenantURL,
+			"insecure_ssl": connection.InsecureSSL,
+		},
+	}, nil
+}
+
+// pathXCConnectionWrite handles config/xc-connection write operations
+func (b *f5TokenBackend) pathXCConnectionWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("connection name cannot be empty"), nil
+	}
+
+	connection := &xcConnection{
+		TenantURL:   strings.TrimSuffix(data.Get("tenant_url").(string), "/"),
+		APIToken:    data.Get("api_token").(string),
+		InsecureSSL: data.Get("insecure_ssl").(bool),
+	}
+
+	if connection.TenantURL == "" || connection.APIToken == "" {
+		return logical.ErrorResponse("tenant_url and api_token are required"), nil
+	}
+	if err := validateHost(connection.TenantURL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.Backend.Logger().Info("configuring XC connection", "name", name, "tenant_url", connection.TenantURL)
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"success":    true,
+			"tenant_url": connection.TenantURL,
+		},
+	}
+
+	if data.Get("verify_connection").(bool) {
+		credentials, err := connection.client().ListCredentials()
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to list API credentials on XC tenant: %s", err)), nil
+		}
+		resp.Data["credentials"] = len(credentials)
+	}
+
+	entry, err := logical.StorageEntryJSON(xcConnectionStoragePrefix+name, connection)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// pathXCConnectionDelete handles config/xc-connection delete operations
+func (b *f5TokenBackend) pathXCConnectionDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("connection name cannot be empty"), nil
+	}
+
+	force := data.Get("force").(bool)
+	revokeOutstanding := data.Get("revoke_outstanding").(bool)
+
+	outstanding, err := b.outstandingXCCredentials(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{}
+
+	if len(outstanding) > 0 {
+		names := make([]string, 0, len(outstanding))
+		for _, credential := range outstanding {
+			names = append(names, credential.Name)
+		}
+
+		switch {
+		case revokeOutstanding:
+			_, failed, err := b.revokeXCRecords(ctx, req.Storage, outstanding)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(failed) > 0 && !force {
+				return logical.ErrorResponse(fmt.Sprintf("failed to revoke %d outstanding credential(s) for XC connection %s: %s; set force=true to delete anyway",
+					len(failed), name, strings.Join(sortedKeys(failed), ", "))), nil
+			}
+			for _, credential := range sortedKeys(failed) {
+				resp.AddWarning(fmt.Sprintf("credential %s could not be revoked and is now orphaned", credential))
+			}
+		case force:
+			resp.AddWarning(fmt.Sprintf("XC connection deleted with %d outstanding credential(s) that are now orphaned: %s",
+				len(names), strings.Join(names, ", ")))
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("XC connection %s has %d outstanding credential(s); set revoke_outstanding=true to revoke them or force=true to delete anyway",
+				name, len(names))), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, xcConnectionStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Warnings) == 0 {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// pathXCConnectionList handles config/xc-connections list operations
+func (b *f5TokenBackend) pathXCConnectionList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, xcConnectionStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+// pathXCCredentialWrite handles xc-credential/ write operations
+func (b *f5TokenBackend) pathXCCredentialWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	credentialType := data.Get("type").(string)
+	ttl := data.Get("ttl").(int)
+
+	var apiType string
+	switch credentialType {
+	case xcTypeAPIToken:
+		apiType = api.XCCredentialAPIToken
+	case xcTypeAPICertificate:
+		apiType = api.XCCredentialAPICertificate
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("type must be %s or %s", xcTypeAPIToken, xcTypeAPICertificate)), nil
+	}
+	if ttl <= 0 {
+		return logical.ErrorResponse("ttl must be positive"), nil
+	}
+	if ttl > xcMaxCredentialTTL {
+		return logical.ErrorResponse(fmt.Sprintf("ttl %d exceeds the XC maximum of %d seconds", ttl, xcMaxCredentialTTL)), nil
+	}
+
+	connection, err := b.getXCConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return logical.ErrorResponse(fmt.Sprintf("XC connection %s not found", name)), nil
+	}
+
+	// API certificates are bundled as PKCS#12, protected with a one-off password
+	var password string
+	if apiType == api.XCCredentialAPICertificate {
+		if password, err = randomHex(16); err != nil {
+			return nil, err
+		}
+	}
+
+	credentialName, err := xcCredentialName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tenant only expires credentials in whole days; the lease revokes
+	// the credential on time and the tenant expiry is a backstop
+	expirationDays := (ttl + 86399) / 86400
+
+	now := time.Now()
+	credential, err := connection.client().CreateCredential(credentialName, apiType, expirationDays, password)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error issuing XC credential: %s", err)), nil
+	}
+
+	credentialEntry := &xcCredentialEntry{
+		Name:                credential.Name,
+		Type:                credentialType,
+		Connection:          name,
+		CreatedAt:           now,
+		ExpiresAt:           now.Add(time.Duration(ttl) * time.Second),
+		IsActive:            true,
+		TenantExpiresAt:     credential.ExpirationTimestamp,
+		EntityID:            req.EntityID,
+		DisplayName:         req.DisplayName,
+		ClientTokenAccessor: req.ClientTokenAccessor,
+		MountPoint:          req.MountPoint,
+		Purpose:             data.Get("purpose").(string),
+		Ticket:              data.Get("ticket").(string),
+	}
+
+	if err := b.putXCCredentialEntry(ctx, req.Storage, credentialEntry); err != nil {
+		// Don't leave a credential behind that nothing will revoke
+		if revokeErr := connection.client().RevokeCredential(credential.Name); revokeErr != nil {
+			b.Backend.Logger().Error("failed to roll back XC credential", "credential", credential.Name, "error", revokeErr)
+		}
+		return nil, err
+	}
+
+	b.Backend.Logger().Info("issued XC credential", "name", name, "credential", credential.Name, "type", credentialType, "ttl", ttl)
+
+	respData := map[string]interface{}{
+		"name":       name,
+		"credential": credential.Name,
+		"type":       credentialType,
+		"expires_at": credentialEntry.ExpiresAt.Format(time.RFC3339),
+	}
+	if apiType == api.XCCredentialAPICertificate {
+		respData["certificate"] = credential.Data
+		respData["password"] = password
+	} else {
+		respData["token"] = credential.Data
+	}
+
+	resp := b.Secret(secretXCCredentialType).Response(respData, map[string]interface{}{
+		"connection": name,
+		"credential": credential.Name,
+	})
+	resp.Secret.TTL = time.Duration(ttl) * time.Second
+	resp.Secret.MaxTTL = resp.Secret.TTL
+
+	return resp, nil
+}
+
+// pathXCCredentialListRead handles xc-credentials/<name> list operations
+func (b *f5TokenBackend) pathXCCredentialListRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	credentials, err := b.listXCCredentials(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keys := make([]string, 0, len(credentials))
+	keyInfo := make(map[string]interface{}, len(credentials))
+	for _, credential := range credentials {
+		keys = append(keys, credential.Name)
+		keyInfo[credential.Name] = map[string]interface{}{
+			"type":         credential.Type,
+			"expires_at":   credential.ExpiresAt.Format(time.RFC3339),
+			"active":       credential.IsActive && now.Before(credential.ExpiresAt),
+			"entity_id":    credential.EntityID,
+			"display_name": credential.DisplayName,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// secretXCCredentialRevoke revokes the API credential behind an XC lease
+func (b *f5TokenBackend) secretXCCredentialRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, _ := req.Secret.InternalData["connection"].(string)
+	credentialName, _ := req.Secret.InternalData["credential"].(string)
+	if name == "" || credentialName == "" {
+		return nil, fmt.Errorf("XC lease is missing its connection or credential name")
+	}
+
+	credential, err := b.getXCCredentialEntry(ctx, req.Storage, name, credentialName)
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil || !credential.IsActive {
+		return nil, nil
+	}
+
+	connection, err := b.getXCConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		// The connection was force-deleted; the credential is orphaned
+		return nil, nil
+	}
+
+	return nil, b.revokeXCCredential(ctx, req.Storage, connection, credential)
+}
+
+// revokeXCCredential revokes a credential on its tenant and marks its record inactive
+func (b *f5TokenBackend) revokeXCCredential(ctx context.Context, storage logical.Storage, connection *xcConnection, credential *xcCredentialEntry) error {
+	if err := connection.client().RevokeCredential(credential.Name); err != nil {
+		return err
+	}
+
+	credential.IsActive = false
+	if err := b.putXCCredentialEntry(ctx, storage, credential); err != nil {
+		return err
+	}
+
+	b.Backend.Logger().Info("revoked XC credential", "name", credential.Connection, "credential", credential.Name)
+	return nil
+}
+
+// cleanupExpiredXCCredentials revokes XC credentials whose lease has run out
+// without being revoked, such as after a lost revocation
+func (b *f5TokenBackend) cleanupExpiredXCCredentials(ctx context.Context, req *logical.Request) error {
+	now := time.Now()
+
+	expired, err := b.findXCCredentials(ctx, req.Storage, "", func(credential *xcCredentialEntry) bool {
+		return credential.IsActive && now.After(credential.ExpiresAt)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The tenant expires credentials on its own, so records whose connection
+	// was force-deleted can be reaped rather than revoked
+	var live []*xcCredentialEntry
+	for _, credential := range expired {
+		connection, err := b.getXCConnection(ctx, req.Storage, credential.Connection)
+		if err != nil {
+			return err
+		}
+		if connection != nil {
+			live = append(live, credential)
+			continue
+		}
+
+		b.Backend.Logger().Warn("reaping orphaned XC credential whose connection no longer exists", "credential", credential.Name, "name", credential.Connection)
+		if err := req.Storage.Delete(ctx, xcCredentialStoragePath(credential.Connection, credential.Name)); err != nil {
+			b.Backend.Logger().Error("error deleting orphaned XC credential", "credential", credential.Name, "error", err)
+		}
+	}
+
+	_, _, err = b.revokeXCRecords(ctx, req.Storage, live)
+	return err
+}
+
+// revokeXCRecords revokes every active credential in credentials on its
+// tenant, like revokeRecords does for device tokens, and returns the names
+// of those revoked and the errors of those that failed
+func (b *f5TokenBackend) revokeXCRecords(ctx context.Context, storage logical.Storage, credentials []*xcCredentialEntry) ([]string, map[string]interface{}, error) {
+	connections := make(map[string]*xcConnection)
+	revoked := []string{}
+	failed := map[string]interface{}{}
+
+	for _, credential := range credentials {
+		if !credential.IsActive {
+			continue
+		}
+
+		connection, ok := connections[credential.Connection]
+		if !ok {
+			var err error
+			connection, err = b.getXCConnection(ctx, storage, credential.Connection)
+			if err != nil {
+				return nil, nil, err
+			}
+			connections[credential.Connection] = connection
+		}
+		if connection == nil {
+			failed[credential.Name] = fmt.Sprintf("XC connection %s not found", credential.Connection)
+			continue
+		}
+
+		if err := b.revokeXCCredential(ctx, storage, connection, credential); err != nil {
+			b.Backend.Logger().Error("failed to revoke XC credential", "credential", credential.Name, "error", err)
+			failed[credential.Name] = err.Error()
+			continue
+		}
+
+		revoked = append(revoked, credential.Name)
+	}
+
+	return revoked, failed, nil
+}
+
+// getXCConnection loads a named XC tenant connection, returning nil if it does not exist
+func (b *f5TokenBackend) getXCConnection(ctx context.Context, storage logical.Storage, name string) (*xcConnection, error) {
+	entry, err := storage.Get(ctx, xcConnectionStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var connection xcConnection
+	if err := entry.DecodeJSON(&connection); err != nil {
+		return nil, err
+	}
+
+	return &connection, nil
+}
+
+// client creates an XC API client for the tenant
+func (c *xcConnection) client() *api.XCClient {
+	return api.NewXCClient(c.TenantURL, c.APIToken, c.InsecureSSL)
+}
+
+// getXCCredentialEntry loads an XC credential record, returning nil if it does not exist
+func (b *f5TokenBackend) getXCCredentialEntry(ctx context.Context, storage logical.Storage, connection, name string) (*xcCredentialEntry, error) {
+	entry, err := storage.Get(ctx, xcCredentialStoragePath(connection, name))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var credential xcCredentialEntry
+	if err := entry.DecodeJSON(&credential); err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+// putXCCredentialEntry stores an XC credential record
+func (b *f5TokenBackend) putXCCredentialEntry(ctx context.Context, storage logical.Storage, credential *xcCredentialEntry) error {
+	entry, err := logical.StorageEntryJSON(xcCredentialStoragePath(credential.Connection, credential.Name), credential)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, entry)
+}
+
+// listXCCredentials returns every credential record of a connection, sorted by name
+func (b *f5TokenBackend) listXCCredentials(ctx context.Context, storage logical.Storage, connection string) ([]*xcCredentialEntry, error) {
+	names, err := storage.List(ctx, xcCredentialStoragePrefix+connection+"/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	credentials := make([]*xcCredentialEntry, 0, len(names))
+	for _, name := range names {
+		credential, err := b.getXCCredentialEntry(ctx, storage, connection, name)
+		if err != nil {
+			return nil, err
+		}
+		if credential != nil {
+			credentials = append(credentials, credential)
+		}
+	}
+
+	return credentials, nil
+}
+
+// outstandingXCCredentials returns the active credential records of a connection
+func (b *f5TokenBackend) outstandingXCCredentials(ctx context.Context, storage logical.Storage, connection string) ([]*xcCredentialEntry, error) {
+	return b.findXCCredentials(ctx, storage, connection, func(credential *xcCredentialEntry) bool {
+		return credential.IsActive
+	})
+}
+
+// findXCCredentials returns the credential records matching keep, across
+// every XC connection or, if connection is set, only that one
+func (b *f5TokenBackend) findXCCredentials(ctx context.Context, storage logical.Storage, connection string, keep func(*xcCredentialEntry) bool) ([]*xcCredentialEntry, error) {
+	names := []string{connection}
+	if connection == "" {
+		keys, err := storage.List(ctx, xcCredentialStoragePrefix)
+		if err != nil {
+			return nil, err
+		}
+		names = names[:0]
+		for _, key := range keys {
+			if strings.HasSuffix(key, "/") {
+				names = append(names, strings.TrimSuffix(key, "/"))
+			}
+		}
+	}
+
+	var found []*xcCredentialEntry
+	for _, name := range names {
+		credentials, err := b.listXCCredentials(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, credential := range credentials {
+			if keep(credential) {
+				found = append(found, credential)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// xcCredentialName returns a unique name for a credential issued through a
+// connection, valid as an XC object name
+func xcCredentialName(connection string) (string, error) {
+	suffix, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := strings.Trim(invalidXCNameChars.ReplaceAllString(strings.ToLower(connection), "-"), "-")
+	if len(prefix) > 32 {
+		prefix = strings.TrimRight(prefix[:32], "-")
+	}
+
+	if prefix == "" {
+		return fmt.Sprintf("vault-%d-%s", time.Now().Unix(), suffix), nil
+	}
+	return fmt.Sprintf("vault-%s-%d-%s", prefix, time.Now().Unix(), suffix), nil
+}
+
+// randomHex returns n random bytes, hex-encoded
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
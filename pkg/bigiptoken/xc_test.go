@@ -0,0 +1,277 @@
+package bigiptoken
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// xcTestAPIToken is the bootstrap token the XC stand-in accepts
+const xcTestAPIToken = "bootstrap-token"
+
+// xcTenant is a local stand-in for the API credential endpoints of an
+// F5 Distributed Cloud tenant
+type xcTenant struct {
+	mu          sync.Mutex
+	credentials map[string]string
+}
+
+// newXCTenant starts an XC stand-in; close the returned server when done
+func newXCTenant(t *testing.T) (*xcTenant, *httptest.Server) {
+	t.Helper()
+
+	tenant := &xcTenant{credentials: make(map[string]string)}
+	srv := httptest.NewTLSServer(http.HandlerFunc(tenant.serveHTTP))
+	t.Cleanup(srv.Close)
+
+	return tenant, srv
+}
+
+func (x *xcTenant) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "APIToken "+xcTestAPIToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/web/namespaces/system/api_credentials":
+		items := []map[string]string{}
+		for _, name := range x.names() {
+			items = append(items, map[string]string{"name": name})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case r.Method == "POST" && r.URL.Path == "/api/web/namespaces/system/api_credentials":
+		var body struct {
+			Name string `json:"name"`
+			Spec struct {
+				Type           string `json:"type"`
+				ExpirationDays int    `json:"expiration_days"`
+			} `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		x.credentials[body.Name] = body.Spec.Type
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":                 body.Name,
+			"active":               true,
+			"expiration_timestamp": time.Now().AddDate(0, 0, body.Spec.ExpirationDays).Format(time.RFC3339),
+			"data":                 "secret-" + body.Name,
+		})
+
+	case r.Method == "POST" && r.URL.Path == "/api/web/namespaces/system/revoke/api_credentials":
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := x.credentials[body.Name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(x.credentials, body.Name)
+		w.Write([]byte("{}"))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// names returns the names of the credentials on the tenant; x.mu must be held
+func (x *xcTenant) names() []string {
+	names := make([]string, 0, len(x.credentials))
+	for name := range x.credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// has reports whether a credential exists on the tenant
+func (x *xcTenant) has(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	_, ok := x.credentials[name]
+	return ok
+}
+
+// xcRequest sends a request to the backend as the given Vault entity and
+// fails the test on internal or error responses
+func xcRequest(t *testing.T, b *f5TokenBackend, storage logical.Storage, op logical.Operation, path, entityID string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Storage:   storage,
+		EntityID:  entityID,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatalf("%s %s: %v", op, path, err)
+	}
+	if resp != nil && resp.IsError() {
+		t.Fatalf("%s %s: %v", op, path, resp.Error())
+	}
+	return resp
+}
+
+// setupXC returns a backend with an XC connection named acme pointing at a stand-in tenant
+func setupXC(t *testing.T) (*f5TokenBackend, logical.Storage, *xcTenant) {
+	t.Helper()
+
+	b, storage := testBackend(t)
+	tenant, srv := newXCTenant(t)
+
+	resp := xcRequest(t, b, storage, logical.CreateOperation, "config/xc-connection/acme", "", map[string]interface{}{
+		"tenant_url":   srv.URL,
+		"api_token":    xcTestAPIToken,
+		"insecure_ssl": true,
+	})
+	if resp.Data["credentials"] != 0 {
+		t.Fatalf("expected the connection to be verified against an empty tenant, got %v", resp.Data)
+	}
+
+	return b, storage, tenant
+}
+
+func TestXCCredentialIssueAndLeaseRevoke(t *testing.T) {
+	b, storage, tenant := setupXC(t)
+
+	resp := xcRequest(t, b, storage, logical.UpdateOperation, "xc-credential/acme", "", map[string]interface{}{
+		"type": xcTypeAPICertificate,
+		"ttl":  "4h",
+	})
+	name := resp.Data["credential"].(string)
+	if !tenant.has(name) {
+		t.Fatalf("credential %s was not created on the tenant", name)
+	}
+	if resp.Data["certificate"] != "secret-"+name || resp.Data["password"] == "" {
+		t.Fatalf("unexpected certificate response: %v", resp.Data)
+	}
+	if resp.Secret == nil || resp.Secret.TTL != 4*time.Hour {
+		t.Fatalf("expected a 4h lease, got %+v", resp.Secret)
+	}
+
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   storage,
+		Secret:    resp.Secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant.has(name) {
+		t.Fatalf("credential %s was not revoked on the tenant", name)
+	}
+
+	credential, err := b.getXCCredentialEntry(context.Background(), storage, "acme", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential == nil || credential.IsActive {
+		t.Fatalf("expected an inactive record, got %+v", credential)
+	}
+}
+
+func TestXCCredentialRevokeEntityAndRevokeAll(t *testing.T) {
+	b, storage, tenant := setupXC(t)
+
+	issue := func(entityID string) string {
+		resp := xcRequest(t, b, storage, logical.UpdateOperation, "xc-credential/acme", entityID, nil)
+		return resp.Data["credential"].(string)
+	}
+	first := issue("entity-1")
+	second := issue("entity-2")
+
+	resp := xcRequest(t, b, storage, logical.UpdateOperation, "revoke-entity/entity-1", "", nil)
+	if revoked := resp.Data["revoked"].([]string); len(revoked) != 1 || revoked[0] != first {
+		t.Fatalf("expected revoke-entity to revoke %s, got %v", first, resp.Data)
+	}
+	if tenant.has(first) || !tenant.has(second) {
+		t.Fatalf("expected only %s to be revoked on the tenant", first)
+	}
+
+	resp = xcRequest(t, b, storage, logical.UpdateOperation, "revoke-all/acme", "", nil)
+	if revoked := resp.Data["revoked"].([]string); len(revoked) != 1 || revoked[0] != second {
+		t.Fatalf("expected revoke-all to revoke %s, got %v", second, resp.Data)
+	}
+	if tenant.has(second) {
+		t.Fatalf("credential %s was not revoked on the tenant", second)
+	}
+
+	// Nothing is left for the connection delete to refuse over
+	xcRequest(t, b, storage, logical.DeleteOperation, "config/xc-connection/acme", "", nil)
+}
+
+func TestXCCleanupExpiredCredentials(t *testing.T) {
+	b, storage, tenant := setupXC(t)
+	ctx := context.Background()
+
+	resp := xcRequest(t, b, storage, logical.UpdateOperation, "xc-credential/acme", "", nil)
+	expired := resp.Data["credential"].(string)
+	resp = xcRequest(t, b, storage, logical.UpdateOperation, "xc-credential/acme", "", nil)
+	current := resp.Data["credential"].(string)
+
+	// Simulate a lost lease revocation
+	credential, err := b.getXCCredentialEntry(ctx, storage, "acme", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := b.putXCCredentialEntry(ctx, storage, credential); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.cleanupExpiredXCCredentials(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.has(expired) || !tenant.has(current) {
+		t.Fatalf("expected only %s to be revoked on the tenant", expired)
+	}
+
+	credential, err = b.getXCCredentialEntry(ctx, storage, "acme", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.IsActive {
+		t.Fatalf("expected %s to be marked inactive", expired)
+	}
+
+	// Records of a force-deleted connection are reaped instead
+	xcRequest(t, b, storage, logical.DeleteOperation, "config/xc-connection/acme", "", map[string]interface{}{"force": true})
+	credential, err = b.getXCCredentialEntry(ctx, storage, "acme", current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := b.putXCCredentialEntry(ctx, storage, credential); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.cleanupExpiredXCCredentials(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	credential, err = b.getXCCredentialEntry(ctx, storage, "acme", current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential != nil {
+		t.Fatalf("expected the orphaned record of %s to be deleted", current)
+	}
+}